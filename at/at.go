@@ -0,0 +1,399 @@
+package at
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"github.com/zsy-cn/4g-gateway/pkg/serial"
+)
+
+// DefaultTimeout 命令未指定超时时间时使用的超时时间
+const DefaultTimeout = 5 * time.Second
+
+// urcQueue 等待分发的 URC 条数，超出时丢弃
+const urcQueue = 64
+
+var (
+	// ErrTimeout 超时时间内没有收到最终结果
+	ErrTimeout = errors.New("at: command timeout")
+	// ErrClosed 串口已关闭
+	ErrClosed = errors.New("at: port closed")
+)
+
+// Error 模块返回的错误结果，Result 为 ERROR、+CME ERROR、+CMS ERROR、NO CARRIER 等
+// Code 为 +CME ERROR、+CMS ERROR 的错误码，其他结果为 -1
+type Error struct {
+	Command string
+	Result  string
+	Code    int
+	Message string // 错误码不是数字时的文本，如 AT+CMEE=2 时的 SIM not inserted
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Code >= 0:
+		return fmt.Sprintf("at: %s: %s: %d", e.Command, e.Result, e.Code)
+	case len(e.Message) > 0:
+		return fmt.Sprintf("at: %s: %s: %s", e.Command, e.Result, e.Message)
+	}
+	return fmt.Sprintf("at: %s: %s", e.Command, e.Result)
+}
+
+// IsCME 是否为指定错误码的 +CME ERROR
+func IsCME(err error, code int) bool {
+	var atErr *Error
+	return errors.As(err, &atErr) && atErr.Result == "+CME ERROR" && atErr.Code == code
+}
+
+// Response 命令的响应，Lines 为最终结果之前的行，不包括回显和空行
+type Response struct {
+	Command string
+	Lines   []string
+}
+
+// Value 第一个以 prefix (如 +CSQ:) 开头的行去掉前缀后的内容
+func (r *Response) Value(prefix string) (string, bool) {
+	for _, line := range r.Lines {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, prefix)), true
+		}
+	}
+	return "", false
+}
+
+// request 等待最终结果的命令
+type request struct {
+	command string
+	prefix  string // 命令的响应前缀，如 AT+CREG? 为 +CREG:，同名的 URC 在命令执行期间作为响应
+	lines   []string
+	done    chan error
+}
+
+// subscriber URC 订阅
+type subscriber struct {
+	prefix  string
+	handler func(line string)
+}
+
+// Engine AT 命令引擎
+// 命令依次执行，多个协程可以同时调用 Command；不属于当前命令的行作为 URC 分发给订阅者
+type Engine struct {
+	log  *logger.Logger
+	port io.ReadWriteCloser
+
+	cmdMu sync.Mutex // 保证同一时间只有一条命令
+
+	mu          sync.Mutex
+	pending     *request
+	subscribers []*subscriber
+	closed      bool
+
+	urcs chan string
+	done chan struct{}
+}
+
+// New 在已打开的串口上创建引擎，启动读取和 URC 分发协程
+func New(log *logger.Logger, port io.ReadWriteCloser) *Engine {
+	e := &Engine{
+		log:  log,
+		port: port,
+		urcs: make(chan string, urcQueue),
+		done: make(chan struct{}),
+	}
+	go e.read()
+	go e.dispatch()
+	return e
+}
+
+// Open 打开 AT 串口并关闭回显
+func Open(log *logger.Logger, name string) (*Engine, error) {
+	port, err := serial.OpenPort(&serial.Config{
+		Name:        name,
+		Baud:        115200,
+		ReadTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	e := New(log, port)
+	if _, err := e.Command("ATE0", 0); err != nil {
+		log.WithFields(logger.Fields{
+			"at":   "open",
+			"port": name,
+		}).Warn("Disable echo: ", err)
+	}
+	return e, nil
+}
+
+// shared 每个串口共用的引擎
+var shared struct {
+	sync.Mutex
+	engines map[string]*Engine
+}
+
+// Shared 串口 name 共用的引擎，第一次调用时打开串口
+// 同一个串口上的模块都应该使用 Shared，由引擎保证命令依次执行
+func Shared(log *logger.Logger, name string) (*Engine, error) {
+	shared.Lock()
+	defer shared.Unlock()
+	if e, ok := shared.engines[name]; ok {
+		return e, nil
+	}
+	e, err := Open(log, name)
+	if err != nil {
+		return nil, err
+	}
+	if shared.engines == nil {
+		shared.engines = make(map[string]*Engine)
+	}
+	shared.engines[name] = e
+	return e, nil
+}
+
+// Command 发送命令 (不包括结尾的 \r) 并等待最终结果
+// timeout 为 0 时使用 DefaultTimeout；模块返回错误结果时 err 为 *Error，响应中仍包含已收到的行
+func (e *Engine) Command(command string, timeout time.Duration) (*Response, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	e.cmdMu.Lock()
+	defer e.cmdMu.Unlock()
+
+	req := &request{
+		command: command,
+		prefix:  responsePrefix(command),
+		done:    make(chan error, 1),
+	}
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil, ErrClosed
+	}
+	e.pending = req
+	e.mu.Unlock()
+
+	e.log.WithFields(logger.Fields{
+		"at": "command",
+	}).Debug(command)
+	if _, err := e.port.Write([]byte(command + "\r")); err != nil {
+		e.finish(req)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-req.done:
+	case <-timer.C:
+		err = ErrTimeout
+	case <-e.done:
+		err = ErrClosed
+	}
+	e.finish(req)
+
+	e.mu.Lock()
+	response := &Response{Command: command, Lines: req.lines}
+	e.mu.Unlock()
+	if err != nil {
+		e.log.WithFields(logger.Fields{
+			"at":      "command",
+			"command": command,
+		}).Debug("Command failed: ", err)
+	}
+	return response, err
+}
+
+// finish 命令结束，之后收到的行作为 URC
+func (e *Engine) finish(req *request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == req {
+		e.pending = nil
+	}
+}
+
+// Subscribe 订阅以 prefix (如 +QIND:、RING) 开头的 URC，返回取消订阅的函数
+// handler 在分发协程中依次调用，可以在其中执行命令，但不应长时间阻塞
+func (e *Engine) Subscribe(prefix string, handler func(line string)) (unsubscribe func()) {
+	s := &subscriber{prefix: prefix, handler: handler}
+	e.mu.Lock()
+	e.subscribers = append(e.subscribers, s)
+	e.mu.Unlock()
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for i, subscriber := range e.subscribers {
+			if subscriber == s {
+				e.subscribers = append(e.subscribers[:i:i], e.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Close 关闭串口，正在执行的命令返回 ErrClosed
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.mu.Unlock()
+	close(e.done)
+	return e.port.Close()
+}
+
+// read 读取串口，按行交给 handleLine
+func (e *Engine) read() {
+	buf := make([]byte, 256)
+	var line []byte
+	for {
+		n, err := e.port.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\r' || b == '\n' {
+				if len(line) > 0 {
+					e.handleLine(string(line))
+					line = line[:0]
+				}
+				continue
+			}
+			line = append(line, b)
+		}
+		if err == nil || err == io.EOF {
+			// 串口读超时返回 0 字节
+			select {
+			case <-e.done:
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-e.done:
+			return
+		default:
+		}
+		e.log.WithFields(logger.Fields{
+			"at": "read",
+		}).Error("Read port: ", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// handleLine 将一行交给当前命令或作为 URC 分发
+func (e *Engine) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	e.mu.Lock()
+	req := e.pending
+	if req != nil && !e.isURC(req, line) {
+		if line == req.command {
+			// 回显
+			e.mu.Unlock()
+			return
+		}
+		if final, err := finalResult(req.command, line); final {
+			e.pending = nil
+			e.mu.Unlock()
+			req.done <- err
+			return
+		}
+		req.lines = append(req.lines, line)
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+
+	select {
+	case e.urcs <- line:
+	default:
+		e.log.WithFields(logger.Fields{
+			"at": "urc",
+		}).Warn("URC queue full, dropped: ", line)
+	}
+}
+
+// isURC 命令执行期间，与订阅前缀匹配且不是命令自身响应的行作为 URC
+func (e *Engine) isURC(req *request, line string) bool {
+	if len(req.prefix) > 0 && strings.HasPrefix(line, req.prefix) {
+		return false
+	}
+	for _, s := range e.subscribers {
+		if strings.HasPrefix(line, s.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch 将 URC 交给订阅者
+func (e *Engine) dispatch() {
+	for {
+		select {
+		case <-e.done:
+			return
+		case line := <-e.urcs:
+			e.mu.Lock()
+			var handlers []func(string)
+			for _, s := range e.subscribers {
+				if strings.HasPrefix(line, s.prefix) {
+					handlers = append(handlers, s.handler)
+				}
+			}
+			e.mu.Unlock()
+			if len(handlers) == 0 {
+				e.log.WithFields(logger.Fields{
+					"at": "urc",
+				}).Debug("Unhandled URC: ", line)
+			}
+			for _, handler := range handlers {
+				handler(line)
+			}
+		}
+	}
+}
+
+// responsePrefix 命令的响应前缀，AT+CSQ、AT+CREG?、AT+QGPSCFG="..." 分别为 +CSQ:、+CREG:、+QGPSCFG:
+func responsePrefix(command string) string {
+	upper := strings.ToUpper(command)
+	if !strings.HasPrefix(upper, "AT+") && !strings.HasPrefix(upper, "AT$") {
+		return ""
+	}
+	name := command[2:]
+	if i := strings.IndexAny(name, "=?"); i >= 0 {
+		name = name[:i]
+	}
+	return name + ":"
+}
+
+// finalResult 判断是否为最终结果，错误结果返回 *Error
+func finalResult(command, line string) (bool, error) {
+	switch line {
+	case "OK":
+		return true, nil
+	case "ERROR", "NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE":
+		return true, &Error{Command: command, Result: line, Code: -1}
+	}
+	for _, result := range []string{"+CME ERROR", "+CMS ERROR"} {
+		if !strings.HasPrefix(line, result+":") {
+			continue
+		}
+		text := strings.TrimSpace(strings.TrimPrefix(line, result+":"))
+		code, err := strconv.Atoi(text)
+		if err != nil {
+			return true, &Error{Command: command, Result: result, Code: -1, Message: text}
+		}
+		return true, &Error{Command: command, Result: result, Code: code}
+	}
+	return false, nil
+}
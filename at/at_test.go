@@ -0,0 +1,235 @@
+package at
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+func TestFinalResult(t *testing.T) {
+	tests := []struct {
+		line       string
+		final      bool
+		wantResult string
+		wantCode   int
+		wantMsg    string
+	}{
+		{line: "OK", final: true},
+		{line: "ERROR", final: true, wantResult: "ERROR", wantCode: -1},
+		{line: "NO CARRIER", final: true, wantResult: "NO CARRIER", wantCode: -1},
+		{line: "BUSY", final: true, wantResult: "BUSY", wantCode: -1},
+		{line: "+CME ERROR: 10", final: true, wantResult: "+CME ERROR", wantCode: 10},
+		{line: "+CME ERROR: SIM not inserted", final: true, wantResult: "+CME ERROR", wantCode: -1, wantMsg: "SIM not inserted"},
+		{line: "+CMS ERROR: 500", final: true, wantResult: "+CMS ERROR", wantCode: 500},
+		{line: "+CSQ: 20,99", final: false},
+		{line: "OKAY", final: false},
+		{line: "+CME ERRORS", final: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			final, err := finalResult("AT+CSQ", tt.line)
+			if final != tt.final {
+				t.Fatalf("final %v, want %v", final, tt.final)
+			}
+			if len(tt.wantResult) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			var atErr *Error
+			if !errors.As(err, &atErr) {
+				t.Fatalf("error %v, want *Error", err)
+			}
+			if atErr.Command != "AT+CSQ" || atErr.Result != tt.wantResult || atErr.Code != tt.wantCode || atErr.Message != tt.wantMsg {
+				t.Fatalf("error %+v", atErr)
+			}
+		})
+	}
+}
+
+func TestIsCME(t *testing.T) {
+	_, err := finalResult("AT+CPIN?", "+CME ERROR: 10")
+	if !IsCME(err, 10) {
+		t.Fatal("IsCME(10) false")
+	}
+	if IsCME(err, 13) {
+		t.Fatal("IsCME(13) true")
+	}
+	_, err = finalResult("AT+CMGS", "+CMS ERROR: 10")
+	if IsCME(err, 10) {
+		t.Fatal("+CMS ERROR reported as +CME ERROR")
+	}
+}
+
+func TestResponsePrefix(t *testing.T) {
+	tests := map[string]string{
+		"AT+CSQ":                      "+CSQ:",
+		"AT+CREG?":                    "+CREG:",
+		"AT+CREG=2":                   "+CREG:",
+		`AT+QGPSCFG="outport","none"`: "+QGPSCFG:",
+		"AT+QENG=\"servingcell\"":     "+QENG:",
+		"at+cops?":                    "+cops:",
+		"ATE0":                        "",
+		"ATI":                         "",
+	}
+	for command, want := range tests {
+		if got := responsePrefix(command); got != want {
+			t.Errorf("responsePrefix(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestResponseValue(t *testing.T) {
+	r := &Response{Lines: []string{"+QENG: \"servingcell\",\"NOCONN\"", "+CSQ: 20,99"}}
+	if v, ok := r.Value("+CSQ:"); !ok || v != "20,99" {
+		t.Fatalf("Value = %q, %v", v, ok)
+	}
+	if _, ok := r.Value("+CREG:"); ok {
+		t.Fatal("missing prefix found")
+	}
+}
+
+// fakeModem 模拟模块的串口，Write 收到的命令写入 commands，send 写入模块的输出
+type fakeModem struct {
+	r        *io.PipeReader
+	w        *io.PipeWriter
+	commands chan string
+}
+
+func newFakeModem() *fakeModem {
+	r, w := io.Pipe()
+	return &fakeModem{r: r, w: w, commands: make(chan string, 16)}
+}
+
+func (m *fakeModem) Read(p []byte) (int, error) { return m.r.Read(p) }
+
+func (m *fakeModem) Write(p []byte) (int, error) {
+	m.commands <- strings.TrimSuffix(string(p), "\r")
+	return len(p), nil
+}
+
+func (m *fakeModem) Close() error {
+	m.w.Close()
+	return m.r.Close()
+}
+
+func (m *fakeModem) send(lines ...string) {
+	m.w.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+// reply 收到 command 后依次输出 lines
+func (m *fakeModem) reply(t *testing.T, command string, lines ...string) {
+	go func() {
+		select {
+		case got := <-m.commands:
+			if got != command {
+				t.Errorf("modem received %q, want %q", got, command)
+			}
+			m.send(lines...)
+		case <-time.After(5 * time.Second):
+			t.Errorf("modem did not receive %q", command)
+		}
+	}()
+}
+
+func newTestEngine(t *testing.T) (*Engine, *fakeModem) {
+	log := logger.New()
+	log.SetOutput(ioutil.Discard)
+	modem := newFakeModem()
+	e := New(log, modem)
+	t.Cleanup(func() { e.Close() })
+	return e, modem
+}
+
+func TestEngineInterleavedURC(t *testing.T) {
+	e, modem := newTestEngine(t)
+	urcs := make(chan string, 4)
+	e.Subscribe("+QIND:", func(line string) { urcs <- line })
+
+	// 回显、URC 和命令响应交错输出
+	modem.reply(t, "AT+CSQ", "AT+CSQ", `+QIND: "csq",20,99`, "+CSQ: 20,99", "", "OK")
+	response, err := e.Command("AT+CSQ", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Lines) != 1 || response.Lines[0] != "+CSQ: 20,99" {
+		t.Fatalf("lines %q", response.Lines)
+	}
+	select {
+	case line := <-urcs:
+		if line != `+QIND: "csq",20,99` {
+			t.Fatalf("urc %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("URC not dispatched")
+	}
+}
+
+func TestEngineSamePrefixURC(t *testing.T) {
+	e, modem := newTestEngine(t)
+	urcs := make(chan string, 4)
+	e.Subscribe("+CREG:", func(line string) { urcs <- line })
+
+	// 命令执行期间同名的行是命令的响应，不作为 URC
+	modem.reply(t, "AT+CREG?", "+CREG: 2,1,\"1A2B\",\"0C3D4E5\",7", "OK")
+	response, err := e.Command("AT+CREG?", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := response.Value("+CREG:"); v != `2,1,"1A2B","0C3D4E5",7` {
+		t.Fatalf("value %q", v)
+	}
+
+	// 没有命令时作为 URC 分发
+	modem.send("+CREG: 5")
+	select {
+	case line := <-urcs:
+		if line != "+CREG: 5" {
+			t.Fatalf("urc %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("URC not dispatched")
+	}
+	if len(urcs) != 0 {
+		t.Fatalf("command response dispatched as URC: %q", <-urcs)
+	}
+}
+
+func TestEngineErrorResult(t *testing.T) {
+	e, modem := newTestEngine(t)
+	modem.reply(t, "AT+CPIN?", "+CME ERROR: 10")
+	_, err := e.Command("AT+CPIN?", time.Second)
+	if !IsCME(err, 10) {
+		t.Fatalf("error %v, want +CME ERROR: 10", err)
+	}
+}
+
+func TestEngineTimeoutAndClose(t *testing.T) {
+	e, modem := newTestEngine(t)
+	go func() { <-modem.commands }()
+	if _, err := e.Command("AT+COPS?", 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("error %v, want ErrTimeout", err)
+	}
+
+	// 超时后迟到的结果不影响下一条命令
+	modem.send("OK")
+	modem.reply(t, "ATI", "Quectel", "EC20F", "Revision: EC20CEFAGR06A15M4G", "OK")
+	response, err := e.Command("ATI", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Lines) != 3 {
+		t.Fatalf("lines %q", response.Lines)
+	}
+
+	e.Close()
+	if _, err := e.Command("AT", time.Second); err != ErrClosed {
+		t.Fatalf("error %v, want ErrClosed", err)
+	}
+}
@@ -9,12 +9,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/zsy-cn/4g-gateway/command"
 	"github.com/zsy-cn/4g-gateway/config"
 	"github.com/zsy-cn/4g-gateway/gpio"
 	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/outbox"
 	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/serial"
-	"gorm.io/gorm"
 )
 
 // MAXRWLEN 二维码最大长度
@@ -22,9 +23,11 @@ const MAXRWLEN = 2048
 
 // BootUp mqtt
 type BootUp struct {
-	Time    time.Time `json:"time"`
-	Account string    `json:"account"`
-	Status  int       `json:"status"`
+	Time     time.Time `json:"time"`
+	Account  string    `json:"account"`
+	Status   int       `json:"status"`
+	Operator string    `json:"operator,omitempty"` // 远程开机的操作员
+	Reason   string    `json:"reason,omitempty"`   // 远程开机的原因
 }
 
 // Qrcode qrcode
@@ -35,7 +38,7 @@ type Qrcode struct {
 
 // CameraConfig 扫码配置
 type CameraConfig struct {
-	DB                   *gorm.DB
+	Outbox               *outbox.Outbox
 	ControlGPIO          *gpio.Pin
 	RunningGPIO          *gpio.Pin
 	CameraSerialPort     *serial.Port
@@ -44,6 +47,9 @@ type CameraConfig struct {
 	QRCodeExpirationTime int
 	RoleID               string
 	TempRoleID           string
+	QRCodes              chan string      // 扫码结果，只在等待扫码时接收
+	Unlocks              chan UnlockToken // 远程开机请求，只在等待扫码时接收
+	SessionEnd           time.Time        // 远程开机的结束时间，扫码开机时为零值
 }
 
 type DeviceState string                                 // 状态
@@ -55,18 +61,45 @@ type Device struct {
 	Mu       sync.Mutex                                    // 排他锁
 	State    DeviceState                                   // 当前状态
 	Handlers map[DeviceState]map[DeviceEvent]DeviceHandler // 处理函数，每一个状态都可以出发有限个事件，执行有限个处理
+
+	stateMu sync.RWMutex // 保护 State，供其他协程读取当前状态
 }
 
 // 获取当前状态
 func (d *Device) getState() DeviceState {
+	d.stateMu.RLock()
+	defer d.stateMu.RUnlock()
 	return d.State
 }
 
 // 设置当前状态
 func (d *Device) setState(newState DeviceState) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
 	d.State = newState
 }
 
+// Current 当前状态，可以在其他协程中调用
+func (d *Device) Current() DeviceState {
+	return d.getState()
+}
+
+// running 运行中的状态机，供心跳等模块读取状态
+var running struct {
+	sync.RWMutex
+	device *Device
+}
+
+// State 运行中的状态机的当前状态，尚未启动时为空
+func State() DeviceState {
+	running.RLock()
+	defer running.RUnlock()
+	if running.device == nil {
+		return ""
+	}
+	return running.device.Current()
+}
+
 // 某状态添加事件处理方法
 func (d *Device) AddHandler(state DeviceState, event DeviceEvent, handler DeviceHandler) *Device {
 	if _, ok := d.Handlers[state]; !ok {
@@ -116,7 +149,7 @@ var (
 	InterQRCodeHandler = DeviceHandler(func(args []interface{}) DeviceState {
 		cameraConfig := args[0].(*CameraConfig)
 		log := args[1].(*logger.Logger)
-		db := args[2].(*gorm.DB)
+		ob := args[2].(*outbox.Outbox)
 		accountold := cameraConfig.TempRoleID
 
 		log.WithFields(logger.Fields{
@@ -124,27 +157,16 @@ var (
 		}).Info("开始扫码!")
 
 		for {
-			buffer := make([]byte, MAXRWLEN)
-			var tmpstr string = ""
-			for {
-				num, err := cameraConfig.CameraSerialPort.Read(buffer)
-				if err != nil {
-					log.WithFields(logger.Fields{
-						"camera": "serial",
-					}).Error("摄像头串口读取失败: %v", err)
-				}
-				if num > 0 {
-					tmpstr += string(buffer[:num])
-				}
-				// 查找读到信息的结尾标志
-				if strings.LastIndex(tmpstr, "\r") > 0 {
-					break
-				}
+			var tmpstr string
+			select {
+			case tmpstr = <-cameraConfig.QRCodes:
+			case unlock := <-cameraConfig.Unlocks:
+				return UnlockDevice(cameraConfig, log, ob, unlock)
 			}
 			// 打印输出读到的信息
 			log.WithFields(logger.Fields{
 				"camera": "serial",
-			}).Info("摄像头读取内容: %s", tmpstr)
+			}).Infof("摄像头读取内容: %s", tmpstr)
 
 			decoded, err := base64.StdEncoding.DecodeString(tmpstr)
 			if err != nil {
@@ -156,7 +178,7 @@ var (
 			decodestr := string(decoded)
 			log.WithFields(logger.Fields{
 				"camera": "serial",
-			}).Info("decodestr qrcode: %s", decodestr)
+			}).Infof("decodestr qrcode: %s", decodestr)
 
 			tempQ := Qrcode{}
 			err = json.Unmarshal(decoded, &tempQ)
@@ -208,6 +230,7 @@ var (
 					continue
 				}
 				// 开机
+				cameraConfig.SessionEnd = time.Time{}
 				cameraConfig.ControlGPIO.Write(gpio.HIGH)
 				log.WithFields(logger.Fields{
 					"camera": "serial",
@@ -215,7 +238,11 @@ var (
 				log.WithFields(logger.Fields{
 					"status": "1",
 				}).Info("成功扫码，写入 MQTT 信息!")
-				db.Create(&model.MQTTMsg{Topic: "Status", Msg: string(mqttData)})
+				if err := ob.Put(model.KindStatus, string(mqttData)); err != nil {
+					log.WithFields(logger.Fields{
+						"camera": "outbox",
+					}).Error("写入 MQTT 信息失败: ", err)
+				}
 				//time.Sleep(time.Duration(5) * time.Second)
 				return SuccessQRCode
 			}
@@ -254,7 +281,7 @@ var (
 
 	OpenDeviceHandler = DeviceHandler(func(args []interface{}) DeviceState {
 		log := args[0].(*logger.Logger)
-		db := args[1].(*gorm.DB)
+		ob := args[1].(*outbox.Outbox)
 		B := &BootUp{}
 		B.Time = time.Now()
 		B.Status = 2
@@ -267,14 +294,18 @@ var (
 				"status": "2",
 			}).Error("MQTT 格式化错误!")
 		}
-		db.Create(&model.MQTTMsg{Topic: "Status", Msg: string(mqttData)})
+		if err := ob.Put(model.KindStatus, string(mqttData)); err != nil {
+			log.WithFields(logger.Fields{
+				"camera": "outbox",
+			}).Error("写入 MQTT 信息失败: ", err)
+		}
 		return CloseDevice
 	})
 
 	CloseDeviceHandler = DeviceHandler(func(args []interface{}) DeviceState {
 		cameraConfig := args[0].(*CameraConfig)
 		log := args[1].(*logger.Logger)
-		db := args[2].(*gorm.DB)
+		ob := args[2].(*outbox.Outbox)
 		value, err := cameraConfig.RunningGPIO.Read()
 		if err != nil {
 			log.WithFields(logger.Fields{
@@ -284,6 +315,12 @@ var (
 		// 上传设备关机信息，上传状态码3
 		for {
 			if int(value) == 0 {
+				if sessionExpired(cameraConfig) {
+					log.WithFields(logger.Fields{
+						"camera": "unlock",
+					}).Info("远程开机时间到，关闭电源!")
+					cameraConfig.ControlGPIO.Write(gpio.LOW)
+				}
 				time.Sleep(time.Duration(10) * time.Second)
 				value, err = cameraConfig.RunningGPIO.Read()
 				if err != nil {
@@ -307,7 +344,11 @@ var (
 						"status": "3",
 					}).Error("MQTT 格式化错误!")
 				}
-				db.Create(&model.MQTTMsg{Topic: "Status", Msg: string(mqttData)})
+				if err := ob.Put(model.KindStatus, string(mqttData)); err != nil {
+					log.WithFields(logger.Fields{
+						"camera": "outbox",
+					}).Error("写入 MQTT 信息失败: ", err)
+				}
 				return CloseDeviceTime
 			}
 		}
@@ -316,7 +357,7 @@ var (
 	OvertimeCloseDeviceHandler = DeviceHandler(func(args []interface{}) DeviceState {
 		cameraConfig := args[0].(*CameraConfig)
 		log := args[1].(*logger.Logger)
-		db := args[2].(*gorm.DB)
+		ob := args[2].(*outbox.Outbox)
 		B := &BootUp{}
 		B.Time = time.Now()
 		B.Status = 0
@@ -331,7 +372,11 @@ var (
 			}).Error("MQTT 格式化错误!")
 		}
 		cameraConfig.ControlGPIO.Write(gpio.LOW)
-		db.Create(&model.MQTTMsg{Topic: "Status", Msg: string(mqttData)})
+		if err := ob.Put(model.KindStatus, string(mqttData)); err != nil {
+			log.WithFields(logger.Fields{
+				"camera": "outbox",
+			}).Error("写入 MQTT 信息失败: ", err)
+		}
 		return InterQRCode
 	})
 
@@ -356,7 +401,7 @@ var (
 			}
 
 			if value == 1 {
-				if (time.Now().Unix() - timeC) >= int64(cameraConfig.CloseDevicePeriod) {
+				if (time.Now().Unix()-timeC) >= int64(cameraConfig.CloseDevicePeriod) || sessionExpired(cameraConfig) {
 					log.WithFields(logger.Fields{
 						"status": "3",
 					}).Info("关闭电源!")
@@ -377,6 +422,42 @@ var (
 	})
 )
 
+// ReadQRCodes 持续读取摄像头串口，每读到一个以 \r 结尾的扫码结果就交给等待扫码的状态
+// 不在等待扫码时读到的结果直接丢弃，避免设备运行期间的扫码在之后被误用
+func ReadQRCodes(log *logger.Logger, cameraConfig *CameraConfig) {
+	buffer := make([]byte, MAXRWLEN)
+	for {
+		var tmpstr string = ""
+		for {
+			num, err := cameraConfig.CameraSerialPort.Read(buffer)
+			if err != nil {
+				log.WithFields(logger.Fields{
+					"camera": "serial",
+				}).Errorf("摄像头串口读取失败: %v", err)
+			}
+			if num > 0 {
+				tmpstr += string(buffer[:num])
+			}
+			// 查找读到信息的结尾标志
+			if strings.LastIndex(tmpstr, "\r") > 0 {
+				break
+			}
+		}
+		select {
+		case cameraConfig.QRCodes <- tmpstr:
+		default:
+			log.WithFields(logger.Fields{
+				"camera": "serial",
+			}).Info("不在扫码状态，忽略扫码!")
+		}
+	}
+}
+
+// sessionExpired 远程开机时间已到
+func sessionExpired(cameraConfig *CameraConfig) bool {
+	return !cameraConfig.SessionEnd.IsZero() && time.Now().After(cameraConfig.SessionEnd)
+}
+
 // 实例化
 func NewCameraDevice(initState DeviceState) *Device {
 	return &Device{
@@ -385,6 +466,29 @@ func NewCameraDevice(initState DeviceState) *Device {
 	}
 }
 
+// Power power-off 命令的执行结果
+type Power struct {
+	Power string      `json:"power"` // off
+	State DeviceState `json:"state"` // 状态机当前状态
+}
+
+// RegisterCommands 注册设备电源相关的命令
+// power-off 断电后状态机检测到设备停止运行，按正常关机流程上传关机信息并回到扫码状态
+// 远程开机只能通过签名的 unlock 命令，与扫码开机一样记录开机信息
+func RegisterCommands(log *logger.Logger, handlers *command.Handlers, device *Device, cameraConfig *CameraConfig) {
+	handlers.Register(command.PowerOff, func(cmd *command.Command) (interface{}, error) {
+		if err := cameraConfig.ControlGPIO.Write(gpio.LOW); err != nil {
+			return nil, err
+		}
+		log.WithFields(logger.Fields{
+			"camera":  "command",
+			"command": cmd.Command,
+			"id":      cmd.ID,
+		}).Info("远程关闭电源!")
+		return Power{Power: "off", State: device.Current()}, nil
+	})
+}
+
 // IniCamera 初始化摄像头
 func InitCamera(
 	log *logger.Logger,
@@ -408,7 +512,7 @@ func InitCamera(
 	if err != nil {
 		log.WithFields(logger.Fields{
 			"camera": "serial",
-		}).Fatal("serial.Open: %v", err)
+		}).Fatalf("serial.Open: %v", err)
 	}
 
 	configSuccess := []byte{0x02, 0x00, 0x00, 0x01, 0x00, 0x33, 0x31}
@@ -566,8 +670,9 @@ func InitCamera(
 // Run 开始识别
 func Run(
 	log *logger.Logger,
-	db *gorm.DB,
+	ob *outbox.Outbox,
 	systemConfig *config.SystemConfig,
+	handlers *command.Handlers,
 ) {
 	// 初始化摄像头
 	SerialPortCamera, err := InitCamera(log, systemConfig.CameraPort)
@@ -593,24 +698,24 @@ func Run(
 	if err != nil {
 		log.WithFields(logger.Fields{
 			"camera": "gpio",
-		}).Error("GPIO 初始化错误: %v", err)
+		}).Errorf("GPIO 初始化错误: %v", err)
 		pOut, err = gpio.OpenPin(systemConfig.ControlGPIO, gpio.OUT)
 		if err != nil {
 			log.WithFields(logger.Fields{
 				"camera": "gpio",
-			}).Error("GPIO 重新初始化错误: %v", err)
+			}).Errorf("GPIO 重新初始化错误: %v", err)
 		}
 	}
 	pIn, err := gpio.OpenPin(systemConfig.RunningGPIO, gpio.IN)
 	if err != nil {
 		log.WithFields(logger.Fields{
 			"camera": "gpio",
-		}).Error("GPIO 初始化错误: %v", err)
+		}).Errorf("GPIO 初始化错误: %v", err)
 		pIn, err = gpio.OpenPin(systemConfig.RunningGPIO, gpio.IN)
 		if err != nil {
 			log.WithFields(logger.Fields{
 				"camera": "gpio",
-			}).Error("GPIO 重新初始化错误: %v", err)
+			}).Errorf("GPIO 重新初始化错误: %v", err)
 		}
 	}
 
@@ -620,7 +725,7 @@ func Run(
 	defer pIn.Close()
 
 	cameraConfig := &CameraConfig{
-		DB:                   db,
+		Outbox:               ob,
 		ControlGPIO:          pOut,
 		RunningGPIO:          pIn,
 		CameraSerialPort:     SerialPortCamera,
@@ -629,7 +734,10 @@ func Run(
 		QRCodeExpirationTime: systemConfig.QRCodeExpirationTime,
 		RoleID:               systemConfig.RoleID,
 		TempRoleID:           "12345678",
+		QRCodes:              make(chan string),
+		Unlocks:              make(chan UnlockToken),
 	}
+	go ReadQRCodes(log, cameraConfig)
 
 	cameraDevice := NewCameraDevice(InterQRCode)
 	cameraDevice.AddHandler(InterQRCode, InterQRCodeEvent, InterQRCodeHandler)
@@ -638,23 +746,28 @@ func Run(
 	cameraDevice.AddHandler(CloseDevice, CloseDeviceEvent, CloseDeviceHandler)
 	cameraDevice.AddHandler(OvertimeCloseDevice, OvertimeCloseDeviceEvent, OvertimeCloseDeviceHandler)
 	cameraDevice.AddHandler(CloseDeviceTime, CloseDeviceEvent, CloseDeviceTimeHandler)
+	RegisterCommands(log, handlers, cameraDevice, cameraConfig)
+	running.Lock()
+	running.device = cameraDevice
+	running.Unlock()
+	RegisterUnlock(log, handlers, cameraDevice, cameraConfig, systemConfig)
 
 	for {
 		switch cameraDevice.State {
 		case InterQRCode:
-			cameraDevice.Call(InterQRCodeEvent, cameraConfig, log, db)
+			cameraDevice.Call(InterQRCodeEvent, cameraConfig, log, ob)
 			continue
 		case SuccessQRCode:
 			cameraDevice.Call(SuccessQRCodeEvent, cameraConfig, log)
 			continue
 		case OpenDevice:
-			cameraDevice.Call(OpenDeviceEvent, log, db)
+			cameraDevice.Call(OpenDeviceEvent, log, ob)
 			continue
 		case CloseDevice:
-			cameraDevice.Call(CloseDeviceEvent, cameraConfig, log, db)
+			cameraDevice.Call(CloseDeviceEvent, cameraConfig, log, ob)
 			continue
 		case OvertimeCloseDevice:
-			cameraDevice.Call(OvertimeCloseDeviceEvent, cameraConfig, log, db)
+			cameraDevice.Call(OvertimeCloseDeviceEvent, cameraConfig, log, ob)
 			continue
 		case CloseDeviceTime:
 			cameraDevice.Call(CloseDeviceEvent, cameraConfig, log)
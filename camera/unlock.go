@@ -0,0 +1,182 @@
+package camera
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/command"
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/gpio"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/outbox"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// unlockWait 等待状态机接收远程开机请求的时间
+const unlockWait = 5 * time.Second
+
+// UnlockToken 远程开机请求，unlock 命令的参数
+//
+//	{"operator":"op-01","account":"13800000000","reason":"手机无法显示二维码",
+//	 "duration":1800,"time":1760000000000,"signature":"9a0c..."}
+type UnlockToken struct {
+	Operator  string `json:"operator"`  // 操作员，必填
+	Account   string `json:"account"`   // 用户账号，写入开机信息
+	Reason    string `json:"reason"`    // 原因，必填
+	Duration  int    `json:"duration"`  // 开机时间，单位秒，不超过 unlockMaxSession，0 为最长时间
+	Time      int64  `json:"time"`      // 签发时间，毫秒时间戳，与二维码一样在 qrCodeExpirationTime 内有效
+	Signature string `json:"signature"` // HMAC-SHA256 签名的十六进制字符串
+}
+
+// SignUnlock 计算远程开机请求的签名，id 为命令的关联 ID
+// 签名内容为 id|operator|account|reason|duration|time
+func SignUnlock(secret string, id string, token UnlockToken) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s|%s|%s|%s|%d|%d", id, token.Operator, token.Account, token.Reason, token.Duration, token.Time)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// unlockVerifier 校验远程开机请求，已使用过的命令 ID 在有效期内不能再次使用
+type unlockVerifier struct {
+	secret     string
+	maxAge     time.Duration
+	maxSession int
+
+	mu   sync.Mutex
+	used map[string]time.Time // 命令 ID 及其过期时间
+}
+
+// verify 校验签名、有效期、开机时间和是否已使用，返回补全后的请求
+// 校验通过不会记录命令 ID，状态机接收请求后才调用 markUsed，设备忙时请求可以重试
+func (v *unlockVerifier) verify(id string, token UnlockToken) (UnlockToken, error) {
+	if len(id) == 0 || len(token.Operator) == 0 || len(token.Reason) == 0 {
+		return token, errors.New("id, operator and reason are required")
+	}
+	expected := SignUnlock(v.secret, id, token)
+	if !hmac.Equal([]byte(expected), []byte(token.Signature)) {
+		return token, errors.New("invalid signature")
+	}
+	issued := time.Unix(0, token.Time*int64(time.Millisecond))
+	if age := time.Since(issued); age > v.maxAge || age < -v.maxAge {
+		return token, errors.New("unlock token expired")
+	}
+	if token.Duration < 0 || token.Duration > v.maxSession {
+		return token, fmt.Errorf("duration must be between 0 and %d", v.maxSession)
+	}
+	if token.Duration == 0 {
+		token.Duration = v.maxSession
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for usedID, expiry := range v.used {
+		if now.After(expiry) {
+			delete(v.used, usedID)
+		}
+	}
+	if _, ok := v.used[id]; ok {
+		return token, errors.New("unlock token already used")
+	}
+	return token, nil
+}
+
+// markUsed 记录已使用的命令 ID，在请求的有效期内不能再次使用
+func (v *unlockVerifier) markUsed(id string, token UnlockToken) {
+	issued := time.Unix(0, token.Time*int64(time.Millisecond))
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.used[id] = issued.Add(v.maxAge)
+}
+
+// Unlocked unlock 命令的执行结果
+type Unlocked struct {
+	SessionEnd time.Time `json:"sessionEnd"`
+}
+
+// RegisterUnlock 注册远程开机命令
+// 请求经过签名校验后交给等待扫码的状态机，按扫码开机的流程接通电源并上传开机信息
+func RegisterUnlock(
+	log *logger.Logger,
+	handlers *command.Handlers,
+	device *Device,
+	cameraConfig *CameraConfig,
+	systemConfig *config.SystemConfig,
+) {
+	verifier := &unlockVerifier{
+		secret:     systemConfig.UnlockSecret,
+		maxAge:     time.Duration(systemConfig.QRCodeExpirationTime) * time.Second,
+		maxSession: systemConfig.UnlockMaxSession,
+		used:       make(map[string]time.Time),
+	}
+	handlers.Register(command.Unlock, func(cmd *command.Command) (interface{}, error) {
+		if len(verifier.secret) == 0 {
+			return nil, errors.New("remote unlock is disabled")
+		}
+		var token UnlockToken
+		if err := cmd.Bind(&token); err != nil {
+			return nil, err
+		}
+		token, err := verifier.verify(cmd.ID, token)
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"camera":   "unlock",
+				"id":       cmd.ID,
+				"operator": token.Operator,
+			}).Warn("拒绝远程开机: ", err)
+			return nil, err
+		}
+
+		if state := device.Current(); state != InterQRCode {
+			return nil, fmt.Errorf("device busy: %s", state)
+		}
+		select {
+		case cameraConfig.Unlocks <- token:
+			verifier.markUsed(cmd.ID, token)
+		case <-time.After(unlockWait):
+			return nil, fmt.Errorf("device busy: %s", device.Current())
+		}
+		return Unlocked{SessionEnd: time.Now().Add(time.Duration(token.Duration) * time.Second)}, nil
+	})
+}
+
+// UnlockDevice 远程开机，与扫码成功相同：接通电源，上传状态 1，进入扫码成功状态
+// 开机时间到后 CloseDeviceHandler 断开电源，按正常关机流程上传关机信息
+func UnlockDevice(cameraConfig *CameraConfig, log *logger.Logger, ob *outbox.Outbox, token UnlockToken) DeviceState {
+	B := &BootUp{
+		Time:     time.Now(),
+		Status:   1,
+		Account:  token.Account,
+		Operator: token.Operator,
+		Reason:   token.Reason,
+	}
+	cameraConfig.SessionEnd = B.Time.Add(time.Duration(token.Duration) * time.Second)
+	cameraConfig.ControlGPIO.Write(gpio.HIGH)
+	log.WithFields(logger.Fields{
+		"camera":     "unlock",
+		"operator":   token.Operator,
+		"account":    token.Account,
+		"reason":     token.Reason,
+		"sessionEnd": cameraConfig.SessionEnd,
+	}).Info("远程开机，电源接通!")
+
+	mqttData, err := json.Marshal(B)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"camera": "unlock",
+		}).Error("MQTT 格式化错误!")
+		return SuccessQRCode
+	}
+	if err := ob.Put(model.KindStatus, string(mqttData)); err != nil {
+		log.WithFields(logger.Fields{
+			"camera": "outbox",
+		}).Error("写入 MQTT 信息失败: ", err)
+	}
+	return SuccessQRCode
+}
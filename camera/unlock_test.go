@@ -0,0 +1,186 @@
+package camera
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUnlockSecret = "test-secret"
+
+func newTestVerifier() *unlockVerifier {
+	return &unlockVerifier{
+		secret:     testUnlockSecret,
+		maxAge:     5 * time.Minute,
+		maxSession: 3600,
+		used:       make(map[string]time.Time),
+	}
+}
+
+func signedToken(id string, issued time.Time) UnlockToken {
+	token := UnlockToken{
+		Operator: "op-01",
+		Account:  "13800000000",
+		Reason:   "手机无法显示二维码",
+		Duration: 1800,
+		Time:     issued.UnixNano() / int64(time.Millisecond),
+	}
+	token.Signature = SignUnlock(testUnlockSecret, id, token)
+	return token
+}
+
+func TestSignUnlock(t *testing.T) {
+	token := UnlockToken{Operator: "op", Account: "acc", Reason: "r", Duration: 60, Time: 1760000000000}
+	got := SignUnlock(testUnlockSecret, "id-1", token)
+	if len(got) != 64 {
+		t.Fatalf("signature length %d, want 64", len(got))
+	}
+	if got != SignUnlock(testUnlockSecret, "id-1", token) {
+		t.Fatal("signature is not deterministic")
+	}
+	if got == SignUnlock(testUnlockSecret, "id-2", token) {
+		t.Fatal("signature does not cover the command id")
+	}
+	if got == SignUnlock("other-secret", "id-1", token) {
+		t.Fatal("signature does not depend on the secret")
+	}
+}
+
+func TestUnlockVerify(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		id      string
+		token   func() UnlockToken
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			id:    "id-1",
+			token: func() UnlockToken { return signedToken("id-1", now) },
+		},
+		{
+			name: "bad signature",
+			id:   "id-1",
+			token: func() UnlockToken {
+				token := signedToken("id-1", now)
+				token.Signature = strings.Repeat("0", 64)
+				return token
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "tampered field",
+			id:   "id-1",
+			token: func() UnlockToken {
+				token := signedToken("id-1", now)
+				token.Account = "13900000000"
+				return token
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name:    "signed for another id",
+			id:      "id-2",
+			token:   func() UnlockToken { return signedToken("id-1", now) },
+			wantErr: "invalid signature",
+		},
+		{
+			name:    "expired",
+			id:      "id-1",
+			token:   func() UnlockToken { return signedToken("id-1", now.Add(-10*time.Minute)) },
+			wantErr: "expired",
+		},
+		{
+			name:    "issued in the future",
+			id:      "id-1",
+			token:   func() UnlockToken { return signedToken("id-1", now.Add(10*time.Minute)) },
+			wantErr: "expired",
+		},
+		{
+			name: "duration too long",
+			id:   "id-1",
+			token: func() UnlockToken {
+				token := signedToken("id-1", now)
+				token.Duration = 7200
+				token.Signature = SignUnlock(testUnlockSecret, "id-1", token)
+				return token
+			},
+			wantErr: "duration",
+		},
+		{
+			name: "missing operator",
+			id:   "id-1",
+			token: func() UnlockToken {
+				token := signedToken("id-1", now)
+				token.Operator = ""
+				return token
+			},
+			wantErr: "required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTestVerifier().verify(tt.id, tt.token())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnlockVerifyDefaultDuration(t *testing.T) {
+	token := signedToken("id-1", time.Now())
+	token.Duration = 0
+	token.Signature = SignUnlock(testUnlockSecret, "id-1", token)
+	got, err := newTestVerifier().verify("id-1", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Duration != 3600 {
+		t.Fatalf("duration %d, want maxSession 3600", got.Duration)
+	}
+}
+
+func TestUnlockReplay(t *testing.T) {
+	v := newTestVerifier()
+	token := signedToken("id-1", time.Now())
+
+	// 设备忙时校验通过但没有使用，请求可以重试
+	if _, err := v.verify("id-1", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.verify("id-1", token); err != nil {
+		t.Fatalf("token burned before it was used: %v", err)
+	}
+
+	v.markUsed("id-1", token)
+	if _, err := v.verify("id-1", token); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("replay error %v, want already used", err)
+	}
+
+	// 其他命令 ID 不受影响
+	if _, err := v.verify("id-2", signedToken("id-2", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnlockUsedExpires(t *testing.T) {
+	v := newTestVerifier()
+	token := signedToken("id-1", time.Now())
+	v.markUsed("id-1", token)
+	// 过期的记录在下一次校验时清理
+	v.used["id-1"] = time.Now().Add(-time.Second)
+	if _, err := v.verify("id-2", signedToken("id-2", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.used["id-1"]; ok {
+		t.Fatal("expired id not removed")
+	}
+}
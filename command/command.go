@@ -0,0 +1,199 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// 命令名称
+// PowerOff 断开设备电源
+// Unlock 远程开机，与扫码开机流程相同，需要签名，不提供不经过状态机的接通电源命令
+// Reboot 重启网关或重新拨号
+// SetConfig 修改配置
+// RequestPosition 查询最近一次 GPS 定位
+const (
+	PowerOff        = "power-off"
+	Unlock          = "unlock"
+	Reboot          = "reboot"
+	SetConfig       = "set-config"
+	RequestPosition = "request-position"
+)
+
+// 执行结果
+// StatusOK 执行成功
+// StatusError 执行失败，原因见 Response.Error
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// ErrUnknownCommand 没有注册处理函数的命令
+var ErrUnknownCommand = errors.New("unknown command")
+
+// Command 云端下发的命令
+//
+//	{"id":"6f1c...","command":"power-off","params":{}}
+type Command struct {
+	ID      string          `json:"id"`      // 关联 ID，原样写入执行结果
+	Command string          `json:"command"` // 命令名称，主题中带有命令名称时以主题为准
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Bind 将命令参数解码到 v，没有参数时 v 保持不变
+func (c *Command) Bind(v interface{}) error {
+	if len(c.Params) == 0 || string(c.Params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(c.Params, v); err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+	return nil
+}
+
+// Response 命令执行结果
+type Response struct {
+	ID      string      `json:"id"`
+	Command string      `json:"command"`
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// Decode 解码命令，name 为主题中 cmd/ 之后的部分，可以为空
+func Decode(name string, payload []byte) (*Command, error) {
+	cmd := &Command{}
+	if err := json.Unmarshal(payload, cmd); err != nil {
+		return nil, fmt.Errorf("invalid command: %w", err)
+	}
+	if len(name) > 0 {
+		cmd.Command = name
+	}
+	if len(cmd.Command) == 0 {
+		return nil, errors.New("missing command name")
+	}
+	return cmd, nil
+}
+
+// Handler 命令处理函数，返回的 data 写入执行结果
+type Handler func(cmd *Command) (data interface{}, err error)
+
+// Setter 配置项修改函数，value 不合法时返回 error
+type Setter func(value string) error
+
+// Handlers 命令处理函数表，由各模块注册
+type Handlers struct {
+	log        *logger.Logger
+	configFile string
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	settings map[string]Setter
+}
+
+// NewHandlers 创建命令处理函数表，set-config 修改的配置写回 configFile
+func NewHandlers(log *logger.Logger, configFile string) *Handlers {
+	h := &Handlers{
+		log:        log,
+		configFile: configFile,
+		handlers:   make(map[string]Handler),
+		settings:   make(map[string]Setter),
+	}
+	h.Register(SetConfig, h.setConfig)
+	return h
+}
+
+// Register 注册命令处理函数，同名的处理函数会被替换
+func (h *Handlers) Register(name string, handler Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers[name] = handler
+}
+
+// RegisterSetting 注册可以通过 set-config 修改的配置项，key 的格式为 段名.键名
+func (h *Handlers) RegisterSetting(key string, setter Setter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.settings[key] = setter
+}
+
+// Handle 执行命令
+func (h *Handlers) Handle(cmd *Command) Response {
+	h.mu.RLock()
+	handler, ok := h.handlers[cmd.Command]
+	h.mu.RUnlock()
+
+	response := Response{
+		ID:      cmd.ID,
+		Command: cmd.Command,
+		Status:  StatusOK,
+	}
+	var err error
+	if ok {
+		response.Data, err = handler(cmd)
+	} else {
+		err = ErrUnknownCommand
+	}
+	if err != nil {
+		response.Status = StatusError
+		response.Error = err.Error()
+	}
+	response.Time = time.Now()
+
+	h.log.WithFields(logger.Fields{
+		"command": cmd.Command,
+		"id":      cmd.ID,
+		"status":  response.Status,
+	}).Info("Handle command: ", response.Error)
+	return response
+}
+
+// setConfig 修改配置，参数为 {"段名.键名": "值"}
+// 按键名顺序逐项生效，遇到不合法的值时停止，全部生效后写回配置文件，重启后保持
+func (h *Handlers) setConfig(cmd *Command) (interface{}, error) {
+	values := make(map[string]string)
+	if err := cmd.Bind(&values); err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.New("no config given")
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h.mu.RLock()
+	setters := make([]Setter, len(keys))
+	var unknown []string
+	for i, key := range keys {
+		setters[i] = h.settings[key]
+		if setters[i] == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	h.mu.RUnlock()
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("config %s can not be set remotely", strings.Join(unknown, ", "))
+	}
+
+	for i, key := range keys {
+		if err := setters[i](values[key]); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if err := config.SaveKeys(h.configFile, values); err != nil {
+		return nil, fmt.Errorf("applied but not saved: %w", err)
+	}
+	return values, nil
+}
@@ -1,7 +1,13 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/zsy-cn/4g-gateway/pkg/ini"
 	"github.com/zsy-cn/4g-gateway/pkg/logger"
@@ -9,11 +15,16 @@ import (
 
 // Config 配置
 type Config struct {
-	System SystemConfig
-	Log    LogConfig
-	MQTT   MQTTConfig
-	Geo    GeoConfig
-	EC20   EC20Config
+	File       string // 配置文件路径，远程修改配置时写回
+	AppMode    string
+	AppVersion string // 固件版本
+	System     SystemConfig
+	Log        LogConfig
+	Database   DatabaseConfig
+	MQTT       MQTTConfig
+	Geo        GeoConfig
+	EC20       EC20Config
+	Voltage    VoltageConfig
 }
 
 // SystemConfig 系统配置
@@ -25,6 +36,8 @@ type SystemConfig struct {
 	QRCloseDevicePeriod  int
 	QRCodeExpirationTime int
 	CameraPort           string
+	UnlockSecret         string // 远程开机签名密钥，为空时不允许远程开机
+	UnlockMaxSession     int    // 远程开机最长时间，单位秒
 }
 
 // LogConfig 日志配置
@@ -33,10 +46,90 @@ type LogConfig struct {
 	FilePath string
 }
 
+// DatabaseConfig 数据库配置
+type DatabaseConfig struct {
+	Driver      string // 目前只支持 sqlite
+	Path        string // 数据库文件路径，:memory: 为内存数据库
+	JournalMode string // DELETE、TRUNCATE、PERSIST、MEMORY、WAL 或 OFF
+	BusyTimeout int    // 数据库被锁定时的等待时间，单位毫秒
+	Synchronous string // OFF、NORMAL、FULL 或 EXTRA
+}
+
 type EC20Config struct {
 	DNS1   string
 	DNS2   string
 	Shfile string
+	ATPort string // AT 命令串口
+	// 蜂窝网络状态采集周期，单位秒，0 不采集
+	CellularPeriod int
+	// 数据连接方式：pppd 由网关启动并监控 pppd，qmi 使用 quectel-CM，ecm 使用 AT+QNETDEVCTL，script 执行 shfile
+	Dial string
+	APN  APNConfig
+	PPP  PPPConfig
+	QMI  QMIConfig
+	ECM  ECMConfig
+	// 联网检测
+	Probe ProbeConfig
+}
+
+// ProbeConfig 联网检测配置，所有检测连续失败 Failures 次后认为断网
+type ProbeConfig struct {
+	Failures int // 连续失败次数，任一检测成功时清零
+	Timeout  int // 单次检测的超时时间，单位秒
+	Checks   []ProbeCheck
+}
+
+// ProbeCheck 单个联网检测 [ec20.probe.名称]
+type ProbeCheck struct {
+	Name     string
+	Type     string // tcp、dns、http 或 mqtt
+	Interval int    // 检测周期，单位秒
+	Address  string // tcp 连接的 host:port
+	Host     string // dns 通过 DNS1、DNS2 解析的域名
+	URL      string // http GET 的地址
+	Status   int    // http 期望的状态码
+}
+
+func (c ProbeCheck) String() string {
+	switch c.Type {
+	case "tcp":
+		return fmt.Sprintf("%s(tcp %s every %ds)", c.Name, c.Address, c.Interval)
+	case "dns":
+		return fmt.Sprintf("%s(dns %s every %ds)", c.Name, c.Host, c.Interval)
+	case "http":
+		return fmt.Sprintf("%s(http %s %d every %ds)", c.Name, c.URL, c.Status, c.Interval)
+	}
+	return fmt.Sprintf("%s(%s every %ds)", c.Name, c.Type, c.Interval)
+}
+
+// APNConfig 各种连接方式共用的 APN 配置
+type APNConfig struct {
+	Name     string
+	Username string
+	Password string
+	Auth     string // none、pap 或 chap，pppd 自动协商
+}
+
+// PPPConfig pppd 拨号配置
+type PPPConfig struct {
+	Command string // pppd 的路径，可以带前缀，如 sudo /usr/sbin/pppd
+	Device  string // 拨号串口
+	Baud    int
+	Number  string // 拨号号码
+	Unit    int    // 网卡为 ppp<unit>
+}
+
+// QMIConfig QMI 连接配置，由 quectel-CM 建立数据连接并通过 DHCP 配置网卡和路由
+type QMIConfig struct {
+	Command   string // quectel-CM 的路径，可以带前缀
+	Interface string // 网卡，如 wwan0，quectel-CM 根据网卡找到对应的 /dev/cdc-wdm 设备
+}
+
+// ECMConfig ECM/RNDIS 连接配置，通过 AT+QNETDEVCTL 建立数据连接，再用 DHCP 配置网卡和路由
+type ECMConfig struct {
+	Mode      string // ecm 或 rndis，与模块的 AT+QCFG="usbnet" 对应
+	Interface string // 网卡，如 usb0
+	DHCP      string // DHCP 客户端命令，网卡名追加在最后，需要在前台运行并负责续租
 }
 
 // MQTTConfig MQTT 配置
@@ -48,14 +141,149 @@ type MQTTConfig struct {
 	ClientID       string
 	KeepAlive      int
 	X509           bool
-	X509Pem        string
-	X509Key        string
+	Transport      string   // tcp、tls、ws 或 wss，默认根据 x509 选择 tcp 或 tls
+	X509Pem        string   // 客户端证书，为空时不使用客户端证书
+	X509Key        string   // 客户端私钥
+	X509CA         string   // 校验服务器证书的 CA 证书，为空时使用系统 CA
+	X509ServerName string   // 校验服务器证书使用的域名，为空时使用服务器地址中的主机名
+	X509Pins       []string // 服务器证书链中公钥 (SPKI) 的 SHA-256，base64 编码，任意一个匹配即可
+	TLSMinVersion  string   // 最低 TLS 版本
+	TLSCiphers     []string // TLS 1.2 及以下允许的加密套件，为空时使用默认值
+	X509ExpiryWarn []int    // 客户端证书剩余天数低于这些值时告警
+	TopicEvent     string   // 网关事件主题，如证书即将过期
+	TopicCellular  string   // 蜂窝网络状态主题
 	TopicGPS       string
 	TopicHeartbeat string
 	TopicVoltage   string
 	TopicBootUp    string
-	HeartPeriod    int
+	HeartPeriod    int // 心跳周期，单位秒，0 不发送
 	FileStore      string
+	// MQTT 客户端保存未完成报文的位置：file 为 fileStore 目录，sqlite 为数据库
+	Store string
+	// 保存的报文条数和字节数上限，超出时丢弃最早的报文，0 不限制
+	StoreMaxPackets int
+	StoreMaxBytes   int64
+	LogLevel        string // MQTT 客户端内部日志级别：none、error、warn、info 或 debug
+	// MQTT 协议版本，4 为 3.1.1，5 为 MQTT 5
+	ProtocolVersion int
+	// MQTT 5 会话过期时间，单位秒
+	SessionExpiry int
+	Routes        map[string]MQTTRoute
+	// 发送队列轮询、确认与重试，单位秒
+	PollPeriod       int
+	AckTimeout       int
+	RetryInterval    int
+	MaxRetryInterval int
+	// 失败重发的最大次数，超过后移入死信表，0 不限制
+	MaxRetries int
+	Batch            MQTTBatchConfig
+	Retention        RetentionConfig
+	Command          MQTTCommandConfig
+	Presence         MQTTPresenceConfig
+	Websocket        MQTTWebsocketConfig
+	Proxy            MQTTProxyConfig
+	// 按顺序排列的服务器，第一个为主服务器
+	Brokers []MQTTBroker
+	// 连续连接失败多少次后切换到下一个服务器
+	FailoverAfter int
+	// 连接备用服务器时每隔多少秒尝试回到主服务器，0 不回切
+	PrimaryRetry int
+}
+
+// MQTTWebsocketConfig ws 和 wss 连接配置
+type MQTTWebsocketConfig struct {
+	Path    string            // 未配置 [mqtt.broker.*] 时服务器地址的路径
+	Proxy   string            // HTTP 代理地址，为空时使用环境变量 HTTPS_PROXY、HTTP_PROXY，none 不使用代理
+	Headers map[string]string // 握手时附加的 HTTP 头
+}
+
+// MQTTProxyConfig 连接服务器使用的代理，对 tcp、tls、ws 和 wss 都生效
+type MQTTProxyConfig struct {
+	URL    string   // socks5://、socks5h:// 或 http:// 代理，为空时使用环境变量 ALL_PROXY、NO_PROXY，none 不使用代理
+	Bypass []string // 不经过代理的主机，格式同 NO_PROXY：IP、CIDR、域名或 .域名
+}
+
+// MQTTBroker 单个 MQTT 服务器，用户名和密码为空时使用 [mqtt] 中的值
+type MQTTBroker struct {
+	Name       string
+	URL        string // tcp://、tls://、ws:// 或 wss://
+	Username   string
+	Password   string
+	ServerName string // 校验服务器证书使用的域名，为空时使用 x509ServerName，再为空使用 URL 中的主机名
+}
+
+// String 不输出密码
+func (b MQTTBroker) String() string {
+	return fmt.Sprintf("%s(%s, user %s)", b.Name, b.URL, b.Username)
+}
+
+// MQTTPresenceConfig 在线状态配置
+// 连接成功后在 Topic 上发布保留的 online 消息，异常断开时由服务器发布遗嘱 offline 消息
+type MQTTPresenceConfig struct {
+	Enabled bool
+	Topic   string // 默认为 <命令前缀>/<clientID>/presence
+	Qos     byte
+}
+
+// MQTTCommandConfig 云端下发命令配置
+// 订阅 <prefix>/<clientID>/cmd/#，结果发布到 <prefix>/<clientID>/resp/<命令>
+type MQTTCommandConfig struct {
+	Enabled bool
+	Prefix  string
+	Qos     byte
+}
+
+// RetentionConfig 发送队列保留策略，防止离线时数据库占满存储
+type RetentionConfig struct {
+	MaxFileSize       int64  // 数据库已用空间上限，单位字节，0 不限制
+	CheckPeriod       int    // 检查周期，单位秒
+	VacuumPeriod      int    // VACUUM 周期，单位秒，0 不执行
+	DeadLetterMaxRows int    // 死信表最多保留条数，0 不限制
+	Policy            string // 未单独配置的消息类型的淘汰策略
+	Kinds             map[string]KindRetention
+}
+
+// KindRetention 单个消息类型的保留策略，数值为 0 表示不限制
+type KindRetention struct {
+	MaxRows  int
+	MaxAge   int   // 单位秒
+	MaxBytes int64 // 消息体总字节数
+	Policy   string
+}
+
+// MQTTBatchConfig 批量上传配置，同一主题的多条消息合并为一条发布
+type MQTTBatchConfig struct {
+	Enabled  bool
+	Kinds    []string // 参与合并的消息类型
+	MaxCount int      // 每批最多条数
+	MaxBytes int      // 每批最多字节数 (压缩前)
+	MaxAge   int      // 最早一条消息最长等待时间，单位秒
+	Encoding string   // json、gzip、deflate
+}
+
+// MQTTRoute 消息类型对应的 MQTT 发布参数
+type MQTTRoute struct {
+	Topic    string
+	Qos      byte
+	Retain   bool
+	Priority int // 优先级，数值大的先发送
+	Expiry   int // 消息有效期，单位秒，0 不过期
+}
+
+// VoltageConfig 供电电压监测配置
+// 电压 (V) = 读数 × Scale + Offset，sysfs 的 IIO _raw 文件会先乘以对应的 _scale
+type VoltageConfig struct {
+	Enabled        bool
+	Source         string // sysfs、adc 或 at
+	Path           string // sysfs 和 adc 的文件路径
+	Port           string // at 的 AT 命令串口
+	Scale          float64
+	Offset         float64
+	Period         int     // 上传周期，单位秒
+	SampleInterval int     // 采样周期，单位秒，告警在采样时立即产生
+	UnderVoltage   float64 // 欠压阈值，单位 V，0 不检查
+	OverVoltage    float64 // 过压阈值，单位 V，0 不检查
+	Hysteresis     float64 // 回差，电压回到阈值以内超过回差才解除告警
 }
 
 // GeoConfig GPS 配置
@@ -65,6 +293,12 @@ type GeoConfig struct {
 	DataPort    string
 }
 
+// apnPattern APN 只能包含字母、数字、点和横线，会写入 chat 脚本
+var apnPattern = regexp.MustCompile(`^[A-Za-z0-9.\-]*$`)
+
+// dialNumberPattern 拨号号码，如 *99# 或 *99***1#
+var dialNumberPattern = regexp.MustCompile(`^[0-9*#]+$`)
+
 // LoadINI 加载配置文件
 func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 
@@ -73,13 +307,15 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 		fmt.Printf("Fail to read file: %v", err)
 		return nil, err
 	}
-	defaultConfig := &Config{}
+	defaultConfig := &Config{File: file}
+	defaultConfig.AppMode = cfg.Section("").Key("app_mode").String()
 	log.WithFields(logger.Fields{
 		"config": "load",
-	}).Info("App Mode:", cfg.Section("").Key("app_mode").String())
+	}).Info("App Mode:", defaultConfig.AppMode)
+	defaultConfig.AppVersion = cfg.Section("").Key("app_version").String()
 	log.WithFields(logger.Fields{
 		"config": "load",
-	}).Info("App Version:", cfg.Section("").Key("app_version").String())
+	}).Info("App Version:", defaultConfig.AppVersion)
 
 	defaultConfig.System.ControlGPIO = cfg.Section("system").Key("controlGPIO").MustInt(21)
 	log.WithFields(logger.Fields{
@@ -109,6 +345,14 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 	log.WithFields(logger.Fields{
 		"config": "load",
 	}).Info("System CameraPort:", defaultConfig.System.CameraPort)
+	defaultConfig.System.UnlockSecret = cfg.Section("system").Key("unlockSecret").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("System Unlock Enabled:", len(defaultConfig.System.UnlockSecret) > 0)
+	defaultConfig.System.UnlockMaxSession = cfg.Section("system").Key("unlockMaxSession").MustInt(3600)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("System Unlock Max Session:", defaultConfig.System.UnlockMaxSession)
 
 	defaultConfig.Log.FileName = cfg.Section("log").Key("fileName").String()
 	log.WithFields(logger.Fields{
@@ -119,6 +363,29 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 		"config": "load",
 	}).Info("Log FilePath:", defaultConfig.Log.FilePath)
 
+	defaultConfig.Database.Driver = cfg.Section("database").Key("driver").In("sqlite", []string{"sqlite"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Database Driver:", defaultConfig.Database.Driver)
+	defaultConfig.Database.Path = cfg.Section("database").Key("path").MustString("./mqttmsg.db")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Database Path:", defaultConfig.Database.Path)
+	defaultConfig.Database.JournalMode = cfg.Section("database").Key("journalMode").In("WAL",
+		[]string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Database Journal Mode:", defaultConfig.Database.JournalMode)
+	defaultConfig.Database.BusyTimeout = cfg.Section("database").Key("busyTimeout").MustInt(5000)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Database Busy Timeout:", defaultConfig.Database.BusyTimeout)
+	defaultConfig.Database.Synchronous = cfg.Section("database").Key("synchronous").In("NORMAL",
+		[]string{"OFF", "NORMAL", "FULL", "EXTRA"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Database Synchronous:", defaultConfig.Database.Synchronous)
+
 	defaultConfig.EC20.DNS1 = cfg.Section("ec20").Key("dns1").String()
 	log.WithFields(logger.Fields{
 		"config": "load",
@@ -131,6 +398,130 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 	log.WithFields(logger.Fields{
 		"config": "load",
 	}).Info("EC20 Shfile:", defaultConfig.EC20.Shfile)
+	defaultConfig.EC20.ATPort = cfg.Section("ec20").Key("atPort").MustString("/dev/ttyUSB2")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 AT Port:", defaultConfig.EC20.ATPort)
+	defaultConfig.EC20.CellularPeriod = cfg.Section("ec20").Key("cellularPeriod").MustInt(300)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 Cellular Period:", defaultConfig.EC20.CellularPeriod)
+	// 没有 dial 但配置了 shfile 时沿用原有的拨号脚本，APN 写在脚本中
+	defaultDial := "pppd"
+	if len(defaultConfig.EC20.Shfile) > 0 {
+		defaultDial = "script"
+	}
+	defaultConfig.EC20.Dial = cfg.Section("ec20").Key("dial").In(defaultDial, []string{"pppd", "qmi", "ecm", "script"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 Dial:", defaultConfig.EC20.Dial)
+	defaultConfig.EC20.APN.Name = cfg.Section("ec20.apn").Key("name").String()
+	if !apnPattern.MatchString(defaultConfig.EC20.APN.Name) {
+		err = fmt.Errorf("invalid apn %q", defaultConfig.EC20.APN.Name)
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Error("EC20 APN: ", err)
+		return nil, err
+	}
+	if defaultConfig.EC20.Dial == "pppd" && len(defaultConfig.EC20.APN.Name) == 0 {
+		// 空 APN 会拨号 AT+CGDCONT=1,"IP",""，需要 APN 的运营商上无法联网
+		err = errors.New("apn is required for dial pppd, set [ec20.apn] name")
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Error("EC20 APN: ", err)
+		return nil, err
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 APN:", defaultConfig.EC20.APN.Name)
+	defaultConfig.EC20.APN.Username = cfg.Section("ec20.apn").Key("username").String()
+	defaultConfig.EC20.APN.Password = cfg.Section("ec20.apn").Key("password").String()
+	if strings.ContainsAny(defaultConfig.EC20.APN.Username+defaultConfig.EC20.APN.Password, "\"\r\n") {
+		err = fmt.Errorf("apn username and password must not contain quotes or line breaks")
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Error("EC20 APN: ", err)
+		return nil, err
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 APN Username:", defaultConfig.EC20.APN.Username)
+	defaultConfig.EC20.APN.Auth = cfg.Section("ec20.apn").Key("auth").In("pap", []string{"none", "pap", "chap"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 APN Auth:", defaultConfig.EC20.APN.Auth)
+	defaultConfig.EC20.PPP.Command = cfg.Section("ec20.ppp").Key("command").MustString("/usr/sbin/pppd")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 PPP Command:", defaultConfig.EC20.PPP.Command)
+	defaultConfig.EC20.PPP.Device = cfg.Section("ec20.ppp").Key("device").MustString("/dev/ttyUSB3")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 PPP Device:", defaultConfig.EC20.PPP.Device)
+	defaultConfig.EC20.PPP.Baud = cfg.Section("ec20.ppp").Key("baud").MustInt(115200)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 PPP Baud:", defaultConfig.EC20.PPP.Baud)
+	defaultConfig.EC20.PPP.Number = cfg.Section("ec20.ppp").Key("number").MustString("*99#")
+	if !dialNumberPattern.MatchString(defaultConfig.EC20.PPP.Number) {
+		err = fmt.Errorf("invalid dial number %q", defaultConfig.EC20.PPP.Number)
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Error("EC20 PPP Number: ", err)
+		return nil, err
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 PPP Number:", defaultConfig.EC20.PPP.Number)
+	defaultConfig.EC20.PPP.Unit = cfg.Section("ec20.ppp").Key("unit").MustInt(0)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 PPP Unit:", defaultConfig.EC20.PPP.Unit)
+	defaultConfig.EC20.QMI.Command = cfg.Section("ec20.qmi").Key("command").MustString("/usr/bin/quectel-CM")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 QMI Command:", defaultConfig.EC20.QMI.Command)
+	defaultConfig.EC20.QMI.Interface = cfg.Section("ec20.qmi").Key("interface").MustString("wwan0")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 QMI Interface:", defaultConfig.EC20.QMI.Interface)
+	defaultConfig.EC20.ECM.Mode = cfg.Section("ec20.ecm").Key("mode").In("ecm", []string{"ecm", "rndis"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 ECM Mode:", defaultConfig.EC20.ECM.Mode)
+	defaultConfig.EC20.ECM.Interface = cfg.Section("ec20.ecm").Key("interface").MustString("usb0")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 ECM Interface:", defaultConfig.EC20.ECM.Interface)
+	defaultConfig.EC20.ECM.DHCP = cfg.Section("ec20.ecm").Key("dhcp").MustString("udhcpc -f -n -i")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 ECM DHCP:", defaultConfig.EC20.ECM.DHCP)
+	defaultConfig.EC20.Probe.Failures = cfg.Section("ec20.probe").Key("failures").MustInt(3)
+	if defaultConfig.EC20.Probe.Failures < 1 {
+		defaultConfig.EC20.Probe.Failures = 1
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 Probe Failures:", defaultConfig.EC20.Probe.Failures)
+	defaultConfig.EC20.Probe.Timeout = cfg.Section("ec20.probe").Key("timeout").MustInt(10)
+	if defaultConfig.EC20.Probe.Timeout < 1 {
+		defaultConfig.EC20.Probe.Timeout = 1
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 Probe Timeout:", defaultConfig.EC20.Probe.Timeout)
+	// [ec20.probe.名称]，没有配置时检测 DNS1、DNS2 的 53 端口和 MQTT 连接
+	defaultConfig.EC20.Probe.Checks, err = loadProbeChecks(cfg, &defaultConfig.EC20)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Error("EC20 Probe Checks: ", err)
+		return nil, err
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("EC20 Probe Checks:", defaultConfig.EC20.Probe.Checks)
 
 	defaultConfig.MQTT.Username = cfg.Section("mqtt").Key("username").String()
 	log.WithFields(logger.Fields{
@@ -148,6 +539,14 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 	log.WithFields(logger.Fields{
 		"config": "load",
 	}).Info("MQTT X509:", defaultConfig.MQTT.X509)
+	transport := "tcp"
+	if defaultConfig.MQTT.X509 {
+		transport = "tls"
+	}
+	defaultConfig.MQTT.Transport = cfg.Section("mqtt").Key("transport").In(transport, []string{"tcp", "tls", "ws", "wss"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Transport:", defaultConfig.MQTT.Transport)
 	defaultConfig.MQTT.X509Pem = cfg.Section("mqtt").Key("x509Pem").String()
 	log.WithFields(logger.Fields{
 		"config": "load",
@@ -156,6 +555,39 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 	log.WithFields(logger.Fields{
 		"config": "load",
 	}).Info("MQTT X509Key:", defaultConfig.MQTT.X509Key)
+	defaultConfig.MQTT.X509CA = cfg.Section("mqtt").Key("x509CA").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT X509CA:", defaultConfig.MQTT.X509CA)
+	defaultConfig.MQTT.X509ServerName = cfg.Section("mqtt").Key("x509ServerName").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT X509 Server Name:", defaultConfig.MQTT.X509ServerName)
+	defaultConfig.MQTT.X509Pins = cfg.Section("mqtt").Key("x509Pins").Strings(",")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT X509 Pins:", defaultConfig.MQTT.X509Pins)
+	defaultConfig.MQTT.TLSMinVersion = cfg.Section("mqtt").Key("tlsMinVersion").In("1.2", []string{"1.0", "1.1", "1.2", "1.3"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT TLS Min Version:", defaultConfig.MQTT.TLSMinVersion)
+	defaultConfig.MQTT.TLSCiphers = cfg.Section("mqtt").Key("tlsCiphers").Strings(",")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT TLS Ciphers:", defaultConfig.MQTT.TLSCiphers)
+	defaultConfig.MQTT.X509ExpiryWarn = []int{30, 7, 1}
+	if key := cfg.Section("mqtt").Key("x509ExpiryWarn"); len(key.String()) > 0 {
+		defaultConfig.MQTT.X509ExpiryWarn, err = key.StrictInts(",")
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"config": "load",
+			}).Error("MQTT X509 Expiry Warn: ", err)
+			return nil, err
+		}
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT X509 Expiry Warn:", defaultConfig.MQTT.X509ExpiryWarn)
 	defaultConfig.MQTT.Server = cfg.Section("mqtt").Key("server").String()
 	log.WithFields(logger.Fields{
 		"config": "load",
@@ -176,10 +608,243 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 	log.WithFields(logger.Fields{
 		"config": "load",
 	}).Info("MQTT Topic Boot Up:", defaultConfig.MQTT.TopicBootUp)
+	defaultConfig.MQTT.TopicVoltage = cfg.Section("mqtt").Key("topicVoltage").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Topic Voltage:", defaultConfig.MQTT.TopicVoltage)
+	defaultConfig.MQTT.TopicEvent = cfg.Section("mqtt").Key("topicEvent").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Topic Event:", defaultConfig.MQTT.TopicEvent)
+	defaultConfig.MQTT.TopicCellular = cfg.Section("mqtt").Key("topicCellular").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Topic Cellular:", defaultConfig.MQTT.TopicCellular)
+	defaultConfig.MQTT.TopicHeartbeat = cfg.Section("mqtt").Key("topicHeartbeat").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Topic Heartbeat:", defaultConfig.MQTT.TopicHeartbeat)
+	defaultConfig.MQTT.HeartPeriod = cfg.Section("mqtt").Key("heartPeriod").MustInt(60)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Heart Period:", defaultConfig.MQTT.HeartPeriod)
 	defaultConfig.MQTT.FileStore = cfg.Section("mqtt").Key("fileStore").String()
 	log.WithFields(logger.Fields{
 		"config": "load",
 	}).Info("MQTT File Store:", defaultConfig.MQTT.FileStore)
+	defaultConfig.MQTT.Store = cfg.Section("mqtt").Key("store").In("file", []string{"file", "sqlite"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Store:", defaultConfig.MQTT.Store)
+	defaultConfig.MQTT.StoreMaxPackets = cfg.Section("mqtt").Key("storeMaxPackets").MustInt(1000)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Store Max Packets:", defaultConfig.MQTT.StoreMaxPackets)
+	defaultConfig.MQTT.StoreMaxBytes = cfg.Section("mqtt").Key("storeMaxBytes").MustInt64(4 << 20)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Store Max Bytes:", defaultConfig.MQTT.StoreMaxBytes)
+	defaultConfig.MQTT.LogLevel = cfg.Section("mqtt").Key("logLevel").In("info", []string{"none", "error", "warn", "info", "debug"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Log Level:", defaultConfig.MQTT.LogLevel)
+	defaultConfig.MQTT.ProtocolVersion, _ = strconv.Atoi(cfg.Section("mqtt").Key("protocolVersion").In("4", []string{"3", "4", "5"}))
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Protocol Version:", defaultConfig.MQTT.ProtocolVersion)
+	defaultConfig.MQTT.SessionExpiry = cfg.Section("mqtt").Key("sessionExpiry").MustInt(0)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Session Expiry:", defaultConfig.MQTT.SessionExpiry)
+	defaultConfig.MQTT.PollPeriod = cfg.Section("mqtt").Key("pollPeriod").MustInt(150)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Poll Period:", defaultConfig.MQTT.PollPeriod)
+	defaultConfig.MQTT.AckTimeout = cfg.Section("mqtt").Key("ackTimeout").MustInt(30)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Ack Timeout:", defaultConfig.MQTT.AckTimeout)
+	defaultConfig.MQTT.RetryInterval = cfg.Section("mqtt").Key("retryInterval").MustInt(5)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Retry Interval:", defaultConfig.MQTT.RetryInterval)
+	defaultConfig.MQTT.MaxRetryInterval = cfg.Section("mqtt").Key("maxRetryInterval").MustInt(600)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Max Retry Interval:", defaultConfig.MQTT.MaxRetryInterval)
+	defaultConfig.MQTT.MaxRetries = cfg.Section("mqtt").Key("maxRetries").MustInt(0)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Max Retries:", defaultConfig.MQTT.MaxRetries)
+
+	defaultConfig.MQTT.Batch.Enabled = cfg.Section("mqtt.batch").Key("enabled").MustBool(false)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Batch Enabled:", defaultConfig.MQTT.Batch.Enabled)
+	defaultConfig.MQTT.Batch.Kinds = cfg.Section("mqtt.batch").Key("kinds").Strings(",")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Batch Kinds:", defaultConfig.MQTT.Batch.Kinds)
+	defaultConfig.MQTT.Batch.MaxCount = cfg.Section("mqtt.batch").Key("maxCount").MustInt(50)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Batch Max Count:", defaultConfig.MQTT.Batch.MaxCount)
+	defaultConfig.MQTT.Batch.MaxBytes = cfg.Section("mqtt.batch").Key("maxBytes").MustInt(16384)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Batch Max Bytes:", defaultConfig.MQTT.Batch.MaxBytes)
+	defaultConfig.MQTT.Batch.MaxAge = cfg.Section("mqtt.batch").Key("maxAge").MustInt(600)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Batch Max Age:", defaultConfig.MQTT.Batch.MaxAge)
+	defaultConfig.MQTT.Batch.Encoding = cfg.Section("mqtt.batch").Key("encoding").In("json", []string{"json", "gzip", "deflate"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Batch Encoding:", defaultConfig.MQTT.Batch.Encoding)
+
+	defaultConfig.MQTT.Command.Enabled = cfg.Section("mqtt.command").Key("enabled").MustBool(false)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Command Enabled:", defaultConfig.MQTT.Command.Enabled)
+	defaultConfig.MQTT.Command.Prefix = cfg.Section("mqtt.command").Key("prefix").MustString("gateway")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Command Prefix:", defaultConfig.MQTT.Command.Prefix)
+	commandQos, _ := strconv.Atoi(cfg.Section("mqtt.command").Key("qos").In("1", []string{"0", "1", "2"}))
+	defaultConfig.MQTT.Command.Qos = byte(commandQos)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Command Qos:", defaultConfig.MQTT.Command.Qos)
+
+	defaultConfig.MQTT.Presence.Enabled = cfg.Section("mqtt.presence").Key("enabled").MustBool(false)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Presence Enabled:", defaultConfig.MQTT.Presence.Enabled)
+	defaultConfig.MQTT.Presence.Topic = cfg.Section("mqtt.presence").Key("topic").MustString(
+		fmt.Sprintf("%s/%s/presence", defaultConfig.MQTT.Command.Prefix, defaultConfig.MQTT.ClientID))
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Presence Topic:", defaultConfig.MQTT.Presence.Topic)
+	presenceQos, _ := strconv.Atoi(cfg.Section("mqtt.presence").Key("qos").In("1", []string{"0", "1", "2"}))
+	defaultConfig.MQTT.Presence.Qos = byte(presenceQos)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Presence Qos:", defaultConfig.MQTT.Presence.Qos)
+
+	// [mqtt.websocket] 及 [mqtt.websocket.headers]
+	defaultConfig.MQTT.Websocket.Path = cfg.Section("mqtt.websocket").Key("path").MustString("/mqtt")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Websocket Path:", defaultConfig.MQTT.Websocket.Path)
+	defaultConfig.MQTT.Websocket.Proxy = cfg.Section("mqtt.websocket").Key("proxy").String()
+	if proxy := defaultConfig.MQTT.Websocket.Proxy; len(proxy) > 0 && proxy != "none" {
+		if uri, err := url.Parse(proxy); err != nil || len(uri.Scheme) == 0 || len(uri.Host) == 0 {
+			err = fmt.Errorf("invalid websocket proxy %q", redactURL(proxy))
+			log.WithFields(logger.Fields{
+				"config": "load",
+			}).Error("MQTT Websocket Proxy: ", err)
+			return nil, err
+		}
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Websocket Proxy:", redactURL(defaultConfig.MQTT.Websocket.Proxy))
+	defaultConfig.MQTT.Websocket.Headers = cfg.Section("mqtt.websocket.headers").KeysHash()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Websocket Headers:", len(defaultConfig.MQTT.Websocket.Headers))
+
+	defaultConfig.MQTT.Proxy.URL = cfg.Section("mqtt.proxy").Key("url").String()
+	if proxy := defaultConfig.MQTT.Proxy.URL; len(proxy) > 0 && proxy != "none" {
+		uri, err := url.Parse(proxy)
+		if err != nil || !proxySchemes[uri.Scheme] || len(uri.Host) == 0 {
+			err = fmt.Errorf("invalid proxy %q", redactURL(proxy))
+			log.WithFields(logger.Fields{
+				"config": "load",
+			}).Error("MQTT Proxy: ", err)
+			return nil, err
+		}
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Proxy:", redactURL(defaultConfig.MQTT.Proxy.URL))
+	defaultConfig.MQTT.Proxy.Bypass = cfg.Section("mqtt.proxy").Key("bypass").Strings(",")
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Proxy Bypass:", defaultConfig.MQTT.Proxy.Bypass)
+
+	// [mqtt.broker.名称]，按文件中的顺序排列，没有配置时使用 server 和 port
+	defaultConfig.MQTT.Brokers, err = loadBrokers(cfg, &defaultConfig.MQTT)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Error("MQTT Brokers: ", err)
+		return nil, err
+	}
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Brokers:", defaultConfig.MQTT.Brokers)
+	defaultConfig.MQTT.FailoverAfter = cfg.Section("mqtt").Key("failoverAfter").MustInt(3)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Failover After:", defaultConfig.MQTT.FailoverAfter)
+	defaultConfig.MQTT.PrimaryRetry = cfg.Section("mqtt").Key("primaryRetry").MustInt(600)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Primary Retry:", defaultConfig.MQTT.PrimaryRetry)
+
+	// [mqtt.retention] 及 [mqtt.retention.消息类型]
+	retentionPolicies := []string{"drop-oldest", "drop-newest", "keep"}
+	defaultConfig.MQTT.Retention.MaxFileSize = cfg.Section("mqtt.retention").Key("maxFileSize").MustInt64(64 << 20)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Retention Max File Size:", defaultConfig.MQTT.Retention.MaxFileSize)
+	defaultConfig.MQTT.Retention.CheckPeriod = cfg.Section("mqtt.retention").Key("checkPeriod").MustInt(300)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Retention Check Period:", defaultConfig.MQTT.Retention.CheckPeriod)
+	defaultConfig.MQTT.Retention.VacuumPeriod = cfg.Section("mqtt.retention").Key("vacuumPeriod").MustInt(86400)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Retention Vacuum Period:", defaultConfig.MQTT.Retention.VacuumPeriod)
+	defaultConfig.MQTT.Retention.DeadLetterMaxRows = cfg.Section("mqtt.retention").Key("deadLetterMaxRows").MustInt(1000)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Retention Dead Letter Max Rows:", defaultConfig.MQTT.Retention.DeadLetterMaxRows)
+	defaultConfig.MQTT.Retention.Policy = cfg.Section("mqtt.retention").Key("policy").In("drop-oldest", retentionPolicies)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("MQTT Retention Policy:", defaultConfig.MQTT.Retention.Policy)
+	defaultConfig.MQTT.Retention.Kinds = make(map[string]KindRetention)
+	for _, section := range cfg.Section("mqtt.retention").ChildSections() {
+		kind := strings.TrimPrefix(section.Name(), "mqtt.retention.")
+		retention := KindRetention{
+			MaxRows:  section.Key("maxRows").MustInt(0),
+			MaxAge:   section.Key("maxAge").MustInt(0),
+			MaxBytes: section.Key("maxBytes").MustInt64(0),
+			Policy:   section.Key("policy").In(defaultConfig.MQTT.Retention.Policy, retentionPolicies),
+		}
+		defaultConfig.MQTT.Retention.Kinds[kind] = retention
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Info("MQTT Retention ", kind, ": ", retention)
+	}
+
+	// [mqtt.routes] 消息类型 = 主题[,qos[,retain[,priority[,expiry]]]]
+	defaultConfig.MQTT.Routes = make(map[string]MQTTRoute)
+	for _, key := range cfg.Section("mqtt.routes").Keys() {
+		route, err := ParseMQTTRoute(key.String())
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"config": "load",
+			}).Error("MQTT Route ", key.Name(), ": ", err)
+			return nil, err
+		}
+		defaultConfig.MQTT.Routes[key.Name()] = route
+		log.WithFields(logger.Fields{
+			"config": "load",
+		}).Info("MQTT Route ", key.Name(), ": ", route)
+	}
 
 	defaultConfig.Geo.Period = cfg.Section("geo").Key("period").MustInt(100)
 	log.WithFields(logger.Fields{
@@ -194,9 +859,239 @@ func LoadINI(file string, log *logger.Logger) (config *Config, err error) {
 		"config": "load",
 	}).Info("Geo Data Port:", defaultConfig.Geo.DataPort)
 
+	defaultConfig.Voltage.Enabled = cfg.Section("voltage").Key("enabled").MustBool(false)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Enabled:", defaultConfig.Voltage.Enabled)
+	defaultConfig.Voltage.Source = cfg.Section("voltage").Key("source").In("sysfs", []string{"sysfs", "adc", "at"})
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Source:", defaultConfig.Voltage.Source)
+	defaultConfig.Voltage.Path = cfg.Section("voltage").Key("path").String()
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Path:", defaultConfig.Voltage.Path)
+	defaultConfig.Voltage.Port = cfg.Section("voltage").Key("port").MustString(defaultConfig.Geo.ControlPort)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Port:", defaultConfig.Voltage.Port)
+	defaultConfig.Voltage.Scale = cfg.Section("voltage").Key("scale").MustFloat64(0.001)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Scale:", defaultConfig.Voltage.Scale)
+	defaultConfig.Voltage.Offset = cfg.Section("voltage").Key("offset").MustFloat64(0)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Offset:", defaultConfig.Voltage.Offset)
+	defaultConfig.Voltage.Period = cfg.Section("voltage").Key("period").MustInt(300)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Period:", defaultConfig.Voltage.Period)
+	defaultConfig.Voltage.SampleInterval = cfg.Section("voltage").Key("sampleInterval").MustInt(5)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Sample Interval:", defaultConfig.Voltage.SampleInterval)
+	defaultConfig.Voltage.UnderVoltage = cfg.Section("voltage").Key("underVoltage").MustFloat64(0)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Under Voltage:", defaultConfig.Voltage.UnderVoltage)
+	defaultConfig.Voltage.OverVoltage = cfg.Section("voltage").Key("overVoltage").MustFloat64(0)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Over Voltage:", defaultConfig.Voltage.OverVoltage)
+	defaultConfig.Voltage.Hysteresis = cfg.Section("voltage").Key("hysteresis").MustFloat64(0.3)
+	log.WithFields(logger.Fields{
+		"config": "load",
+	}).Info("Voltage Hysteresis:", defaultConfig.Voltage.Hysteresis)
+
 	return defaultConfig, nil
 }
 
+// ParseMQTTRoute 解析路由配置，格式为 主题[,qos[,retain[,priority[,expiry]]]]
+// qos 默认 2，retain 默认 false，priority 默认 0，expiry 默认 0 不过期
+func ParseMQTTRoute(value string) (route MQTTRoute, err error) {
+	fields := strings.Split(value, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	route.Topic = fields[0]
+	if len(route.Topic) == 0 {
+		return route, fmt.Errorf("empty topic in route %q", value)
+	}
+
+	route.Qos = 2
+	if len(fields) > 1 && len(fields[1]) > 0 {
+		qos, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil || qos > 2 {
+			return route, fmt.Errorf("invalid qos in route %q", value)
+		}
+		route.Qos = byte(qos)
+	}
+
+	if len(fields) > 2 && len(fields[2]) > 0 {
+		route.Retain, err = strconv.ParseBool(fields[2])
+		if err != nil {
+			return route, fmt.Errorf("invalid retain in route %q", value)
+		}
+	}
+
+	if len(fields) > 3 && len(fields[3]) > 0 {
+		route.Priority, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return route, fmt.Errorf("invalid priority in route %q", value)
+		}
+	}
+
+	if len(fields) > 4 && len(fields[4]) > 0 {
+		route.Expiry, err = strconv.Atoi(fields[4])
+		if err != nil || route.Expiry < 0 {
+			return route, fmt.Errorf("invalid expiry in route %q", value)
+		}
+	}
+	return route, nil
+}
+
+// redactURL 写入日志的地址，隐藏其中的密码
+func redactURL(raw string) string {
+	uri, err := url.Parse(raw)
+	if err != nil {
+		if strings.Contains(raw, "@") {
+			return "(invalid url with credentials)"
+		}
+		return raw
+	}
+	return uri.Redacted()
+}
+
+// proxySchemes 支持的代理协议
+var proxySchemes = map[string]bool{"socks5": true, "socks5h": true, "http": true}
+
+// brokerSchemes 支持的服务器地址协议
+var brokerSchemes = map[string]bool{"tcp": true, "tls": true, "ws": true, "wss": true}
+
+// loadBrokers 读取 [mqtt.broker.名称]
+// 没有配置时根据 server、port 和 transport 生成一个名为 default 的服务器，与原有配置兼容
+func loadBrokers(cfg *ini.File, mqttConfig *MQTTConfig) ([]MQTTBroker, error) {
+	sections := cfg.Section("mqtt.broker").ChildSections()
+	if len(sections) == 0 {
+		path := ""
+		if mqttConfig.Transport == "ws" || mqttConfig.Transport == "wss" {
+			path = "/" + strings.TrimPrefix(mqttConfig.Websocket.Path, "/")
+		}
+		return []MQTTBroker{{
+			Name:     "default",
+			URL:      fmt.Sprintf("%s://%s:%d%s", mqttConfig.Transport, mqttConfig.Server, mqttConfig.Port, path),
+			Username: mqttConfig.Username,
+			Password: mqttConfig.Password,
+		}}, nil
+	}
+
+	brokers := make([]MQTTBroker, 0, len(sections))
+	for _, section := range sections {
+		broker := MQTTBroker{
+			Name:       strings.TrimPrefix(section.Name(), "mqtt.broker."),
+			URL:        section.Key("url").String(),
+			Username:   section.Key("username").MustString(mqttConfig.Username),
+			Password:   section.Key("password").MustString(mqttConfig.Password),
+			ServerName: section.Key("serverName").String(),
+		}
+		uri, err := url.Parse(broker.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url of broker %s: %w", broker.Name, err)
+		}
+		if !brokerSchemes[uri.Scheme] || len(uri.Host) == 0 {
+			return nil, fmt.Errorf("invalid url of broker %s: %q", broker.Name, broker.URL)
+		}
+		if uri.User != nil {
+			return nil, fmt.Errorf("credentials of broker %s must be set by username and password", broker.Name)
+		}
+		brokers = append(brokers, broker)
+	}
+	return brokers, nil
+}
+
+// probeTypes 支持的联网检测
+var probeTypes = []string{"tcp", "dns", "http", "mqtt"}
+
+// loadProbeChecks 读取 [ec20.probe.名称]
+// 没有配置时检测 DNS1、DNS2 的 TCP 53 端口和 MQTT 连接
+func loadProbeChecks(cfg *ini.File, ec20Config *EC20Config) ([]ProbeCheck, error) {
+	sections := cfg.Section("ec20.probe").ChildSections()
+	if len(sections) == 0 {
+		var checks []ProbeCheck
+		for i, dns := range []string{ec20Config.DNS1, ec20Config.DNS2} {
+			if len(dns) > 0 {
+				checks = append(checks, ProbeCheck{
+					Name:     fmt.Sprintf("dns%d", i+1),
+					Type:     "tcp",
+					Interval: 30,
+					Address:  net.JoinHostPort(dns, "53"),
+				})
+			}
+		}
+		return append(checks, ProbeCheck{Name: "mqtt", Type: "mqtt", Interval: 30}), nil
+	}
+
+	checks := make([]ProbeCheck, 0, len(sections))
+	for _, section := range sections {
+		check := ProbeCheck{
+			Name:     strings.TrimPrefix(section.Name(), "ec20.probe."),
+			Type:     section.Key("type").String(),
+			Interval: section.Key("interval").MustInt(30),
+			Address:  section.Key("address").String(),
+			Host:     section.Key("host").String(),
+			URL:      section.Key("url").String(),
+			Status:   section.Key("status").MustInt(200),
+		}
+		if check.Interval < 1 {
+			return nil, fmt.Errorf("invalid interval of probe %s: %d", check.Name, check.Interval)
+		}
+		switch check.Type {
+		case "tcp":
+			if _, _, err := net.SplitHostPort(check.Address); err != nil {
+				return nil, fmt.Errorf("invalid address of probe %s: %w", check.Name, err)
+			}
+		case "dns":
+			if len(check.Host) == 0 {
+				return nil, fmt.Errorf("host of probe %s is empty", check.Name)
+			}
+		case "http":
+			uri, err := url.Parse(check.URL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid url of probe %s: %w", check.Name, err)
+			}
+			if (uri.Scheme != "http" && uri.Scheme != "https") || len(uri.Host) == 0 {
+				return nil, fmt.Errorf("invalid url of probe %s: %q", check.Name, check.URL)
+			}
+		case "mqtt":
+		default:
+			return nil, fmt.Errorf("unknown type of probe %s: %q, must be one of %v", check.Name, check.Type, probeTypes)
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// SaveKeys 修改配置文件中的配置项并保存，key 的格式为 段名.键名，如 geo.period
+func SaveKeys(file string, values map[string]string) error {
+	cfg, err := ini.Load(file)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		i := strings.LastIndex(name, ".")
+		if i <= 0 || i == len(name)-1 {
+			return fmt.Errorf("invalid config key %q", name)
+		}
+		cfg.Section(name[:i]).Key(name[i+1:]).SetValue(value)
+	}
+	// 保持配置文件原有的 key = value 格式
+	ini.PrettyFormat = false
+	ini.PrettyEqual = true
+	return cfg.SaveTo(file)
+}
+
 // MQTTPubType MQTT 发送类型
 type MQTTPubType int
 
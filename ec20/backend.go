@@ -0,0 +1,100 @@
+package ec20
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// 连接方式，对应 [ec20] 的 dial
+// DialPPP pppd 拨号
+// DialQMI quectel-CM 通过 QMI 建立数据连接
+// DialECM AT+QNETDEVCTL 在 ECM/RNDIS 模式下建立数据连接
+// DialScript 执行 shfile，不由网关监控
+const (
+	DialPPP    = "pppd"
+	DialQMI    = "qmi"
+	DialECM    = "ecm"
+	DialScript = "script"
+)
+
+// Backend 数据连接，由网关建立并在断开后重新连接
+// 联网状态机只通过 Backend 判断和重建连接，不关心具体的连接方式
+type Backend interface {
+	// Run 建立连接，断开后按退避时间重新连接，直到 Stop
+	Run()
+	// Running 连接进程或数据会话是否存在
+	Running() bool
+	// Up 网卡是否已获得地址
+	Up() bool
+	// Restart 断开当前连接，由 Run 重新连接
+	Restart() error
+	// Stop 断开连接，不再重新连接
+	Stop()
+	// Interface 数据连接的网卡
+	Interface() string
+}
+
+// NewBackend 根据 dial 创建数据连接，script 返回 nil
+func NewBackend(log *logger.Logger, ec20Config *config.EC20Config) (Backend, error) {
+	switch ec20Config.Dial {
+	case DialPPP:
+		return NewPPP(log, &ec20Config.PPP, &ec20Config.APN), nil
+	case DialQMI:
+		return NewQMI(log, &ec20Config.QMI, &ec20Config.APN), nil
+	case DialECM:
+		return NewECM(log, ec20Config), nil
+	case DialScript:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown dial %q", ec20Config.Dial)
+}
+
+// 重新连接的退避时间，连接保持 backoffStable 以上时恢复为最短间隔
+const (
+	minBackoff    = 5 * time.Second
+	maxBackoff    = 5 * time.Minute
+	backoffStable = time.Minute
+)
+
+// backoff 重新连接的退避时间
+type backoff struct {
+	next time.Duration
+}
+
+// Next 本次连接结束后等待的时间，upSince 为连接建立的时间，未建立时为零值
+func (b *backoff) Next(upSince time.Time) time.Duration {
+	if b.next == 0 || (!upSince.IsZero() && time.Since(upSince) >= backoffStable) {
+		b.next = minBackoff
+	}
+	wait := b.next
+	b.next *= 2
+	if b.next > maxBackoff {
+		b.next = maxBackoff
+	}
+	return wait
+}
+
+// interfaceAddr 网卡的 IPv4 地址，网卡不存在或没有地址时 up 为 false
+func interfaceAddr(name string) (addr string, up bool) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil || iface.Flags&net.FlagUp == 0 {
+		return "", false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), true
+		}
+	}
+	return "", false
+}
+
+// authCodes APN 认证方式，quectel-CM 和 AT+QICSGP 的 <authentication>
+var authCodes = map[string]int{"none": 0, "pap": 1, "chap": 2}
@@ -0,0 +1,381 @@
+package ec20
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/at"
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/outbox"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// cellularTimeout 采集时每条 AT 命令的超时时间，AT+COPS? 搜网时较慢
+const cellularTimeout = 10 * time.Second
+
+// Registration 网络注册状态，+CREG、+CEREG 的 <stat>
+type Registration struct {
+	Stat  int    `json:"stat"`
+	State string `json:"state"` // not-registered、home、searching、denied、unknown 或 roaming
+	LAC   string `json:"lac,omitempty"`
+	Cell  string `json:"cell,omitempty"`
+}
+
+// registrationStates <stat> 对应的状态
+var registrationStates = map[int]string{
+	0: "not-registered",
+	1: "home",
+	2: "searching",
+	3: "denied",
+	4: "unknown",
+	5: "roaming",
+}
+
+// Registered 是否已注册 (本地或漫游)
+func (r *Registration) Registered() bool {
+	return r != nil && (r.Stat == 1 || r.Stat == 5)
+}
+
+// Operator 当前运营商，+COPS 的返回值
+type Operator struct {
+	Mode int    `json:"mode"`
+	Name string `json:"name,omitempty"`
+	Act  string `json:"act,omitempty"` // GSM、UTRAN、E-UTRAN 等
+}
+
+// copsActs +COPS 的 <AcT>
+var copsActs = map[int]string{
+	0:   "GSM",
+	2:   "UTRAN",
+	3:   "GSM/EGPRS",
+	4:   "UTRAN/HSDPA",
+	5:   "UTRAN/HSUPA",
+	6:   "UTRAN/HSPA",
+	7:   "E-UTRAN",
+	100: "CDMA",
+}
+
+// ServingCell 服务小区，AT+QENG="servingcell" 的返回值
+// State 为 SEARCH、LIMSRV、NOCONN 或 CONNECT，SEARCH 时没有其他字段
+type ServingCell struct {
+	State  string `json:"state"`
+	RAT    string `json:"rat,omitempty"` // LTE、WCDMA 或 GSM
+	Duplex string `json:"duplex,omitempty"`
+	MCC    string `json:"mcc,omitempty"`
+	MNC    string `json:"mnc,omitempty"`
+	LAC    string `json:"lac,omitempty"` // LTE 为 TAC，十六进制
+	CellID string `json:"cellID,omitempty"`
+	PCI    *int   `json:"pci,omitempty"`    // LTE 物理小区 ID，WCDMA 为 PSC
+	EARFCN *int   `json:"earfcn,omitempty"` // LTE 为 EARFCN，WCDMA 为 UARFCN，GSM 为 ARFCN
+	Band   string `json:"band,omitempty"`
+	RSRP   *int   `json:"rsrp,omitempty"`  // dBm
+	RSRQ   *int   `json:"rsrq,omitempty"`  // dB
+	RSSI   *int   `json:"rssi,omitempty"`  // dBm
+	SINR   *int   `json:"sinr,omitempty"`  // dB
+	RSCP   *int   `json:"rscp,omitempty"`  // WCDMA，dBm
+	EcIo   *int   `json:"ecio,omitempty"`  // WCDMA，dB
+	RxLev  *int   `json:"rxlev,omitempty"` // GSM，dBm
+}
+
+// Cellular 蜂窝网络状态，无法获取的字段省略
+type Cellular struct {
+	Time     time.Time     `json:"time"`
+	IMEI     string        `json:"imei,omitempty"`
+	IMSI     string        `json:"imsi,omitempty"`
+	ICCID    string        `json:"iccid,omitempty"`
+	CSQ      *int          `json:"csq,omitempty"`  // AT+CSQ 的 <rssi>，0-31
+	RSSI     *int          `json:"rssi,omitempty"` // 由 CSQ 换算，dBm
+	BER      *int          `json:"ber,omitempty"`
+	SysMode  string        `json:"sysMode,omitempty"` // AT+QCSQ 的网络制式，NOSERVICE 为无服务
+	RSRP     *int          `json:"rsrp,omitempty"`    // AT+QCSQ，dBm
+	RSRQ     *int          `json:"rsrq,omitempty"`    // AT+QCSQ，dB
+	SINR     *float64      `json:"sinr,omitempty"`    // AT+QCSQ，dB
+	CREG     *Registration `json:"creg,omitempty"`
+	CEREG    *Registration `json:"cereg,omitempty"`
+	Operator *Operator     `json:"operator,omitempty"`
+	Serving  *ServingCell  `json:"servingCell,omitempty"`
+	Errors   []string      `json:"errors,omitempty"` // 执行失败的命令
+}
+
+// Collect 依次执行 AT 命令采集蜂窝网络状态，单条命令失败不影响其他字段
+func Collect(engine *at.Engine) *Cellular {
+	c := &Cellular{Time: time.Now()}
+
+	query := func(command string) *at.Response {
+		response, err := engine.Command(command, cellularTimeout)
+		if err != nil {
+			c.Errors = append(c.Errors, fmt.Sprintf("%s: %v", command, err))
+			return nil
+		}
+		return response
+	}
+	value := func(command, prefix string, parse func(string) error) {
+		response := query(command)
+		if response == nil {
+			return
+		}
+		v, ok := response.Value(prefix)
+		if !ok {
+			c.Errors = append(c.Errors, command+": no "+prefix+" in response")
+			return
+		}
+		if err := parse(v); err != nil {
+			c.Errors = append(c.Errors, fmt.Sprintf("%s: %v", command, err))
+		}
+	}
+	line := func(command string) string {
+		response := query(command)
+		if response == nil || len(response.Lines) == 0 {
+			return ""
+		}
+		return response.Lines[0]
+	}
+
+	c.IMEI = line("AT+GSN")
+	c.IMSI = line("AT+CIMI")
+	value("AT+QCCID", "+QCCID:", func(v string) error {
+		c.ICCID = v
+		return nil
+	})
+	value("AT+CSQ", "+CSQ:", func(v string) (err error) {
+		c.CSQ, c.RSSI, c.BER, err = ParseCSQ(v)
+		return err
+	})
+	value("AT+QCSQ", "+QCSQ:", func(v string) (err error) {
+		c.SysMode, c.RSRP, c.RSRQ, c.SINR, err = ParseQCSQ(v)
+		return err
+	})
+	value("AT+CREG?", "+CREG:", func(v string) (err error) {
+		c.CREG, err = ParseRegistration(v)
+		return err
+	})
+	value("AT+CEREG?", "+CEREG:", func(v string) (err error) {
+		c.CEREG, err = ParseRegistration(v)
+		return err
+	})
+	value("AT+COPS?", "+COPS:", func(v string) (err error) {
+		c.Operator, err = ParseCOPS(v)
+		return err
+	})
+	value(`AT+QENG="servingcell"`, "+QENG:", func(v string) (err error) {
+		c.Serving, err = ParseServingCell(v)
+		return err
+	})
+	return c
+}
+
+// splitParams 按逗号拆分参数并去掉引号
+func splitParams(v string) []string {
+	params := strings.Split(v, ",")
+	for i, param := range params {
+		params[i] = strings.Trim(strings.TrimSpace(param), `"`)
+	}
+	return params
+}
+
+// intParam 整数参数，空或 - 时返回 nil
+func intParam(params []string, i int) *int {
+	if i >= len(params) {
+		return nil
+	}
+	n, err := strconv.Atoi(params[i])
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+// stringParam 字符串参数，不存在时为空
+func stringParam(params []string, i int) string {
+	if i >= len(params) || params[i] == "-" {
+		return ""
+	}
+	return params[i]
+}
+
+// ParseCSQ 解析 +CSQ: <rssi>,<ber>，rssi 为 99 时未知
+func ParseCSQ(v string) (csq, rssi, ber *int, err error) {
+	params := splitParams(v)
+	csq, ber = intParam(params, 0), intParam(params, 1)
+	if csq == nil || len(params) != 2 {
+		return nil, nil, nil, fmt.Errorf("unexpected +CSQ %q", v)
+	}
+	if *csq >= 0 && *csq <= 31 {
+		dBm := -113 + 2**csq
+		rssi = &dBm
+	}
+	if ber != nil && *ber == 99 {
+		ber = nil
+	}
+	return csq, rssi, ber, nil
+}
+
+// ParseQCSQ 解析 +QCSQ: <sysmode>[,...]
+// LTE 为 "LTE",<rssi>,<rsrp>,<sinr>,<rsrq>，sinr 以 1/5 dB 为单位，0-250 对应 -20 到 30 dB
+func ParseQCSQ(v string) (sysMode string, rsrp, rsrq *int, sinr *float64, err error) {
+	params := splitParams(v)
+	sysMode = params[0]
+	if len(sysMode) == 0 {
+		return "", nil, nil, nil, fmt.Errorf("unexpected +QCSQ %q", v)
+	}
+	if sysMode == "LTE" {
+		if len(params) < 5 {
+			return sysMode, nil, nil, nil, fmt.Errorf("unexpected +QCSQ %q", v)
+		}
+		rsrp, rsrq = intParam(params, 2), intParam(params, 4)
+		if raw := intParam(params, 3); raw != nil {
+			dB := float64(*raw)/5 - 20
+			sinr = &dB
+		}
+	}
+	return sysMode, rsrp, rsrq, sinr, nil
+}
+
+// ParseRegistration 解析 +CREG、+CEREG 查询的返回值 <n>,<stat>[,<lac>,<ci>[,<AcT>]]
+func ParseRegistration(v string) (*Registration, error) {
+	params := splitParams(v)
+	stat := intParam(params, 1)
+	if stat == nil {
+		return nil, fmt.Errorf("unexpected registration %q", v)
+	}
+	r := &Registration{Stat: *stat, State: registrationStates[*stat]}
+	if len(r.State) == 0 {
+		r.State = "unknown"
+	}
+	r.LAC = stringParam(params, 2)
+	r.Cell = stringParam(params, 3)
+	return r, nil
+}
+
+// ParseCOPS 解析 +COPS: <mode>[,<format>,<oper>[,<AcT>]]
+func ParseCOPS(v string) (*Operator, error) {
+	params := splitParams(v)
+	mode := intParam(params, 0)
+	if mode == nil {
+		return nil, fmt.Errorf("unexpected +COPS %q", v)
+	}
+	o := &Operator{Mode: *mode, Name: stringParam(params, 2)}
+	if act := intParam(params, 3); act != nil {
+		o.Act = copsActs[*act]
+		if len(o.Act) == 0 {
+			o.Act = strconv.Itoa(*act)
+		}
+	}
+	return o, nil
+}
+
+// ParseServingCell 解析 +QENG: "servingcell",<state>,<rat>,...
+func ParseServingCell(v string) (*ServingCell, error) {
+	params := splitParams(v)
+	if len(params) < 2 || params[0] != "servingcell" {
+		return nil, fmt.Errorf("unexpected +QENG %q", v)
+	}
+	s := &ServingCell{State: params[1], RAT: stringParam(params, 2)}
+	switch s.RAT {
+	case "LTE":
+		// "LTE",<is_tdd>,<MCC>,<MNC>,<cellID>,<PCID>,<earfcn>,<freq_band_ind>,<UL_bandwidth>,<DL_bandwidth>,<TAC>,<RSRP>,<RSRQ>,<RSSI>,<SINR>,<srxlev>
+		s.Duplex = stringParam(params, 3)
+		s.MCC = stringParam(params, 4)
+		s.MNC = stringParam(params, 5)
+		s.CellID = stringParam(params, 6)
+		s.PCI = intParam(params, 7)
+		s.EARFCN = intParam(params, 8)
+		s.Band = stringParam(params, 9)
+		s.LAC = stringParam(params, 12)
+		s.RSRP = intParam(params, 13)
+		s.RSRQ = intParam(params, 14)
+		s.RSSI = intParam(params, 15)
+		s.SINR = intParam(params, 16)
+	case "WCDMA":
+		// "WCDMA",<MCC>,<MNC>,<LAC>,<cellID>,<uarfcn>,<PSC>,<RAC>,<RSCP>,<ecio>,...
+		s.MCC = stringParam(params, 3)
+		s.MNC = stringParam(params, 4)
+		s.LAC = stringParam(params, 5)
+		s.CellID = stringParam(params, 6)
+		s.EARFCN = intParam(params, 7)
+		s.PCI = intParam(params, 8)
+		s.RSCP = intParam(params, 10)
+		s.EcIo = intParam(params, 11)
+	case "GSM":
+		// "GSM",<MCC>,<MNC>,<LAC>,<cellid>,<bsic>,<arfcn>,<band>,<rxlev>,...
+		s.MCC = stringParam(params, 3)
+		s.MNC = stringParam(params, 4)
+		s.LAC = stringParam(params, 5)
+		s.CellID = stringParam(params, 6)
+		s.EARFCN = intParam(params, 8)
+		s.Band = stringParam(params, 9)
+		s.RxLev = intParam(params, 10)
+	}
+	return s, nil
+}
+
+// lastCellular 最近一次采集的蜂窝网络状态
+var lastCellular struct {
+	sync.RWMutex
+	cellular *Cellular
+}
+
+// LastCellular 最近一次采集的蜂窝网络状态，尚未采集时为 nil
+func LastCellular() *Cellular {
+	lastCellular.RLock()
+	defer lastCellular.RUnlock()
+	return lastCellular.cellular
+}
+
+// RunCellular 按 cellularPeriod 周期采集蜂窝网络状态，配置了 Cellular 路由时上传
+func RunCellular(log *logger.Logger, ob *outbox.Outbox, ec20Config *config.EC20Config, engine *at.Engine) {
+	if ec20Config.CellularPeriod <= 0 {
+		log.WithFields(logger.Fields{
+			"ec20": "cellular",
+		}).Info("Cellular telemetry disabled")
+		return
+	}
+	_, publish := ob.Registry().Lookup(model.KindCellular)
+	if !publish {
+		log.WithFields(logger.Fields{
+			"ec20": "cellular",
+		}).Warn("Cellular telemetry not published, no route for ", model.KindCellular)
+	}
+
+	ticker := time.NewTicker(time.Duration(ec20Config.CellularPeriod) * time.Second)
+	defer ticker.Stop()
+	for {
+		c := Collect(engine)
+		lastCellular.Lock()
+		lastCellular.cellular = c
+		lastCellular.Unlock()
+
+		fields := logger.Fields{
+			"ec20": "cellular",
+		}
+		if c.RSSI != nil {
+			fields["rssi"] = *c.RSSI
+		}
+		if c.RSRP != nil {
+			fields["rsrp"] = *c.RSRP
+		}
+		if len(c.Errors) > 0 {
+			fields["errors"] = c.Errors
+		}
+		log.WithFields(fields).Info("Cellular: ", c.SysMode)
+
+		if publish {
+			mqttData, err := json.Marshal(c)
+			if err != nil {
+				log.WithFields(logger.Fields{
+					"ec20": "cellular",
+				}).Error("MQTT Json Marshal Err:", err)
+			} else if err := ob.Put(model.KindCellular, string(mqttData)); err != nil {
+				log.WithFields(logger.Fields{
+					"ec20": "cellular",
+				}).Error("Outbox Put Err:", err)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,239 @@
+package ec20
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// show 指针字段的值，nil 为 -
+func show(p interface{}) string {
+	switch v := p.(type) {
+	case *int:
+		if v != nil {
+			return fmt.Sprint(*v)
+		}
+	case *float64:
+		if v != nil {
+			return fmt.Sprintf("%.1f", *v)
+		}
+	}
+	return "-"
+}
+
+func TestParseCSQ(t *testing.T) {
+	tests := []struct {
+		v       string
+		csq     string
+		rssi    string
+		ber     string
+		wantErr bool
+	}{
+		{v: "20,99", csq: "20", rssi: "-73", ber: "-"},
+		{v: "31,0", csq: "31", rssi: "-51", ber: "0"},
+		{v: "0,99", csq: "0", rssi: "-113", ber: "-"},
+		{v: "99,99", csq: "99", rssi: "-", ber: "-"},
+		{v: "", wantErr: true},
+		{v: "20", wantErr: true},
+	}
+	for _, tt := range tests {
+		csq, rssi, ber, err := ParseCSQ(tt.v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseCSQ(%q) no error", tt.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCSQ(%q): %v", tt.v, err)
+			continue
+		}
+		if show(csq) != tt.csq || show(rssi) != tt.rssi || show(ber) != tt.ber {
+			t.Errorf("ParseCSQ(%q) = %s %s %s, want %s %s %s", tt.v, show(csq), show(rssi), show(ber), tt.csq, tt.rssi, tt.ber)
+		}
+	}
+}
+
+func TestParseQCSQ(t *testing.T) {
+	tests := []struct {
+		v       string
+		sysMode string
+		rsrp    string
+		rsrq    string
+		sinr    string
+		wantErr bool
+	}{
+		// "LTE",<rssi>,<rsrp>,<sinr>,<rsrq>
+		{v: `"LTE",-67,-96,151,-10`, sysMode: "LTE", rsrp: "-96", rsrq: "-10", sinr: "10.2"},
+		{v: `"LTE",-52,-80,250,-5`, sysMode: "LTE", rsrp: "-80", rsrq: "-5", sinr: "30.0"},
+		{v: `"LTE",-90,-120,0,-20`, sysMode: "LTE", rsrp: "-120", rsrq: "-20", sinr: "-20.0"},
+		{v: `"WCDMA",-70,-85,-4`, sysMode: "WCDMA", rsrp: "-", rsrq: "-", sinr: "-"},
+		{v: `"GSM",-71`, sysMode: "GSM", rsrp: "-", rsrq: "-", sinr: "-"},
+		{v: `"NOSERVICE"`, sysMode: "NOSERVICE", rsrp: "-", rsrq: "-", sinr: "-"},
+		{v: `"LTE",-67`, wantErr: true},
+		{v: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		sysMode, rsrp, rsrq, sinr, err := ParseQCSQ(tt.v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseQCSQ(%q) no error", tt.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQCSQ(%q): %v", tt.v, err)
+			continue
+		}
+		if sysMode != tt.sysMode || show(rsrp) != tt.rsrp || show(rsrq) != tt.rsrq || show(sinr) != tt.sinr {
+			t.Errorf("ParseQCSQ(%q) = %s %s %s %s, want %s %s %s %s", tt.v,
+				sysMode, show(rsrp), show(rsrq), show(sinr), tt.sysMode, tt.rsrp, tt.rsrq, tt.sinr)
+		}
+	}
+}
+
+func TestParseQCSQSINRScale(t *testing.T) {
+	// sinr 原始值 0-250 对应 -20 到 30 dB，每 1/5 dB 一档
+	for raw := 0; raw <= 250; raw += 25 {
+		_, _, _, sinr, err := ParseQCSQ(fmt.Sprintf(`"LTE",-67,-96,%d,-10`, raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := float64(raw)/5 - 20; math.Abs(*sinr-want) > 1e-9 {
+			t.Fatalf("raw %d sinr %f, want %f", raw, *sinr, want)
+		}
+	}
+}
+
+func TestParseRegistration(t *testing.T) {
+	tests := []struct {
+		v          string
+		want       Registration
+		registered bool
+		wantErr    bool
+	}{
+		{v: "0,1", want: Registration{Stat: 1, State: "home"}, registered: true},
+		{v: `2,1,"DE10","1A2D001",7`, want: Registration{Stat: 1, State: "home", LAC: "DE10", Cell: "1A2D001"}, registered: true},
+		{v: `2,5,"A50B","3F1C0F",2`, want: Registration{Stat: 5, State: "roaming", LAC: "A50B", Cell: "3F1C0F"}, registered: true},
+		{v: "0,2", want: Registration{Stat: 2, State: "searching"}},
+		{v: "0,3", want: Registration{Stat: 3, State: "denied"}},
+		{v: "0,0", want: Registration{Stat: 0, State: "not-registered"}},
+		{v: "0,9", want: Registration{Stat: 9, State: "unknown"}},
+		{v: "0", wantErr: true},
+		{v: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		r, err := ParseRegistration(tt.v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRegistration(%q) no error", tt.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRegistration(%q): %v", tt.v, err)
+			continue
+		}
+		if *r != tt.want || r.Registered() != tt.registered {
+			t.Errorf("ParseRegistration(%q) = %+v registered %v, want %+v %v", tt.v, *r, r.Registered(), tt.want, tt.registered)
+		}
+	}
+}
+
+func TestParseCOPS(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    Operator
+		wantErr bool
+	}{
+		{v: `0,0,"CHINA MOBILE",7`, want: Operator{Mode: 0, Name: "CHINA MOBILE", Act: "E-UTRAN"}},
+		{v: `0,0,"CHN-UNICOM",2`, want: Operator{Mode: 0, Name: "CHN-UNICOM", Act: "UTRAN"}},
+		{v: `0,0,"CHINA MOBILE",0`, want: Operator{Mode: 0, Name: "CHINA MOBILE", Act: "GSM"}},
+		{v: `1,2,"46011",9`, want: Operator{Mode: 1, Name: "46011", Act: "9"}},
+		{v: `0`, want: Operator{Mode: 0}},
+		{v: `2`, want: Operator{Mode: 2}},
+		{v: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		o, err := ParseCOPS(tt.v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseCOPS(%q) no error", tt.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCOPS(%q): %v", tt.v, err)
+			continue
+		}
+		if *o != tt.want {
+			t.Errorf("ParseCOPS(%q) = %+v, want %+v", tt.v, *o, tt.want)
+		}
+	}
+}
+
+// servingCellFields ServingCell 的字段，指针字段 nil 为 -
+func servingCellFields(s *ServingCell) string {
+	return fmt.Sprintf("state=%s rat=%s duplex=%s mcc=%s mnc=%s lac=%s cell=%s pci=%s earfcn=%s band=%s rsrp=%s rsrq=%s rssi=%s sinr=%s rscp=%s ecio=%s rxlev=%s",
+		s.State, s.RAT, s.Duplex, s.MCC, s.MNC, s.LAC, s.CellID, show(s.PCI), show(s.EARFCN), s.Band,
+		show(s.RSRP), show(s.RSRQ), show(s.RSSI), show(s.SINR), show(s.RSCP), show(s.EcIo), show(s.RxLev))
+}
+
+func TestParseServingCell(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "LTE",
+			v:    `"servingcell","NOCONN","LTE","FDD",460,00,1A2D001,1,1650,3,5,5,DE10,-100,-11,-67,11,33`,
+			want: "state=NOCONN rat=LTE duplex=FDD mcc=460 mnc=00 lac=DE10 cell=1A2D001 pci=1 earfcn=1650 band=3 rsrp=-100 rsrq=-11 rssi=-67 sinr=11 rscp=- ecio=- rxlev=-",
+		},
+		{
+			name: "LTE TDD connected",
+			v:    `"servingcell","CONNECT","LTE","TDD",460,00,8C8A103,258,38950,40,5,5,5A50,-87,-9,-58,18,48`,
+			want: "state=CONNECT rat=LTE duplex=TDD mcc=460 mnc=00 lac=5A50 cell=8C8A103 pci=258 earfcn=38950 band=40 rsrp=-87 rsrq=-9 rssi=-58 sinr=18 rscp=- ecio=- rxlev=-",
+		},
+		{
+			name: "WCDMA",
+			v:    `"servingcell","NOCONN","WCDMA",460,01,A50B,3F1C0F,10713,55,1,-85,-4,-,-,-,-,-`,
+			want: "state=NOCONN rat=WCDMA duplex= mcc=460 mnc=01 lac=A50B cell=3F1C0F pci=55 earfcn=10713 band= rsrp=- rsrq=- rssi=- sinr=- rscp=-85 ecio=-4 rxlev=-",
+		},
+		{
+			name: "GSM",
+			v:    `"servingcell","NOCONN","GSM",460,00,1806,2C71,44,40,0,-68,255,255,0,32,32,1,-,-,-,-,-,-,-,-,-,-`,
+			want: "state=NOCONN rat=GSM duplex= mcc=460 mnc=00 lac=1806 cell=2C71 pci=- earfcn=40 band=0 rsrp=- rsrq=- rssi=- sinr=- rscp=- ecio=- rxlev=-68",
+		},
+		{
+			name: "searching",
+			v:    `"servingcell","SEARCH"`,
+			want: "state=SEARCH rat= duplex= mcc= mnc= lac= cell= pci=- earfcn=- band= rsrp=- rsrq=- rssi=- sinr=- rscp=- ecio=- rxlev=-",
+		},
+		{
+			name: "limited service with missing values",
+			v:    `"servingcell","LIMSRV","LTE","FDD",460,00,-,-,1650,3,5,5,-,-,-,-,-,-`,
+			want: "state=LIMSRV rat=LTE duplex=FDD mcc=460 mnc=00 lac= cell= pci=- earfcn=1650 band=3 rsrp=- rsrq=- rssi=- sinr=- rscp=- ecio=- rxlev=-",
+		},
+		{name: "neighbour cell", v: `"neighbourcell intra","LTE",1650,1,-11,-100,-67,11`, wantErr: true},
+		{name: "empty", v: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseServingCell(tt.v)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := servingCellFields(s); got != tt.want {
+				t.Fatalf("\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,16 @@
 package ec20
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/zsy-cn/4g-gateway/command"
 	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/outbox"
 	"github.com/zsy-cn/4g-gateway/pkg/logger"
 )
 
@@ -21,18 +23,69 @@ type Network struct {
 	Mu       sync.Mutex                                       // 排他锁
 	State    NetworkState                                     // 当前状态
 	Handlers map[NetworkState]map[NetworkEvent]NetworkHandler // 处理函数，每一个状态都可以出发有限个事件，执行有限个处理
+
+	stateMu sync.RWMutex // 保护 State，供其他协程读取当前状态
 }
 
 // 获取当前状态
 func (n *Network) getState() NetworkState {
+	n.stateMu.RLock()
+	defer n.stateMu.RUnlock()
 	return n.State
 }
 
 // 设置当前状态
 func (n *Network) setState(newState NetworkState) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
 	n.State = newState
 }
 
+// Current 当前状态，可以在其他协程中调用
+func (n *Network) Current() NetworkState {
+	return n.getState()
+}
+
+// running 运行中的状态机和数据连接，供心跳等模块读取状态
+var running struct {
+	sync.RWMutex
+	network *Network
+	backend Backend // dial 为 script 时为 nil
+
+	connectivity *Connectivity
+}
+
+// runningConnectivity 运行中的联网检测
+func runningConnectivity() *Connectivity {
+	running.RLock()
+	defer running.RUnlock()
+	return running.connectivity
+}
+
+// runningBackend 运行中的数据连接
+func runningBackend() Backend {
+	running.RLock()
+	defer running.RUnlock()
+	return running.backend
+}
+
+// Shutdown 正常退出，断开由网关建立的数据连接
+func Shutdown() {
+	if backend := runningBackend(); backend != nil {
+		backend.Stop()
+	}
+}
+
+// State 运行中的状态机的当前状态，尚未启动时为空
+func State() NetworkState {
+	running.RLock()
+	defer running.RUnlock()
+	if running.network == nil {
+		return ""
+	}
+	return running.network.Current()
+}
+
 // 某状态添加事件处理方法
 func (n *Network) AddHandler(state NetworkState, event NetworkEvent, handler NetworkHandler) *Network {
 	if _, ok := n.Handlers[state]; !ok {
@@ -87,14 +140,7 @@ var (
 
 	JudgeHandler = NetworkHandler(func(args []interface{}) NetworkState {
 		log := args[0].(*logger.Logger)
-		config := args[1].(*config.EC20Config)
-		link, err := IsCanPingOpen(config.DNS1)
-		if err != nil {
-			log.WithFields(logger.Fields{
-				"network": "ping",
-			}).Error("ping was wrong:", err)
-		}
-		if !link {
+		if !runningConnectivity().Up() {
 			log.WithFields(logger.Fields{
 				"network": "ping",
 			}).Info("network is disrupted")
@@ -111,13 +157,22 @@ var (
 		log.WithFields(logger.Fields{
 			"network": "connection",
 		}).Info("network is normal")
-		time.Sleep(time.Duration(90) * time.Second)
+		// 检测到断网时立即重新判断，最长 90 秒
+		runningConnectivity().Wait(false, 90*time.Second)
 		return Judge
 	})
 
 	NetworkSIMHandler = NetworkHandler(func(args []interface{}) NetworkState {
 		log := args[0].(*logger.Logger)
 		config := args[1].(*config.EC20Config)
+		if backend := runningBackend(); backend != nil {
+			// 连接断开后由 Backend 按退避时间重新连接
+			log.WithFields(logger.Fields{
+				"network": "dial",
+			}).Info("Data connection is supervised, waiting for reconnect")
+			time.Sleep(90 * time.Second)
+			return Judge
+		}
 		//先授予.sh文件执行权限，再执行.sh文件
 		cmdd := exec.Command("/bin/bash", "-c", "chmod u+x "+config.Shfile)
 		stdoutbyte, err := cmdd.Output()
@@ -143,6 +198,12 @@ var (
 
 	CheckProcessHandler = NetworkHandler(func(args []interface{}) NetworkState {
 		log := args[0].(*logger.Logger)
+		if backend := runningBackend(); backend != nil {
+			if backend.Running() {
+				return ExistProcess
+			}
+			return NoProcess
+		}
 		excmd := exec.Command("/bin/bash", "-c", "ps -aux | grep pppd | grep -v grep")
 		std_out, err := excmd.Output()
 		if err != nil {
@@ -165,40 +226,11 @@ var (
 
 	WaitOrKillProcessHandler = NetworkHandler(func(args []interface{}) NetworkState {
 		log := args[0].(*logger.Logger)
-		config := args[1].(*config.EC20Config)
-		timeout := time.Duration(120 * time.Second)
-		_, err := net.DialTimeout("tcp", config.DNS1, timeout)
-		if err != nil {
+		if !runningConnectivity().Wait(true, 120*time.Second) {
 			log.WithFields(logger.Fields{
 				"wait": "ping",
-			}).Error("ping was wrong:", err)
-			excmd := exec.Command("/bin/bash", "-c", "ps -aux | grep pppd | grep -v grep")
-			std_out, err := excmd.Output()
-			if err != nil {
-				log.WithFields(logger.Fields{
-					"execution": "ps",
-				}).Error("ps execution failed in Killprocess:", err)
-			}
-			splitString := strings.Fields(string(std_out))
-			for _, fragment := range splitString {
-				if strings.Contains(fragment, "pppd") {
-					killCommand := "sudo kill -9 " + splitString[1]
-					cmd := exec.Command("/bin/bash", "-c", killCommand)
-					_, err := cmd.Output()
-					if err != nil {
-						log.WithFields(logger.Fields{
-							"execution": "kill",
-						}).Error("kill execution failed:", err)
-					}
-					// out_string :=string(out_bytes)
-					if err == nil {
-						log.WithFields(logger.Fields{
-							"network": "kill",
-						}).Info("kill pppd process succeeded")
-						break
-					}
-				}
-			}
+			}).Error("network is still down after 120s")
+			KillPPPD(log)
 			return NoProcess
 		}
 		log.WithFields(logger.Fields{
@@ -208,14 +240,86 @@ var (
 	})
 )
 
-//IsCanPingOpen 函数是确定是否联网的方法
-func IsCanPingOpen(dns string) (bool, error) {
-	timeout := time.Duration(10 * time.Second)
-	_, err := net.DialTimeout("tcp", dns, timeout)
+// KillPPPD 结束 pppd 进程，状态机检测到断网后重新拨号
+// dial 不是 script 时由 Backend 断开并重新连接
+func KillPPPD(log *logger.Logger) error {
+	if backend := runningBackend(); backend != nil {
+		return backend.Restart()
+	}
+	excmd := exec.Command("/bin/bash", "-c", "ps -aux | grep pppd | grep -v grep")
+	std_out, err := excmd.Output()
 	if err != nil {
-		return false, err
+		log.WithFields(logger.Fields{
+			"execution": "ps",
+		}).Error("ps execution failed in Killprocess:", err)
 	}
-	return true, nil
+	// ps -aux 每行的第二列为 pid
+	for _, line := range strings.Split(string(std_out), "\n") {
+		splitString := strings.Fields(line)
+		if len(splitString) > 1 && strings.Contains(line, "pppd") {
+			killCommand := "sudo kill -9 " + splitString[1]
+			cmd := exec.Command("/bin/bash", "-c", killCommand)
+			_, err := cmd.Output()
+			if err != nil {
+				log.WithFields(logger.Fields{
+					"execution": "kill",
+				}).Error("kill execution failed:", err)
+				return err
+			}
+			log.WithFields(logger.Fields{
+				"network": "kill",
+			}).Info("kill pppd process succeeded")
+			return nil
+		}
+	}
+	return errors.New("no pppd process")
+}
+
+// 重启对象
+// RebootSystem 重启网关
+// RebootNetwork 结束 pppd 进程，重新拨号
+const (
+	RebootSystem  = "system"
+	RebootNetwork = "network"
+)
+
+// RebootParams reboot 命令的参数
+type RebootParams struct {
+	Target string `json:"target"` // system 或 network，默认 system
+	Delay  int    `json:"delay"`  // 延迟执行，单位秒，留出发布执行结果的时间，默认 5
+}
+
+// RegisterCommands 注册网络相关的命令
+func RegisterCommands(log *logger.Logger, handlers *command.Handlers) {
+	handlers.Register(command.Reboot, func(cmd *command.Command) (interface{}, error) {
+		params := RebootParams{Target: RebootSystem, Delay: 5}
+		if err := cmd.Bind(&params); err != nil {
+			return nil, err
+		}
+		if params.Target != RebootSystem && params.Target != RebootNetwork {
+			return nil, fmt.Errorf("unknown reboot target %q", params.Target)
+		}
+		if params.Delay < 0 {
+			params.Delay = 0
+		}
+		log.WithFields(logger.Fields{
+			"network": "reboot",
+			"target":  params.Target,
+			"delay":   params.Delay,
+			"id":      cmd.ID,
+		}).Warn("Remote reboot")
+
+		go func() {
+			time.Sleep(time.Duration(params.Delay) * time.Second)
+			switch params.Target {
+			case RebootSystem:
+				ExecCommand("sudo reboot", log)
+			case RebootNetwork:
+				KillPPPD(log)
+			}
+		}()
+		return params, nil
+	})
 }
 
 //ExecCommand 函数是执行.sh脚本的方法
@@ -245,14 +349,46 @@ func ExecCommand(strcommand string, log *logger.Logger) (bool, error) {
 
 func Run(
 	log *logger.Logger,
+	ob *outbox.Outbox,
 	ec20Config *config.EC20Config,
+	handlers *command.Handlers,
+	mqttConnected func() bool,
 ) {
+	RegisterCommands(log, handlers)
+
+	engine, err := OpenModem(log, ec20Config)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"ec20": "modem",
+		}).Error("Open AT port: ", err)
+	} else {
+		go RunCellular(log, ob, ec20Config, engine)
+	}
+
 	network := NewNetwork(Judge)
 	network.AddHandler(Judge, JudgeEvent, JudgeHandler)
 	network.AddHandler(Networked, NetworkedEvent, NetworkedHandler)
 	network.AddHandler(NotNetworked, CheckProcessEvent, CheckProcessHandler)
 	network.AddHandler(ExistProcess, WaitOrKillProcessEvent, WaitOrKillProcessHandler)
 	network.AddHandler(NoProcess, NetworkSIMEvent, NetworkSIMHandler)
+	connectivity := NewConnectivity(log, &ec20Config.Probe, NewProbers(ec20Config, mqttConnected))
+	running.Lock()
+	running.network = network
+	running.connectivity = connectivity
+	running.Unlock()
+	connectivity.Run()
+
+	backend, err := NewBackend(log, ec20Config)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"network": "init",
+		}).Error("Init data connection: ", err)
+	} else if backend != nil {
+		running.Lock()
+		running.backend = backend
+		running.Unlock()
+		go backend.Run()
+	}
 	for {
 		switch network.State {
 		case Judge:
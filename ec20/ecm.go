@@ -0,0 +1,185 @@
+package ec20
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/at"
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// usbnetModes AT+QCFG="usbnet" 的取值
+var usbnetModes = map[string]string{"ecm": "1", "rndis": "3"}
+
+// ecmTimeout AT+QNETDEVCTL 建立数据连接的超时时间
+const ecmTimeout = 30 * time.Second
+
+// ECM 通过 AT+QNETDEVCTL 在 ECM/RNDIS 模式下建立数据连接
+// 数据连接建立后在网卡上运行 DHCP 客户端配置地址、默认路由和 DNS，DHCP 客户端在前台运行并负责续租
+// 模块上报 +QNETDEVCTL: 0 或 DHCP 客户端退出时断开数据连接，按退避时间重新连接
+type ECM struct {
+	log    *logger.Logger
+	config *config.EC20Config
+
+	mu      sync.Mutex
+	dhcp    *Process // 当前的 DHCP 客户端，没有数据连接时为 nil
+	stopped bool
+}
+
+// NewECM 创建 ECM/RNDIS 数据连接
+func NewECM(log *logger.Logger, ec20Config *config.EC20Config) *ECM {
+	return &ECM{
+		log:    log,
+		config: ec20Config,
+	}
+}
+
+// Interface 连接的网卡
+func (e *ECM) Interface() string {
+	return e.config.ECM.Interface
+}
+
+// Up 网卡是否已获得地址
+func (e *ECM) Up() bool {
+	e.mu.Lock()
+	dhcp := e.dhcp
+	e.mu.Unlock()
+	return dhcp != nil && dhcp.Up()
+}
+
+// Running 数据连接是否存在
+func (e *ECM) Running() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dhcp != nil
+}
+
+// Restart 断开当前的数据连接，由 Run 重新连接
+func (e *ECM) Restart() error {
+	e.mu.Lock()
+	dhcp := e.dhcp
+	e.mu.Unlock()
+	if dhcp == nil {
+		return errors.New("no ecm session")
+	}
+	return dhcp.Restart()
+}
+
+// Stop 断开数据连接，不再重新连接
+func (e *ECM) Stop() {
+	e.mu.Lock()
+	e.stopped = true
+	dhcp := e.dhcp
+	e.mu.Unlock()
+	if dhcp != nil {
+		dhcp.Stop()
+	}
+}
+
+// Run 建立数据连接，断开后按退避时间重新连接，直到 Stop
+func (e *ECM) Run() {
+	engine, err := at.Shared(e.log, e.config.ATPort)
+	if err != nil {
+		e.log.WithFields(logger.Fields{
+			"network": "ecm",
+		}).Error("Open AT port: ", err)
+		return
+	}
+	engine.Subscribe("+QNETDEVCTL:", func(line string) {
+		// 最后一个参数为连接状态，0 为已断开
+		params := splitParams(strings.TrimPrefix(line, "+QNETDEVCTL:"))
+		if params[len(params)-1] != "0" {
+			return
+		}
+		e.log.WithFields(logger.Fields{
+			"network": "ecm",
+		}).Warn("Data session dropped by modem: ", line)
+		e.Restart()
+	})
+
+	var b backoff
+	for {
+		e.mu.Lock()
+		stopped := e.stopped
+		e.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		started := time.Now()
+		upSince, err := e.session(engine)
+		wait := b.Next(upSince)
+		if _, cmdErr := engine.Command("AT+QNETDEVCTL=0,1,0", ecmTimeout); cmdErr != nil {
+			e.log.WithFields(logger.Fields{
+				"network": "ecm",
+			}).Warn("Disconnect data session: ", cmdErr)
+		}
+		e.log.WithFields(logger.Fields{
+			"network":  "exit",
+			"process":  "ecm",
+			"duration": int64(time.Since(started) / time.Second),
+			"backoff":  int64(wait / time.Second),
+		}).Warn("ECM session ended: ", err)
+		time.Sleep(wait)
+	}
+}
+
+// session 建立一次数据连接并运行 DHCP 客户端，直到 DHCP 客户端退出
+// 返回网卡获得地址的时间，未获得时为零值
+func (e *ECM) session(engine *at.Engine) (upSince time.Time, err error) {
+	mode := usbnetModes[e.config.ECM.Mode]
+	response, err := engine.Command(`AT+QCFG="usbnet"`, 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if value, _ := response.Value("+QCFG:"); value != `"usbnet",`+mode {
+		// 修改 usbnet 后模块需要重启才能生效，由运维确认后执行
+		return time.Time{}, fmt.Errorf(`modem usbnet is %q, set AT+QCFG="usbnet",%s and reset the modem for %s`,
+			value, mode, e.config.ECM.Mode)
+	}
+
+	apn := &e.config.APN
+	command := fmt.Sprintf(`AT+QICSGP=1,1,"%s","%s","%s",%d`, apn.Name, apn.Username, apn.Password, authCodes[apn.Auth])
+	if _, err := engine.Command(command, 0); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := engine.Command("AT+QNETDEVCTL=1,1,1", ecmTimeout); err != nil {
+		return time.Time{}, err
+	}
+	e.log.WithFields(logger.Fields{
+		"network":   "ecm",
+		"mode":      e.config.ECM.Mode,
+		"apn":       apn.Name,
+		"interface": e.Interface(),
+	}).Info("Data session started")
+
+	if output, err := exec.Command("ip", "link", "set", "dev", e.Interface(), "up").CombinedOutput(); err != nil {
+		return time.Time{}, fmt.Errorf("ip link set %s up: %v: %s", e.Interface(), err, strings.TrimSpace(string(output)))
+	}
+
+	dhcp := &Process{
+		log:     e.log,
+		name:    "dhcp",
+		command: append(strings.Fields(e.config.ECM.DHCP), e.Interface()),
+		iface:   e.Interface(),
+	}
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return time.Time{}, errors.New("stopped")
+	}
+	e.dhcp = dhcp
+	e.mu.Unlock()
+
+	upSince, err = dhcp.run()
+
+	e.mu.Lock()
+	e.dhcp = nil
+	e.mu.Unlock()
+	return upSince, err
+}
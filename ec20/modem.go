@@ -0,0 +1,40 @@
+package ec20
+
+import (
+	"github.com/zsy-cn/4g-gateway/at"
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// modemURCs 记录日志的模块状态 URC
+// RDY 模块启动完成，+CPIN: SIM 卡状态变化，+QIND: 模块指示，POWERED DOWN 模块关机
+var modemURCs = []string{"RDY", "+CPIN:", "+QIND:", "POWERED DOWN"}
+
+// OpenModem 打开 AT 串口共用的引擎，记录模块型号和固件版本，订阅模块状态 URC
+// 打开失败不影响拨号，返回错误由调用方记录
+func OpenModem(log *logger.Logger, ec20Config *config.EC20Config) (*at.Engine, error) {
+	engine, err := at.Shared(log, ec20Config.ATPort)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := engine.Command("ATI", 0)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"ec20": "modem",
+		}).Warn("ATI: ", err)
+	} else {
+		log.WithFields(logger.Fields{
+			"ec20": "modem",
+		}).Info("Modem: ", response.Lines)
+	}
+
+	for _, prefix := range modemURCs {
+		engine.Subscribe(prefix, func(line string) {
+			log.WithFields(logger.Fields{
+				"ec20": "urc",
+			}).Info(line)
+		})
+	}
+	return engine, nil
+}
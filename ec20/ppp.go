@@ -0,0 +1,334 @@
+package ec20
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// processStopWait 发送 SIGTERM 后等待进程退出的时间，超时后 SIGKILL
+const processStopWait = 5 * time.Second
+
+// pppdExitCodes pppd 的退出码，见 pppd(8) EXIT STATUS
+var pppdExitCodes = map[int]string{
+	0:  "connection terminated normally",
+	1:  "fatal error",
+	2:  "options error",
+	3:  "not setuid root",
+	4:  "kernel does not support ppp",
+	5:  "terminated by signal",
+	6:  "serial port could not be locked",
+	7:  "serial port could not be opened",
+	8:  "connect script failed",
+	9:  "pty command could not be run",
+	10: "ppp negotiation failed",
+	11: "peer failed to authenticate",
+	12: "link idle",
+	13: "connect time limit reached",
+	14: "callback negotiated",
+	15: "peer not responding to echo requests",
+	16: "modem hung up",
+	17: "loopback detected",
+	18: "init script failed",
+	19: "failed to authenticate to peer",
+}
+
+// Process 由网关持有的连接进程 (pppd、quectel-CM)，退出后按退避时间重新启动
+// 进程在前台运行，输出写入日志，网卡获得地址时认为连接建立
+type Process struct {
+	log         *logger.Logger
+	name        string   // 写入日志的进程名
+	command     []string // 程序和参数
+	iface       string
+	exitReasons map[int]string // 退出码的含义
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	up      bool
+	stopped bool
+}
+
+// NewPPP pppd 拨号，pppd 以 nodetach 运行，网卡为 ppp<unit>
+func NewPPP(log *logger.Logger, pppConfig *config.PPPConfig, apnConfig *config.APNConfig) *Process {
+	var passwordFile string
+	if len(apnConfig.Password) > 0 {
+		var err error
+		if passwordFile, err = writePasswordFile(pppConfig.Unit, apnConfig.Password); err != nil {
+			log.WithFields(logger.Fields{
+				"network": "init",
+				"process": "pppd",
+			}).Error("Write pppd password file, dial without password: ", err)
+		}
+	}
+	return &Process{
+		log:         log,
+		name:        "pppd",
+		command:     append(strings.Fields(pppConfig.Command), pppArgs(pppConfig, apnConfig, passwordFile)...),
+		iface:       fmt.Sprintf("ppp%d", pppConfig.Unit),
+		exitReasons: pppdExitCodes,
+	}
+}
+
+// chatScript 拨号的 chat 脚本，设置 APN 后拨号
+func chatScript(pppConfig *config.PPPConfig, apnConfig *config.APNConfig) string {
+	return fmt.Sprintf(`chat -v -t 30 ABORT BUSY ABORT 'NO CARRIER' ABORT 'NO DIALTONE' ABORT ERROR `+
+		`'' AT OK ATE0 OK 'AT+CGDCONT=1,"IP","%s"' OK ATD%s CONNECT`, apnConfig.Name, pppConfig.Number)
+}
+
+// passwordFilePattern pppd 选项文件，只包含 APN 密码
+const passwordFilePattern = "4g-gateway-ppp%d.options"
+
+// writePasswordFile 将 APN 密码写入只有网关用户可读的 pppd 选项文件
+// 密码不能出现在 pppd 的命令行中，ps 可以看到所有进程的命令行
+func writePasswordFile(unit int, password string) (string, error) {
+	name := filepath.Join(os.TempDir(), fmt.Sprintf(passwordFilePattern, unit))
+	// 删除后以 O_EXCL 创建，不沿用已有文件的权限，也不跟随符号链接
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	// 引号中的反斜杠是转义字符，配置加载时已拒绝引号和换行
+	_, err = fmt.Fprintf(f, "password \"%s\"\n", strings.ReplaceAll(password, `\`, `\\`))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// pppArgs pppd 的参数，不包括 Command 中的程序和前缀
+// 密码通过 passwordFile 选项文件传入，为空时不使用密码
+func pppArgs(pppConfig *config.PPPConfig, apnConfig *config.APNConfig, passwordFile string) []string {
+	args := []string{
+		pppConfig.Device, fmt.Sprint(pppConfig.Baud),
+		"nodetach", "logfd", "2",
+		"unit", fmt.Sprint(pppConfig.Unit),
+		"connect", chatScript(pppConfig, apnConfig),
+		"noauth", "noipdefault", "usepeerdns", "defaultroute",
+		"ipcp-accept-local", "ipcp-accept-remote",
+		"novj", "novjccomp", "nobsdcomp", "nodeflate",
+		"lcp-echo-interval", "30", "lcp-echo-failure", "4",
+		"maxfail", "1",
+	}
+	if len(apnConfig.Username) > 0 {
+		args = append(args, "user", apnConfig.Username)
+	}
+	if len(passwordFile) > 0 {
+		args = append(args, "file", passwordFile)
+	}
+	return args
+}
+
+// Interface 连接的网卡
+func (p *Process) Interface() string {
+	return p.iface
+}
+
+// Up 网卡是否已获得地址
+func (p *Process) Up() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.up
+}
+
+// Running 进程是否在运行
+func (p *Process) Running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cmd != nil
+}
+
+// Restart 结束当前的进程，由 Run 重新启动
+func (p *Process) Restart() error {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd == nil {
+		return fmt.Errorf("no %s process", p.name)
+	}
+	p.log.WithFields(logger.Fields{
+		"network": "restart",
+		"process": p.name,
+		"pid":     cmd.Process.Pid,
+	}).Warn("Restart ", p.name)
+	return terminate(cmd)
+}
+
+// Stop 结束进程，不再重新启动
+func (p *Process) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd != nil {
+		terminate(cmd)
+	}
+}
+
+// terminate 发送 SIGTERM，processStopWait 后仍未退出时 SIGKILL
+func terminate(cmd *exec.Cmd) error {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	process := cmd.Process
+	time.AfterFunc(processStopWait, func() {
+		// 已退出时返回 os: process already finished
+		process.Kill()
+	})
+	return nil
+}
+
+// Run 启动进程，退出后按退避时间重新启动，直到 Stop
+func (p *Process) Run() {
+	var b backoff
+	for {
+		p.mu.Lock()
+		stopped := p.stopped
+		p.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		started := time.Now()
+		upSince, err := p.run()
+		wait := b.Next(upSince)
+		fields := logger.Fields{
+			"network":  "exit",
+			"process":  p.name,
+			"duration": int64(time.Since(started) / time.Second),
+			"backoff":  int64(wait / time.Second),
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code := exitErr.ExitCode()
+			fields["code"] = code
+			if reason, ok := p.exitReasons[code]; ok {
+				fields["reason"] = reason
+			}
+		}
+		p.log.WithFields(fields).Warn(p.name, " exited: ", err)
+		time.Sleep(wait)
+	}
+}
+
+// run 运行一次进程直到退出，返回连接建立的时间，未建立时为零值
+func (p *Process) run() (upSince time.Time, err error) {
+	if len(p.command) == 0 {
+		return time.Time{}, fmt.Errorf("%s command is empty", p.name)
+	}
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return time.Time{}, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return time.Time{}, err
+	}
+	p.log.WithFields(logger.Fields{
+		"network":   "start",
+		"process":   p.name,
+		"pid":       cmd.Process.Pid,
+		"interface": p.iface,
+	}).Info("Start ", p.name)
+	p.mu.Lock()
+	p.cmd = cmd
+	p.mu.Unlock()
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go p.logOutput(stdout, &output)
+	go p.logOutput(stderr, &output)
+
+	exited := make(chan struct{})
+	link := make(chan time.Time, 1)
+	go func() {
+		link <- p.watchLink(exited)
+	}()
+	// 读完输出后才能 Wait
+	output.Wait()
+	err = cmd.Wait()
+	close(exited)
+	upSince = <-link
+
+	p.mu.Lock()
+	p.cmd = nil
+	p.up = false
+	p.mu.Unlock()
+	return upSince, err
+}
+
+// watchLink 每秒检查网卡，网卡出现并有 IPv4 地址时连接建立，直到进程退出
+func (p *Process) watchLink(exited <-chan struct{}) (upSince time.Time) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			p.mu.Lock()
+			up := p.up
+			p.mu.Unlock()
+			if up {
+				p.log.WithFields(logger.Fields{
+					"network":   "link",
+					"interface": p.iface,
+				}).Warn("Link down")
+			}
+			return upSince
+		case <-ticker.C:
+		}
+		addr, up := interfaceAddr(p.iface)
+		p.mu.Lock()
+		changed := p.up != up
+		p.up = up
+		p.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if up {
+			upSince = time.Now()
+			p.log.WithFields(logger.Fields{
+				"network":   "link",
+				"interface": p.iface,
+				"addr":      addr,
+			}).Info("Link up")
+		} else {
+			p.log.WithFields(logger.Fields{
+				"network":   "link",
+				"interface": p.iface,
+			}).Warn("Link down")
+		}
+	}
+}
+
+// logOutput 将进程的输出逐行写入日志
+func (p *Process) logOutput(r io.Reader, done *sync.WaitGroup) {
+	defer done.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.log.WithFields(logger.Fields{
+			"network": "output",
+			"process": p.name,
+		}).Info(scanner.Text())
+	}
+}
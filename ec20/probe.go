@@ -0,0 +1,262 @@
+package ec20
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// Prober 单个联网检测，按各自的周期执行
+type Prober interface {
+	// Name 检测名称，写入日志
+	Name() string
+	// Interval 检测周期
+	Interval() time.Duration
+	// Probe 执行一次检测，不通时返回错误
+	Probe(ctx context.Context) error
+}
+
+// TCPProber 连接 host:port
+type TCPProber struct {
+	name     string
+	interval time.Duration
+	Address  string
+}
+
+func (p *TCPProber) Name() string            { return p.name }
+func (p *TCPProber) Interval() time.Duration { return p.interval }
+
+func (p *TCPProber) Probe(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// DNSProber 通过 DNS 服务器解析域名，任一服务器解析成功即可
+// 不使用系统的 resolv.conf，拨号前后的 DNS 配置不影响检测结果
+type DNSProber struct {
+	name     string
+	interval time.Duration
+	Host     string
+	Servers  []string // DNS 服务器，没有端口时使用 53
+}
+
+func (p *DNSProber) Name() string            { return p.name }
+func (p *DNSProber) Interval() time.Duration { return p.interval }
+
+func (p *DNSProber) Probe(ctx context.Context) error {
+	if len(p.Servers) == 0 {
+		return errors.New("no dns server")
+	}
+	var err error
+	for _, server := range p.Servers {
+		address := server
+		if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+			address = net.JoinHostPort(server, "53")
+		}
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+		if _, err = resolver.LookupHost(ctx, p.Host); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// HTTPProber GET 指定地址，状态码与期望值相同时认为连通
+type HTTPProber struct {
+	name     string
+	interval time.Duration
+	URL      string
+	Status   int
+}
+
+func (p *HTTPProber) Name() string            { return p.name }
+func (p *HTTPProber) Interval() time.Duration { return p.interval }
+
+func (p *HTTPProber) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	// 不复用连接，每次检测都重新建立 TCP 和 TLS 连接
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != p.Status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, p.Status)
+	}
+	return nil
+}
+
+// SignalProber 由其他模块提供的连通状态，如 MQTT 客户端是否已连接
+type SignalProber struct {
+	name      string
+	interval  time.Duration
+	Connected func() bool
+}
+
+func (p *SignalProber) Name() string            { return p.name }
+func (p *SignalProber) Interval() time.Duration { return p.interval }
+
+func (p *SignalProber) Probe(ctx context.Context) error {
+	if p.Connected == nil || !p.Connected() {
+		return fmt.Errorf("%s is not connected", p.name)
+	}
+	return nil
+}
+
+// NewProbers 根据 [ec20.probe.名称] 创建联网检测，mqttConnected 为 mqtt 检测使用的 MQTT 连接状态
+func NewProbers(ec20Config *config.EC20Config, mqttConnected func() bool) []Prober {
+	var servers []string
+	for _, dns := range []string{ec20Config.DNS1, ec20Config.DNS2} {
+		if len(dns) > 0 {
+			servers = append(servers, dns)
+		}
+	}
+	probers := make([]Prober, 0, len(ec20Config.Probe.Checks))
+	for _, check := range ec20Config.Probe.Checks {
+		interval := time.Duration(check.Interval) * time.Second
+		switch check.Type {
+		case "tcp":
+			probers = append(probers, &TCPProber{name: check.Name, interval: interval, Address: check.Address})
+		case "dns":
+			probers = append(probers, &DNSProber{name: check.Name, interval: interval, Host: check.Host, Servers: servers})
+		case "http":
+			probers = append(probers, &HTTPProber{name: check.Name, interval: interval, URL: check.URL, Status: check.Status})
+		case "mqtt":
+			probers = append(probers, &SignalProber{name: check.Name, interval: interval, Connected: mqttConnected})
+		}
+	}
+	return probers
+}
+
+// Connectivity 汇总所有联网检测的结果
+// 任一检测成功时认为已联网，所有检测合计连续失败 failures 次后认为断网
+type Connectivity struct {
+	log      *logger.Logger
+	probers  []Prober
+	failures int
+	timeout  time.Duration
+
+	mu          sync.Mutex
+	up          bool
+	consecutive int           // 连续失败次数
+	changed     chan struct{} // 联网状态变化时关闭并重新创建
+}
+
+// NewConnectivity 创建联网检测，启动前为未联网
+func NewConnectivity(log *logger.Logger, probeConfig *config.ProbeConfig, probers []Prober) *Connectivity {
+	return &Connectivity{
+		log:      log,
+		probers:  probers,
+		failures: probeConfig.Failures,
+		timeout:  time.Duration(probeConfig.Timeout) * time.Second,
+		changed:  make(chan struct{}),
+	}
+}
+
+// Run 每个检测在单独的协程中按各自的周期执行
+func (c *Connectivity) Run() {
+	for _, prober := range c.probers {
+		go c.run(prober)
+	}
+}
+
+// run 立即执行一次检测，之后按周期执行
+func (c *Connectivity) run(prober Prober) {
+	ticker := time.NewTicker(prober.Interval())
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err := prober.Probe(ctx)
+		cancel()
+		c.record(prober.Name(), err)
+		<-ticker.C
+	}
+}
+
+// record 记录一次检测结果
+func (c *Connectivity) record(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	up := c.up
+	if err == nil {
+		c.consecutive = 0
+		up = true
+	} else {
+		c.consecutive++
+		c.log.WithFields(logger.Fields{
+			"network":     "probe",
+			"probe":       name,
+			"consecutive": c.consecutive,
+		}).Warn("Probe failed: ", err)
+		if c.consecutive >= c.failures {
+			up = false
+		}
+	}
+	if up == c.up {
+		return
+	}
+	c.up = up
+	close(c.changed)
+	c.changed = make(chan struct{})
+	if up {
+		c.log.WithFields(logger.Fields{
+			"network": "probe",
+			"probe":   name,
+		}).Info("Network is up")
+	} else {
+		c.log.WithFields(logger.Fields{
+			"network":  "probe",
+			"failures": c.consecutive,
+		}).Warn("Network is down")
+	}
+}
+
+// Up 是否已联网
+func (c *Connectivity) Up() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.up
+}
+
+// Wait 等待联网状态变为 up，超时返回当前状态
+func (c *Connectivity) Wait(up bool, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		current, changed := c.up, c.changed
+		c.mu.Unlock()
+		if current == up {
+			return current
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return c.Up()
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package ec20
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// NewQMI quectel-CM 通过 QMI 建立数据连接
+// quectel-CM 在前台运行，连接建立后调用 udhcpc 配置网卡地址、默认路由和 DNS，断开时退出
+func NewQMI(log *logger.Logger, qmiConfig *config.QMIConfig, apnConfig *config.APNConfig) *Process {
+	return &Process{
+		log:     log,
+		name:    "quectel-CM",
+		command: append(strings.Fields(qmiConfig.Command), qmiArgs(qmiConfig, apnConfig)...),
+		iface:   qmiConfig.Interface,
+	}
+}
+
+// qmiArgs quectel-CM 的参数 -s <apn> [<user> <password> <auth>] -i <interface>
+func qmiArgs(qmiConfig *config.QMIConfig, apnConfig *config.APNConfig) []string {
+	var args []string
+	if len(apnConfig.Name) > 0 {
+		args = append(args, "-s", apnConfig.Name)
+		if len(apnConfig.Username) > 0 {
+			args = append(args, apnConfig.Username, apnConfig.Password, fmt.Sprint(authCodes[apnConfig.Auth]))
+		}
+	}
+	return append(args, "-i", qmiConfig.Interface)
+}
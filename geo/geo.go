@@ -8,13 +8,17 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/zsy-cn/4g-gateway/at"
+	"github.com/zsy-cn/4g-gateway/command"
 	"github.com/zsy-cn/4g-gateway/config"
 	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/outbox"
 	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/serial"
-	"gorm.io/gorm"
 )
 
 // NMEA 符合 NMEA 规定
@@ -77,7 +81,63 @@ type Geo struct {
 	Longitude string    `json:"longitude"`
 }
 
-// IniGeo 初始化 GPS 模块
+// lastFix 最近一次定位
+var lastFix struct {
+	sync.RWMutex
+	geo   Geo
+	valid bool
+}
+
+// LastFix 最近一次定位，尚未定位时 ok 为 false
+func LastFix() (geo Geo, ok bool) {
+	lastFix.RLock()
+	defer lastFix.RUnlock()
+	return lastFix.geo, lastFix.valid
+}
+
+// setLastFix 记录最近一次定位
+func setLastFix(geo Geo) {
+	lastFix.Lock()
+	defer lastFix.Unlock()
+	lastFix.geo = geo
+	lastFix.valid = true
+}
+
+// Position request-position 命令的执行结果
+type Position struct {
+	Geo
+	Age int64 `json:"age"` // 距离定位时间，单位秒
+}
+
+// RegisterCommands 注册 GPS 相关的命令和配置项
+// period 为上传周期，geo.period 修改后下一次上传时生效
+func RegisterCommands(handlers *command.Handlers, period *int64) {
+	handlers.Register(command.RequestPosition, func(cmd *command.Command) (interface{}, error) {
+		geo, ok := LastFix()
+		if !ok {
+			return nil, errors.New("no gps fix available")
+		}
+		return Position{Geo: geo, Age: int64(time.Since(geo.Time) / time.Second)}, nil
+	})
+	handlers.RegisterSetting("geo.period", func(value string) error {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("invalid period %q", value)
+		}
+		atomic.StoreInt64(period, int64(seconds))
+		return nil
+	})
+}
+
+// EC20 GNSS 命令的错误码
+// cmeSessionOngoing 定位会话已开启
+// cmeNotActive 定位会话未开启
+const (
+	cmeSessionOngoing = 504
+	cmeNotActive      = 505
+)
+
+// IniGeo 初始化 GPS 模块，通过共用的 AT 引擎开启定位，返回 NMEA 数据串口
 func InitGeo(
 	log *logger.Logger,
 	geoConfig *config.GeoConfig,
@@ -86,12 +146,7 @@ func InitGeo(
 		"geo": "init",
 	}).Info("Init geo")
 
-	optionUSB2 := &serial.Config{
-		Name:        geoConfig.ControlPort,
-		Baud:        115200,
-		ReadTimeout: time.Second,
-	}
-	serialPortUSB2, err := serial.OpenPort(optionUSB2)
+	engine, err := at.Shared(log, geoConfig.ControlPort)
 	if err != nil {
 		log.WithFields(logger.Fields{
 			"geo": "init",
@@ -99,73 +154,40 @@ func InitGeo(
 		return nil, err
 	}
 
-	QGPSCFGATCommand := "AT+QGPSCFG=\"gpsnmeatype\",1\r"
-	QGPSENDATCommand := "AT+QGPSEND\r"
-	QGPSATCommand := "AT+QGPS=1,,,,10\r"
-
-	buf := make([]byte, 128)
-
-	//b := []byte{0x41, 0x54, 0x2B, 0x51, 0x47, 0x50, 0x53, 0x3D, 0x31, 0x0d}
-	_, err = serialPortUSB2.Write([]byte(QGPSENDATCommand))
-	if err != nil {
-		log.WithFields(logger.Fields{
-			"geo": "init",
-		}).Error("QGPSENDATCommand write err: ", err)
-		return nil, err
-	}
-	time.Sleep(1 * time.Second)
-	num, err := serialPortUSB2.Read(buf)
-	if err != nil {
+	// 先结束之前的定位会话，未开启定位时返回 +CME ERROR: 505
+	response, err := engine.Command("AT+QGPSEND", 0)
+	if err != nil && !at.IsCME(err, cmeNotActive) {
 		log.WithFields(logger.Fields{
 			"geo": "config",
-		}).Error("QGPSENDATCommand Read err: ", err)
+		}).Error("QGPSENDATCommand err: ", err)
 		return nil, err
 	}
 	log.WithFields(logger.Fields{
 		"geo": "config",
-	}).Info("QGPSENDATCommand Config: ", string(buf[:num]))
+	}).Info("QGPSENDATCommand Config: ", response.Lines, err)
 
-	_, err = serialPortUSB2.Write([]byte(QGPSCFGATCommand))
-	if err != nil {
-		log.WithFields(logger.Fields{
-			"geo": "init",
-		}).Error("QGPSCFGATCommand write err: ", err)
-		return nil, err
-	}
-	time.Sleep(1 * time.Second)
-	num, err = serialPortUSB2.Read(buf)
+	response, err = engine.Command(`AT+QGPSCFG="gpsnmeatype",1`, 0)
 	if err != nil {
 		log.WithFields(logger.Fields{
 			"geo": "config",
-		}).Error("QGPSCFGATCommand Read err: ", err)
+		}).Error("QGPSCFGATCommand err: ", err)
 		return nil, err
 	}
 	log.WithFields(logger.Fields{
 		"geo": "config",
-	}).Info("QGPSCFGATCommand Config: ", string(buf[:num]))
-	time.Sleep(1 * time.Second)
+	}).Info("QGPSCFGATCommand Config: ", response.Lines)
 
-	_, err = serialPortUSB2.Write([]byte(QGPSATCommand))
-	if err != nil {
-		log.WithFields(logger.Fields{
-			"geo": "init",
-		}).Error("QGPSATCommand write err: ", err)
-		return nil, err
-	}
-	time.Sleep(1 * time.Second)
-	num, err = serialPortUSB2.Read(buf)
-	if err != nil {
+	// 定位会话已开启时返回 +CME ERROR: 504
+	response, err = engine.Command("AT+QGPS=1,,,,10", 0)
+	if err != nil && !at.IsCME(err, cmeSessionOngoing) {
 		log.WithFields(logger.Fields{
 			"geo": "config",
-		}).Error("QGPSATCommand Read err: ", err)
+		}).Error("QGPSATCommand err: ", err)
 		return nil, err
 	}
 	log.WithFields(logger.Fields{
 		"geo": "config",
-	}).Info("QGPSATCommand Config: ", string(buf[:num]))
-	time.Sleep(1 * time.Second)
-
-	serialPortUSB2.Close()
+	}).Info("QGPSATCommand Config: ", response.Lines, err)
 
 	options := &serial.Config{
 		Name:        geoConfig.DataPort,
@@ -186,9 +208,14 @@ func InitGeo(
 // Run 采集并上传 GPS 数据
 func Run(
 	log *logger.Logger,
-	db *gorm.DB,
+	ob *outbox.Outbox,
 	geoConfig *config.GeoConfig,
+	handlers *command.Handlers,
 ) {
+	// 上传周期可以通过命令修改
+	period := int64(geoConfig.Period)
+	RegisterCommands(handlers, &period)
+
 	// 初始化GPS
 	serialPortGPS, err := InitGeo(log, geoConfig)
 	if err != nil {
@@ -229,6 +256,7 @@ func Run(
 					G.Time = time.Now()
 					G.Latitude = latitude
 					G.Longitude = longitude
+					setLastFix(*G)
 					mqttData, err := json.Marshal(G)
 					if err != nil {
 						log.WithFields(logger.Fields{
@@ -237,8 +265,12 @@ func Run(
 						continue
 					}
 					// 存入数据库
-					db.Create(&model.MQTTMsg{Topic: "GPS", Msg: string(mqttData)})
-					time.Sleep(time.Duration(geoConfig.Period) * time.Second)
+					if err := ob.Put(model.KindGPS, string(mqttData)); err != nil {
+						log.WithFields(logger.Fields{
+							"geo": "run",
+						}).Error("Outbox Put Err:", err)
+					}
+					time.Sleep(time.Duration(atomic.LoadInt64(&period)) * time.Second)
 				} else {
 					log.WithFields(logger.Fields{
 						"geo": "run",
@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package heartbeat
+
+import "syscall"
+
+// freeDisk path 所在文件系统的可用空间，单位字节
+func freeDisk(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
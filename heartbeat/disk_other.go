@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package heartbeat
+
+import "errors"
+
+// freeDisk 只支持 Linux
+func freeDisk(path string) (int64, error) {
+	return 0, errors.New("free disk not supported")
+}
@@ -0,0 +1,111 @@
+package heartbeat
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/camera"
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/ec20"
+	"github.com/zsy-cn/4g-gateway/geo"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/mqtt"
+	"github.com/zsy-cn/4g-gateway/outbox"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// started 进程启动时间
+var started = time.Now()
+
+// Heartbeat 心跳，数值为 -1 表示无法获取
+type Heartbeat struct {
+	Time      time.Time        `json:"time"`
+	ClientID  string           `json:"clientID"`
+	Version   string           `json:"version"`            // 固件版本 app_version
+	Uptime    int64            `json:"uptime"`             // 运行时间，单位秒
+	Network   string           `json:"network"`            // ec20 联网状态
+	Broker    string           `json:"broker"`             // 已连接的 MQTT 服务器名称
+	Device    string           `json:"device"`             // 设备状态机状态
+	GPSFixAge int64            `json:"gpsFixAge"`          // 距离最近一次定位的时间，单位秒，尚未定位为 -1
+	Outbox    map[string]int64 `json:"outbox"`             // 每个消息类型待发送的条数
+	Evicted   map[string]int64 `json:"evicted,omitempty"`  // 启动以来每个消息类型被保留策略淘汰的条数
+	FreeDisk  int64            `json:"freeDisk"`           // 数据库所在磁盘的可用空间，单位字节
+	Cellular  *ec20.Cellular   `json:"cellular,omitempty"` // 最近一次采集的蜂窝网络状态
+}
+
+// Collect 采集当前的运行状态
+func Collect(log *logger.Logger, ob *outbox.Outbox, retention *outbox.Retention, cfg *config.Config) *Heartbeat {
+	H := &Heartbeat{
+		Time:      time.Now(),
+		ClientID:  cfg.MQTT.ClientID,
+		Version:   cfg.AppVersion,
+		Uptime:    int64(time.Since(started) / time.Second),
+		Network:   string(ec20.State()),
+		Broker:    mqtt.Broker(),
+		Device:    string(camera.State()),
+		GPSFixAge: -1,
+		FreeDisk:  -1,
+		Cellular:  ec20.LastCellular(),
+		Evicted:   retention.Evicted(),
+	}
+
+	if fix, ok := geo.LastFix(); ok {
+		H.GPSFixAge = int64(time.Since(fix.Time) / time.Second)
+	}
+
+	depth, err := ob.Depth()
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"heartbeat": "collect",
+		}).Error("Outbox depth: ", err)
+	}
+	H.Outbox = depth
+
+	free, err := freeDisk(filepath.Dir(cfg.Database.Path))
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"heartbeat": "collect",
+		}).Error("Free disk: ", err)
+	} else {
+		H.FreeDisk = free
+	}
+	return H
+}
+
+// Run 按 heartPeriod 周期写入心跳，未配置心跳路由或周期为 0 时不发送
+func Run(
+	log *logger.Logger,
+	ob *outbox.Outbox,
+	retention *outbox.Retention,
+	cfg *config.Config,
+) {
+	if cfg.MQTT.HeartPeriod <= 0 {
+		log.WithFields(logger.Fields{
+			"heartbeat": "run",
+		}).Info("Heartbeat disabled")
+		return
+	}
+	if _, ok := ob.Registry().Lookup(model.KindHeartbeat); !ok {
+		log.WithFields(logger.Fields{
+			"heartbeat": "run",
+		}).Warn("Heartbeat disabled, no route for ", model.KindHeartbeat)
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(cfg.MQTT.HeartPeriod) * time.Second)
+	defer ticker.Stop()
+	for {
+		mqttData, err := json.Marshal(Collect(log, ob, retention, cfg))
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"heartbeat": "run",
+			}).Error("MQTT Json Marshal Err:", err)
+		} else if err := ob.Put(model.KindHeartbeat, string(mqttData)); err != nil {
+			log.WithFields(logger.Fields{
+				"heartbeat": "run",
+			}).Error("Outbox Put Err:", err)
+		}
+		<-ticker.C
+	}
+}
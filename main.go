@@ -1,24 +1,30 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/zsy-cn/4g-gateway/camera"
+	"github.com/zsy-cn/4g-gateway/command"
 	"github.com/zsy-cn/4g-gateway/config"
 	"github.com/zsy-cn/4g-gateway/ec20"
 	"github.com/zsy-cn/4g-gateway/geo"
+	"github.com/zsy-cn/4g-gateway/heartbeat"
 	"github.com/zsy-cn/4g-gateway/model"
 	"github.com/zsy-cn/4g-gateway/mqtt"
+	"github.com/zsy-cn/4g-gateway/outbox"
 	"github.com/zsy-cn/4g-gateway/pkg/cli"
 	"github.com/zsy-cn/4g-gateway/pkg/lfshook"
 	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/rotatelogs"
+	"github.com/zsy-cn/4g-gateway/voltage"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -119,14 +125,46 @@ func InitLog(LogFilePath, LogFileName string) (log *logger.Logger, err error) {
 	return log, nil
 }
 
-func InitDB(log *logger.Logger) *gorm.DB {
-	db, err := gorm.Open(sqlite.Open("./mqttmsg.db"), &gorm.Config{})
+// InitDB 打开数据库并执行迁移
+func InitDB(log *logger.Logger, dbConfig *config.DatabaseConfig) *gorm.DB {
+	if dbConfig.Driver != "sqlite" {
+		log.WithFields(logger.Fields{
+			"db": "init",
+		}).Panic("unsupported database driver: ", dbConfig.Driver)
+	}
+
+	var dsn string
+	if dbConfig.Path == ":memory:" {
+		// 连接池中的每个连接共享同一个内存数据库
+		dsn = "file::memory:?cache=shared"
+	} else {
+		if err := os.MkdirAll(filepath.Dir(dbConfig.Path), 0755); err != nil {
+			log.WithFields(logger.Fields{
+				"db": "init",
+			}).Panic("failed to create database directory: ", err)
+		}
+		dsn = fmt.Sprintf("file:%s?_journal_mode=%s&_busy_timeout=%d&_synchronous=%s",
+			dbConfig.Path, dbConfig.JournalMode, dbConfig.BusyTimeout, dbConfig.Synchronous)
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	if err != nil {
 		log.WithFields(logger.Fields{
 			"db": "init",
 		}).Panic("failed to connect database: ", err)
 	}
-	db.AutoMigrate(&model.MQTTMsg{})
+
+	version, err := model.Migrate(db)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"db":      "migrate",
+			"version": version,
+		}).Panic("failed to migrate database: ", err)
+	}
+	log.WithFields(logger.Fields{
+		"db":      "migrate",
+		"version": version,
+	}).Info("Database schema up to date")
 	return db
 }
 
@@ -154,17 +192,26 @@ func RunSystem(opts []Option) {
 	log.Info("进程号: ", os.Getpid())
 
 	// 初始化数据库
-	db := InitDB(log)
+	db := InitDB(log, &Config.Database)
+	ob := outbox.New(db, outbox.NewRegistryFromConfig(&Config.MQTT))
+
+	// 云端下发的命令，由各模块注册处理函数
+	commands := command.NewHandlers(log, Config.File)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	// 初始化4G网络
 	// 判断能否联网
-	go ec20.Run(log, &Config.EC20)
+	// MQTT 连接状态作为联网检测之一
+	go ec20.Run(log, ob, &Config.EC20, commands, mqtt.Connected)
 
 	// 发送 mqtt 队列
-	go mqtt.Run(log, db, &Config.MQTT)
+	go mqtt.Run(log, ob, &Config.MQTT, Config.AppVersion, commands)
+
+	// 按保留策略淘汰积压的消息，防止数据库占满存储
+	retention := outbox.NewRetention(log, ob, &Config.MQTT.Retention)
+	go retention.Run()
 
 	// 打开摄像头
 	// 识别qrcode编码
@@ -172,13 +219,19 @@ func RunSystem(opts []Option) {
 	// 生成上电，开机，关机信息
 	// 存入数据库
 	// mqtt上传(时间，二维码信息)
-	go camera.Run(log, db, &Config.System)
+	go camera.Run(log, ob, &Config.System, commands)
 
 	// 获取GPS信息
 	// 生成GPS上传信息
 	// 存入数据库
 	// mqtt上传(时间，经度，纬度)
-	go geo.Run(log, db, &Config.Geo)
+	go geo.Run(log, ob, &Config.Geo, commands)
+
+	// 监测供电电压，欠压、过压时立即告警
+	go voltage.Run(log, ob, &Config.Voltage)
+
+	// 定期上传心跳，包括运行时间、联网状态、设备状态、定位、队列积压和磁盘空间
+	go heartbeat.Run(log, ob, retention, Config)
 
 	wg.Wait()
 }
@@ -204,6 +257,9 @@ EXIT:
 			break EXIT
 		}
 	}
+	// 正常退出时发布 offline，服务器只在异常断开时发布遗嘱
+	mqtt.Shutdown(5 * time.Second)
+	ec20.Shutdown()
 	log.Println("服务退出")
 	time.Sleep(time.Second)
 	os.Exit(state)
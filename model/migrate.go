@@ -0,0 +1,148 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaMigration 已执行的数据库迁移
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migration 一次数据库迁移，Version 递增，已发布的迁移不能修改，只能追加新的迁移
+type Migration struct {
+	Version int
+	Name    string
+	Migrate func(tx *gorm.DB) error
+}
+
+// mqttMsgV1 最初版本的 mqtt_msgs 表
+type mqttMsgV1 struct {
+	gorm.Model
+	Topic string
+	Msg   string
+}
+
+func (mqttMsgV1) TableName() string { return "mqtt_msgs" }
+
+// mqttMsgV2 增加发送状态和重试
+type mqttMsgV2 struct {
+	gorm.Model
+	Topic         string
+	Msg           string
+	State         string `gorm:"index;default:pending"`
+	Retries       int
+	NextAttemptAt time.Time `gorm:"index"`
+}
+
+func (mqttMsgV2) TableName() string { return "mqtt_msgs" }
+
+// mqttMsgV3 增加优先级
+type mqttMsgV3 struct {
+	gorm.Model
+	Topic         string
+	Msg           string
+	Priority      int    `gorm:"index"`
+	State         string `gorm:"index;default:pending"`
+	Retries       int
+	NextAttemptAt time.Time `gorm:"index"`
+}
+
+func (mqttMsgV3) TableName() string { return "mqtt_msgs" }
+
+// mqttDeadLetterV1 最初版本的 mqtt_dead_letters 表
+type mqttDeadLetterV1 struct {
+	gorm.Model
+	Kind   string
+	Msg    string
+	Reason string
+}
+
+func (mqttDeadLetterV1) TableName() string { return "mqtt_dead_letters" }
+
+// mqttPacketV1 最初版本的 mqtt_packets 表
+type mqttPacketV1 struct {
+	Key       string `gorm:"primaryKey"`
+	Data      []byte
+	Size      int
+	Corrupt   bool `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+func (mqttPacketV1) TableName() string { return "mqtt_packets" }
+
+// Migrations 按版本排列的数据库迁移
+// 每个迁移使用当时的表结构快照，不引用会继续变化的 MQTTMsg 等类型
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create mqtt_msgs",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&mqttMsgV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add delivery state to mqtt_msgs",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&mqttMsgV2{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create mqtt_dead_letters",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&mqttDeadLetterV1{})
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add priority to mqtt_msgs",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&mqttMsgV3{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create mqtt_packets",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&mqttPacketV1{})
+		},
+	},
+}
+
+// Migrate 执行尚未执行的数据库迁移，每个迁移在单独的事务中执行
+// 返回执行后的版本号
+func Migrate(db *gorm.DB) (version int, err error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return 0, err
+	}
+	if err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error; err != nil {
+		return 0, err
+	}
+	for _, migration := range Migrations {
+		if migration.Version <= version {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Migrate(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return version, err
+		}
+		version = migration.Version
+	}
+	return version, nil
+}
@@ -1,11 +1,58 @@
 package model
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// 消息类型，对应 MQTTMsg.Topic
+const (
+	KindStatus       = "Status"
+	KindGPS          = "GPS"
+	KindHeartbeat    = "Heartbeat"
+	KindVoltage      = "Voltage"
+	KindVoltageAlarm = "VoltageAlarm"
+	KindEvent        = "Event"
+	KindCellular     = "Cellular"
+)
+
+// 消息发送状态
+// StatePending 等待发送
+// StateInFlight 已发送，等待服务器确认
+// StateAcked 服务器已确认，等待删除
+const (
+	StatePending  = "pending"
+	StateInFlight = "in-flight"
+	StateAcked    = "acked"
+)
+
+// MQTTMsg 待发送的 MQTT 消息，Topic 为消息类型，由路由表映射到实际的 MQTT 主题
 type MQTTMsg struct {
 	gorm.Model
-	Topic string
-	Msg   string
+	Topic         string
+	Msg           string
+	Priority      int    `gorm:"index"`
+	State         string `gorm:"index;default:pending"`
+	Retries       int
+	NextAttemptAt time.Time `gorm:"index"`
+}
+
+// MQTTDeadLetter 无法路由的消息，从发送队列中移出，避免阻塞队列
+type MQTTDeadLetter struct {
+	gorm.Model
+	Kind   string
+	Msg    string
+	Reason string
+}
+
+// MQTTPacket MQTT 客户端保存的未完成报文，Key 为 i.报文 ID 或 o.报文 ID，Data 为报文编码
+// 无法解码的报文标记为 Corrupt，不再返回给客户端，保留用于排查
+type MQTTPacket struct {
+	Key       string `gorm:"primaryKey"`
+	Data      []byte
+	Size      int
+	Corrupt   bool `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
 }
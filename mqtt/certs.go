@@ -0,0 +1,232 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/outbox"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// certCheckPeriod 检查客户端证书有效期的周期
+const certCheckPeriod = time.Hour
+
+// certReloader 客户端证书，证书或私钥文件被替换后在下一次握手时重新加载
+type certReloader struct {
+	log      *logger.Logger
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // 已加载的证书和私钥中较新的修改时间
+}
+
+// newCertReloader 加载客户端证书，失败时返回 error
+func newCertReloader(log *logger.Logger, certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified 证书和私钥中较新的修改时间
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load 加载证书和私钥
+func (r *certReloader) load() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetClientCertificate 供 tls.Config 在每次握手时调用
+// 文件有变化时重新加载，加载失败 (如证书和私钥只替换了一个) 时继续使用原来的证书
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.modified()
+	if err == nil && modTime.After(r.modTime) {
+		if err := r.load(); err != nil {
+			r.log.WithFields(logger.Fields{
+				"mqtt": "X509",
+				"cert": r.certFile,
+			}).Error("Reload client certificate, keep the old one: ", err)
+		} else {
+			r.log.WithFields(logger.Fields{
+				"mqtt": "X509",
+				"cert": r.certFile,
+			}).Info("Reload client certificate")
+		}
+	}
+	return r.cert, nil
+}
+
+// CertExpiry 证书即将过期或已过期的事件
+type CertExpiry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"` // cert-expiry
+	ClientID  string    `json:"clientID"`
+	Subject   string    `json:"subject"`
+	NotAfter  time.Time `json:"notAfter"`
+	DaysLeft  int       `json:"daysLeft"`  // 剩余天数，已过期时为负数
+	Threshold int       `json:"threshold"` // 触发告警的阈值，单位天
+}
+
+// EventCertExpiry 证书过期事件的名称
+const EventCertExpiry = "cert-expiry"
+
+// readCert 读取证书文件中的第一个证书
+func readCert(certFile string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found in " + certFile)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// CertMonitor 定期检查客户端证书的有效期
+// 剩余天数首次低于 x509ExpiryWarn 中的某个值时记录日志并上传事件，证书更换后重新计算
+type CertMonitor struct {
+	log        *logger.Logger
+	ob         *outbox.Outbox
+	mqttConfig *config.MQTTConfig
+	thresholds []int // 从大到小
+
+	notAfter time.Time
+	warned   int // 已告警的最小阈值，0 为尚未告警
+}
+
+// NewCertMonitor 创建 CertMonitor
+func NewCertMonitor(log *logger.Logger, ob *outbox.Outbox, mqttConfig *config.MQTTConfig) *CertMonitor {
+	thresholds := make([]int, 0, len(mqttConfig.X509ExpiryWarn))
+	for _, days := range mqttConfig.X509ExpiryWarn {
+		if days > 0 {
+			thresholds = append(thresholds, days)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(thresholds)))
+	return &CertMonitor{
+		log:        log,
+		ob:         ob,
+		mqttConfig: mqttConfig,
+		thresholds: thresholds,
+	}
+}
+
+// Run 每小时检查一次
+func (m *CertMonitor) Run() {
+	for {
+		m.Check()
+		time.Sleep(certCheckPeriod)
+	}
+}
+
+// Check 检查一次证书有效期
+func (m *CertMonitor) Check() {
+	cert, err := readCert(m.mqttConfig.X509Pem)
+	if err != nil {
+		m.log.WithFields(logger.Fields{
+			"mqtt": "X509",
+			"cert": m.mqttConfig.X509Pem,
+		}).Error("Read client certificate: ", err)
+		return
+	}
+	if !cert.NotAfter.Equal(m.notAfter) {
+		// 证书已更换
+		m.notAfter = cert.NotAfter
+		m.warned = 0
+	}
+
+	daysLeft := int(time.Until(cert.NotAfter).Hours() / 24)
+	if time.Now().After(cert.NotAfter) {
+		daysLeft = -int(time.Since(cert.NotAfter).Hours()/24) - 1
+	}
+	threshold := 0
+	for _, days := range m.thresholds {
+		if daysLeft < days {
+			threshold = days
+		}
+	}
+	if threshold == 0 || (m.warned != 0 && threshold >= m.warned) {
+		return
+	}
+	m.warned = threshold
+
+	event := CertExpiry{
+		Time:      time.Now(),
+		Event:     EventCertExpiry,
+		ClientID:  m.mqttConfig.ClientID,
+		Subject:   cert.Subject.String(),
+		NotAfter:  cert.NotAfter,
+		DaysLeft:  daysLeft,
+		Threshold: threshold,
+	}
+	m.log.WithFields(logger.Fields{
+		"mqtt":     "X509",
+		"cert":     m.mqttConfig.X509Pem,
+		"notAfter": cert.NotAfter,
+		"daysLeft": daysLeft,
+	}).Warn("Client certificate expires soon")
+
+	if _, ok := m.ob.Registry().Lookup(model.KindEvent); !ok {
+		return
+	}
+	mqttData, err := json.Marshal(event)
+	if err != nil {
+		m.log.WithFields(logger.Fields{
+			"mqtt": "X509",
+		}).Error("MQTT Json Marshal Err:", err)
+		return
+	}
+	if err := m.ob.Put(model.KindEvent, string(mqttData)); err != nil {
+		m.log.WithFields(logger.Fields{
+			"mqtt": "X509",
+		}).Error("Outbox Put Err:", err)
+	}
+}
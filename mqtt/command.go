@@ -0,0 +1,202 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/command"
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
+)
+
+// commandQueueSize 等待执行的命令数上限，超出的命令直接丢弃
+const commandQueueSize = 16
+
+// commandSeenSize 记住的已执行命令 ID 个数，重复的 ID 直接返回上次的执行结果
+const commandSeenSize = 256
+
+// received 收到的命令消息
+type received struct {
+	client mqtt.Client
+	msg    mqtt.Message
+}
+
+// Commander 订阅云端下发的命令，交给 command.Handlers 执行，并发布执行结果
+// 命令按收到的顺序逐条执行，不阻塞 MQTT 客户端的收包流程
+type Commander struct {
+	log      *logger.Logger
+	handlers *command.Handlers
+	config   *config.MQTTCommandConfig
+	clientID string
+	timeout  time.Duration
+	queue    chan received
+
+	// 已执行命令的结果，只在 Run 协程中访问
+	// 持久会话重连后服务器会重发未确认的 QoS 1 消息，同一个 ID 不会再次执行
+	seen      map[string]command.Response
+	seenOrder []string
+}
+
+// NewCommander 创建 Commander
+func NewCommander(log *logger.Logger, handlers *command.Handlers, mqttConfig *config.MQTTConfig) *Commander {
+	return &Commander{
+		log:      log,
+		handlers: handlers,
+		config:   &mqttConfig.Command,
+		clientID: mqttConfig.ClientID,
+		timeout:  time.Duration(mqttConfig.AckTimeout) * time.Second,
+		queue:    make(chan received, commandQueueSize),
+		seen:     make(map[string]command.Response),
+	}
+}
+
+// Topic 命令主题 <prefix>/<clientID>/cmd/#
+func (c *Commander) Topic() string {
+	return fmt.Sprintf("%s/%s/cmd/#", c.config.Prefix, c.clientID)
+}
+
+// ResponseTopic 命令执行结果主题 <prefix>/<clientID>/resp/<命令>
+func (c *Commander) ResponseTopic(name string) string {
+	return fmt.Sprintf("%s/%s/resp/%s", c.config.Prefix, c.clientID, name)
+}
+
+// validResponseTopic 请求指定的回复主题是否在 <prefix>/<clientID>/resp/ 下，不能含有通配符
+func (c *Commander) validResponseTopic(topic string) bool {
+	prefix := c.ResponseTopic("")
+	return strings.HasPrefix(topic, prefix) && len(topic) > len(prefix) && !strings.ContainsAny(topic, "+#")
+}
+
+// Subscribe 订阅命令主题，每次连接成功后调用
+func (c *Commander) Subscribe(client mqtt.Client) {
+	token := client.Subscribe(c.Topic(), c.config.Qos, c.OnMessage)
+	if !token.WaitTimeout(c.timeout) || token.Error() != nil {
+		c.log.WithFields(logger.Fields{
+			"mqtt":  "command",
+			"topic": c.Topic(),
+		}).Error("Subscribe command topic: ", token.Error())
+		return
+	}
+	c.log.WithFields(logger.Fields{
+		"mqtt":  "command",
+		"topic": c.Topic(),
+	}).Info("Subscribe command topic")
+}
+
+// OnMessage 收到命令，放入队列等待执行
+// 保留消息在每次订阅时都会收到，不执行
+func (c *Commander) OnMessage(client mqtt.Client, msg mqtt.Message, args ...interface{}) {
+	if msg.Retained() {
+		c.log.WithFields(logger.Fields{
+			"mqtt":  "command",
+			"topic": msg.Topic(),
+		}).Warn("Ignore retained command")
+		return
+	}
+	select {
+	case c.queue <- received{client: client, msg: msg}:
+	default:
+		c.log.WithFields(logger.Fields{
+			"mqtt":  "command",
+			"topic": msg.Topic(),
+		}).Warn("Command queue full, drop command")
+	}
+}
+
+// Run 逐条执行命令
+func (c *Commander) Run() {
+	for r := range c.queue {
+		c.handle(r.client, r.msg)
+	}
+}
+
+// remember 记住命令的执行结果，超过 commandSeenSize 时忘记最早的
+func (c *Commander) remember(id string, response command.Response) {
+	if id == "" {
+		return
+	}
+	if len(c.seenOrder) >= commandSeenSize {
+		delete(c.seen, c.seenOrder[0])
+		c.seenOrder = c.seenOrder[1:]
+	}
+	c.seen[id] = response
+	c.seenOrder = append(c.seenOrder, id)
+}
+
+// handle 执行一条命令并发布执行结果
+func (c *Commander) handle(client mqtt.Client, msg mqtt.Message) {
+	prefix := strings.TrimSuffix(c.Topic(), "#")
+	name := strings.TrimPrefix(msg.Topic(), prefix)
+	if name == msg.Topic() {
+		name = ""
+	}
+
+	var response command.Response
+	cmd, err := command.Decode(name, msg.Payload())
+	if err != nil {
+		response = command.Response{
+			Command: name,
+			Status:  command.StatusError,
+			Error:   err.Error(),
+			Time:    time.Now(),
+		}
+		c.log.WithFields(logger.Fields{
+			"mqtt":  "command",
+			"topic": msg.Topic(),
+		}).Error("Decode command: ", err)
+	} else if cached, ok := c.seen[cmd.ID]; ok && cmd.ID != "" {
+		c.log.WithFields(logger.Fields{
+			"mqtt":    "command",
+			"command": cmd.Command,
+			"id":      cmd.ID,
+		}).Warn("Duplicate command, resend the last response")
+		response = cached
+	} else {
+		response = c.handlers.Handle(cmd)
+		c.remember(cmd.ID, response)
+	}
+	if response.Command == "" {
+		// 无法确定命令名称时无处回复
+		return
+	}
+
+	// MQTT 5 的请求可以指定回复主题和关联数据，回复主题只能在 <prefix>/<clientID>/resp/ 下
+	topic := c.ResponseTopic(response.Command)
+	var props *packets.Properties
+	if reqProps := msg.Properties(); reqProps != nil {
+		if reqProps.ResponseTopic != "" {
+			if c.validResponseTopic(reqProps.ResponseTopic) {
+				topic = reqProps.ResponseTopic
+			} else {
+				c.log.WithFields(logger.Fields{
+					"mqtt":          "command",
+					"command":       response.Command,
+					"responseTopic": reqProps.ResponseTopic,
+				}).Warn("Response topic not allowed, use ", topic)
+			}
+		}
+		if reqProps.CorrelationData != nil {
+			props = &packets.Properties{CorrelationData: reqProps.CorrelationData}
+		}
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		c.log.WithFields(logger.Fields{
+			"mqtt":    "command",
+			"command": response.Command,
+		}).Error("Marshal command response: ", err)
+		return
+	}
+	token := client.PublishWithProperties(topic, c.config.Qos, false, payload, props)
+	if !token.WaitTimeout(c.timeout) || token.Error() != nil {
+		c.log.WithFields(logger.Fields{
+			"mqtt":    "command",
+			"command": response.Command,
+			"id":      response.ID,
+		}).Error("Publish command response: ", token.Error())
+	}
+}
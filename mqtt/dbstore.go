@@ -0,0 +1,246 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DBStore 将 MQTT 客户端未完成的报文保存在 Sqlite 数据库的 mqtt_packets 表中
+// 写入由数据库事务保证断电安全，无法解码的报文标记为 corrupt，不再返回给客户端
+// 超出条数或字节数上限时丢弃最早的报文，发送队列中的消息未确认前不会删除，会重新发送
+type DBStore struct {
+	log        *logger.Logger
+	db         *gorm.DB
+	maxPackets int   // 0 不限制
+	maxBytes   int64 // 0 不限制
+
+	mu      sync.Mutex
+	opened  bool
+	version byte
+}
+
+// NewDBStore 创建数据库存储，maxPackets、maxBytes 为报文条数和字节数上限
+func NewDBStore(log *logger.Logger, db *gorm.DB, maxPackets int, maxBytes int64) *DBStore {
+	return &DBStore{
+		log:        log,
+		db:         db,
+		maxPackets: maxPackets,
+		maxBytes:   maxBytes,
+	}
+}
+
+// Open 打开
+func (s *DBStore) Open() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opened = true
+}
+
+// Close 关闭
+func (s *DBStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opened = false
+}
+
+// SetProtocolVersion 设置协议版本，读取 MQTT 5 的报文需要
+func (s *DBStore) SetProtocolVersion(version byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+}
+
+// Put 保存报文，key 相同时覆盖
+func (s *DBStore) Put(key string, message packets.ControlPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opened {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+			"key":  key,
+		}).Error("Trying to use db store, but not open")
+		return
+	}
+	var buf bytes.Buffer
+	if err := message.Write(&buf); err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+			"key":  key,
+		}).Error("Encode packet: ", err)
+		return
+	}
+	s.evict(key, int64(buf.Len()))
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "size", "corrupt", "updated_at"}),
+	}).Create(&model.MQTTPacket{
+		Key:  key,
+		Data: buf.Bytes(),
+		Size: buf.Len(),
+	}).Error
+	if err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+			"key":  key,
+		}).Error("Put packet: ", err)
+	}
+}
+
+// Get 读取报文，不存在或无法解码时返回 nil，无法解码的报文标记为 corrupt
+func (s *DBStore) Get(key string) packets.ControlPacket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opened {
+		return nil
+	}
+	var packet model.MQTTPacket
+	result := s.db.Where("key = ? AND corrupt = ?", key, false).Limit(1).Find(&packet)
+	if result.Error != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+			"key":  key,
+		}).Error("Get packet: ", result.Error)
+		return nil
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	message, err := s.decode(packet.Data)
+	if err != nil {
+		s.quarantine(key, err)
+		return nil
+	}
+	return message
+}
+
+// All 所有可用报文的 key，按写入时间排列
+func (s *DBStore) All() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opened {
+		return nil
+	}
+	var keys []string
+	err := s.db.Model(&model.MQTTPacket{}).Where("corrupt = ?", false).
+		Order("updated_at, key").Pluck("key", &keys).Error
+	if err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+		}).Error("List packets: ", err)
+	}
+	return keys
+}
+
+// Del 删除报文
+func (s *DBStore) Del(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.Where("key = ?", key).Delete(&model.MQTTPacket{}).Error; err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+			"key":  key,
+		}).Error("Delete packet: ", err)
+	}
+}
+
+// Reset 删除所有可用报文，标记为 corrupt 的报文保留用于排查
+func (s *DBStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log.WithFields(logger.Fields{
+		"mqtt": "store",
+	}).Warn("Reset db store")
+	if err := s.db.Where("corrupt = ?", false).Delete(&model.MQTTPacket{}).Error; err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+		}).Error("Reset packets: ", err)
+	}
+}
+
+// decode 解码报文，报文之后不能有多余的数据
+func (s *DBStore) decode(data []byte) (packets.ControlPacket, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty packet")
+	}
+	reader := bytes.NewReader(data)
+	message, err := packets.ReadPacketWithVersion(reader, s.version)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() != 0 {
+		return nil, errors.New("trailing data after packet")
+	}
+	return message, nil
+}
+
+// quarantine 将无法解码的报文标记为 corrupt
+func (s *DBStore) quarantine(key string, reason error) {
+	s.log.WithFields(logger.Fields{
+		"mqtt": "store",
+		"key":  key,
+	}).Warn("Corrupted packet quarantined: ", reason)
+	err := s.db.Model(&model.MQTTPacket{}).Where("key = ?", key).Update("corrupt", true).Error
+	if err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+			"key":  key,
+		}).Error("Quarantine packet: ", err)
+	}
+}
+
+// evict 丢弃最早的报文，直到写入 size 字节的 key 后不超过上限
+func (s *DBStore) evict(key string, size int64) {
+	if s.maxPackets <= 0 && s.maxBytes <= 0 {
+		return
+	}
+	var rows []struct {
+		Key  string
+		Size int64
+	}
+	err := s.db.Model(&model.MQTTPacket{}).Select("key, size").
+		Where("corrupt = ? AND key <> ?", false, key).
+		Order("updated_at, key").Scan(&rows).Error
+	if err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+		}).Error("List packets: ", err)
+		return
+	}
+	count := len(rows)
+	var total int64
+	for _, row := range rows {
+		total += row.Size
+	}
+	var evicted []string
+	for _, row := range rows {
+		overPackets := s.maxPackets > 0 && count+1 > s.maxPackets
+		overBytes := s.maxBytes > 0 && total+size > s.maxBytes
+		if !overPackets && !overBytes {
+			break
+		}
+		evicted = append(evicted, row.Key)
+		count--
+		total -= row.Size
+	}
+	if len(evicted) == 0 {
+		return
+	}
+	if err := s.db.Where("key IN ?", evicted).Delete(&model.MQTTPacket{}).Error; err != nil {
+		s.log.WithFields(logger.Fields{
+			"mqtt": "store",
+		}).Error("Evict packets: ", err)
+		return
+	}
+	s.log.WithFields(logger.Fields{
+		"mqtt":  "store",
+		"count": len(evicted),
+		"keys":  evicted,
+	}).Warn("Store full, oldest packets discarded")
+}
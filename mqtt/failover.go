@@ -0,0 +1,232 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt"
+	"github.com/zsy-cn/4g-gateway/pkg/net/proxy"
+)
+
+// Failover 多个服务器之间的切换
+// 每次只连接当前服务器，连续失败 failoverAfter 次后切换到下一个
+// 连接备用服务器时每隔 primaryRetry 探测主服务器，可以连通时断开并重新连接主服务器
+type Failover struct {
+	log           *logger.Logger
+	brokers       []config.MQTTBroker
+	urls          []*url.URL // 与 brokers 一一对应，加入客户端配置的地址
+	serverName    string     // x509ServerName
+	failoverAfter int
+	primaryRetry  time.Duration
+	dialer        proxy.Dialer // 探测主服务器使用，与客户端相同
+
+	mu         sync.Mutex
+	active     int  // 当前服务器的序号
+	failures   int  // 当前服务器连续失败的次数
+	attempting bool // 已开始连接，尚未连接成功
+	connected  bool
+}
+
+// NewFailover 创建 Failover，从主服务器开始连接
+func NewFailover(log *logger.Logger, mqttConfig *config.MQTTConfig) *Failover {
+	failoverAfter := mqttConfig.FailoverAfter
+	if failoverAfter < 1 {
+		failoverAfter = 1
+	}
+	return &Failover{
+		log:           log,
+		brokers:       mqttConfig.Brokers,
+		serverName:    mqttConfig.X509ServerName,
+		failoverAfter: failoverAfter,
+		primaryRetry:  time.Duration(mqttConfig.PrimaryRetry) * time.Second,
+	}
+}
+
+// AddBrokers 将所有服务器加入客户端配置，用户名和密码写入 URL
+func (f *Failover) AddBrokers(options *mqtt.ClientOptions) error {
+	for _, broker := range f.brokers {
+		uri, err := url.Parse(broker.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url of broker %s: %w", broker.Name, err)
+		}
+		if len(broker.Username) > 0 {
+			uri.User = url.UserPassword(broker.Username, broker.Password)
+		}
+		options.Servers = append(options.Servers, uri)
+		f.urls = append(f.urls, uri)
+	}
+	options.SetBrokerSelector(f.Select)
+	options.SetConnectionAttemptHandler(f.TLSConfig)
+	return nil
+}
+
+// NeedTLS 是否有服务器使用 TLS
+func (f *Failover) NeedTLS() bool {
+	for _, broker := range f.brokers {
+		uri, err := url.Parse(broker.URL)
+		if err == nil && (uri.Scheme == "tls" || uri.Scheme == "wss") {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPorts 地址中没有端口时使用的默认端口
+var defaultPorts = map[string]string{"tcp": "1883", "tls": "8883", "ws": "80", "wss": "443"}
+
+// brokerAddr 服务器的 host:port
+func brokerAddr(uri *url.URL) string {
+	if len(uri.Port()) > 0 {
+		return uri.Host
+	}
+	return net.JoinHostPort(uri.Hostname(), defaultPorts[uri.Scheme])
+}
+
+// Select 每次连接前调用，返回本次要连接的服务器
+// 上一次连接尚未成功就再次调用，说明上一次连接失败
+func (f *Failover) Select(brokers []*url.URL) []*url.URL {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(brokers) != len(f.brokers) || len(brokers) == 0 {
+		return brokers
+	}
+
+	if f.attempting {
+		f.failures++
+		f.log.WithFields(logger.Fields{
+			"mqtt":     "failover",
+			"broker":   f.brokers[f.active].Name,
+			"failures": f.failures,
+		}).Warn("Connect to broker failed")
+		if f.failures >= f.failoverAfter && len(f.brokers) > 1 {
+			next := (f.active + 1) % len(f.brokers)
+			f.log.WithFields(logger.Fields{
+				"mqtt": "failover",
+				"from": f.brokers[f.active].Name,
+				"to":   f.brokers[next].Name,
+			}).Warn("Failover to next broker")
+			f.active = next
+			f.failures = 0
+		}
+	}
+	f.attempting = true
+	f.connected = false
+	return brokers[f.active : f.active+1]
+}
+
+// TLSConfig 按服务器设置证书校验的域名
+func (f *Failover) TLSConfig(broker *url.URL, tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig == nil {
+		return nil
+	}
+	serverName := f.serverName
+	for i, uri := range f.urls {
+		if sameBroker(uri, broker) && len(f.brokers[i].ServerName) > 0 {
+			serverName = f.brokers[i].ServerName
+		}
+	}
+	if len(serverName) == 0 {
+		serverName = broker.Hostname()
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = serverName
+	return tlsConfig
+}
+
+// sameBroker 两个地址是否为同一个服务器，客户端传入的地址可能是复制或重新解析的，不能比较指针
+func sameBroker(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host && a.Path == b.Path
+}
+
+// OnConnect 连接成功
+func (f *Failover) OnConnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempting = false
+	f.connected = true
+	f.failures = 0
+	f.log.WithFields(logger.Fields{
+		"mqtt":   "failover",
+		"broker": f.brokers[f.active].String(),
+	}).Info("Connected to broker")
+}
+
+// Connected 已连接的服务器名称，未连接时为空
+func (f *Failover) Connected() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.connected {
+		return ""
+	}
+	return f.brokers[f.active].Name
+}
+
+// RunPrimaryRetry 连接备用服务器时定期探测主服务器，可以连通时重新连接主服务器
+func (f *Failover) RunPrimaryRetry(client mqtt.Client, timeout time.Duration) {
+	if f.primaryRetry <= 0 || len(f.brokers) < 2 {
+		return
+	}
+	primary, err := url.Parse(f.brokers[0].URL)
+	if err != nil {
+		return
+	}
+	for {
+		time.Sleep(f.primaryRetry)
+
+		f.mu.Lock()
+		onBackup := f.connected && f.active != 0
+		f.mu.Unlock()
+		if !onBackup {
+			continue
+		}
+
+		dialer := f.dialer
+		if dialer == nil {
+			dialer = &net.Dialer{}
+		}
+		conn, err := dialTimeout(dialer, brokerAddr(primary), timeout)
+		if err != nil {
+			f.log.WithFields(logger.Fields{
+				"mqtt":   "failover",
+				"broker": f.brokers[0].Name,
+			}).Info("Primary broker still unreachable: ", err)
+			continue
+		}
+		conn.Close()
+
+		f.log.WithFields(logger.Fields{
+			"mqtt": "failover",
+			"from": f.Connected(),
+			"to":   f.brokers[0].Name,
+		}).Info("Return to primary broker")
+		f.mu.Lock()
+		f.active = 0
+		f.failures = 0
+		f.attempting = false
+		f.connected = false
+		f.mu.Unlock()
+		// 正常断开服务器不发布遗嘱，重新连接后发布 online
+		// 客户端启用了 ConnectRetry，连接主服务器失败时由 Select 计数，连续失败后切换回备用服务器
+		// token 在连接成功或放弃重试时完成
+		client.Disconnect(250)
+		token := client.Connect()
+		token.Wait()
+		if err := token.Error(); err != nil {
+			f.log.WithFields(logger.Fields{
+				"mqtt":   "failover",
+				"broker": f.brokers[0].Name,
+			}).Error("Reconnect after returning to primary broker: ", err)
+			continue
+		}
+		f.log.WithFields(logger.Fields{
+			"mqtt":   "failover",
+			"broker": f.Connected(),
+		}).Info("Reconnected after returning to primary broker")
+	}
+}
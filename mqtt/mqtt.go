@@ -1,86 +1,103 @@
 package mqtt
 
 import (
-	"crypto/tls"
 	"fmt"
 	"time"
 
+	"github.com/zsy-cn/4g-gateway/command"
 	"github.com/zsy-cn/4g-gateway/config"
-	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/outbox"
 	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/mqtt"
-	"gorm.io/gorm"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
 )
 
-var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message, args ...interface{}) {
-	// ToDo 改 mqtt 包增加 log
-	// log := args[0].(*logger.Logger)
-	// log.WithFields(logger.Fields{
-	// 	"mqtt": "message",
-	// }).Info("Received message: ", msg.Payload(), "from topic: ", msg.Topic())
-	fmt.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+// messagePubHandler 没有匹配到路由的消息
+func messagePubHandler(log *logger.Logger) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message, args ...interface{}) {
+		log.WithFields(logger.Fields{
+			"mqtt":  "message",
+			"topic": msg.Topic(),
+		}).Info("Received message: ", string(msg.Payload()))
+	}
+}
+
+// connectHandler 连接成功
+func connectHandler(log *logger.Logger) mqtt.OnConnectHandler {
+	return func(client mqtt.Client, args ...interface{}) {
+		log.WithFields(logger.Fields{
+			"mqtt": "connect",
+		}).Info("Connected")
+	}
 }
 
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client, args ...interface{}) {
-	// ToDo 改 mqtt 包增加 log
-	// log := args[0].(*logger.Logger)
-	// log.WithFields(logger.Fields{
-	// 	"mqtt": "message",
-	// }).Info("Connected")
-	fmt.Println("Connected")
+// connectLostHandler 连接断开，客户端会自动重连
+func connectLostHandler(log *logger.Logger) mqtt.ConnectionLostHandler {
+	return func(client mqtt.Client, err error, args ...interface{}) {
+		log.WithFields(logger.Fields{
+			"mqtt": "connect",
+		}).Warn("Connect lost: ", err)
+	}
 }
 
-var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error, args ...interface{}) {
-	// ToDo 改 mqtt 包增加 log
-	// log := args[0].(*logger.Logger)
-	// log.WithFields(logger.Fields{
-	// 	"mqtt": "message",
-	// }).Info("Connect lost:", err)
-	fmt.Printf("Connect lost: %v", err)
+// logLevels [log] mqttLevel 对应的日志级别
+var logLevels = map[string]logger.Level{
+	"error": logger.ErrorLevel,
+	"warn":  logger.WarnLevel,
+	"info":  logger.InfoLevel,
+	"debug": logger.DebugLevel,
 }
 
-func publish(log *logger.Logger, client mqtt.Client, msg string, topic string) {
+// publish 发布消息并等待服务器确认，出错返回 error
+// 超时返回 *outbox.PendingError，报文由客户端重连后重发，不能重新发布
+// MQTT 5 时带上消息有效期，过期的消息由服务器丢弃，不再投递
+func publish(log *logger.Logger, client mqtt.Client, timeout time.Duration, route outbox.Route, msg string) error {
+	if !client.IsConnectionOpen() {
+		return outbox.ErrOffline
+	}
 	log.WithFields(logger.Fields{
 		"mqtt": "publish",
 	}).Info("MQTT pub message: ", msg)
-	token := client.Publish(topic, 2, false, msg)
-	token.Wait()
-}
-
-func NewTLSConfig(log *logger.Logger, mqttConfig *config.MQTTConfig) *tls.Config {
-	cert, err := tls.LoadX509KeyPair(mqttConfig.X509Pem, mqttConfig.X509Key)
-	if err != nil {
-		log.WithFields(logger.Fields{
-			"mqtt": "X509",
-		}).Error("MQTT X509 : ", err)
+	var props *packets.Properties
+	if route.Expiry > 0 {
+		props = &packets.Properties{MessageExpiry: packets.Uint32(uint32(route.Expiry / time.Second))}
 	}
-	return &tls.Config{
-		ClientAuth:         tls.NoClientCert,
-		ClientCAs:          nil,
-		InsecureSkipVerify: true,
-		Certificates:       []tls.Certificate{cert},
+	token := client.PublishWithProperties(route.Topic, route.Qos, route.Retain, msg, props)
+	if !token.WaitTimeout(timeout) {
+		return &outbox.PendingError{Topic: route.Topic, Timeout: timeout, Pending: token}
 	}
+	return token.Error()
 }
 
-// IniMQTT 初始化 MQTT
-func InitMQTT(log *logger.Logger, mqttConfig *config.MQTTConfig) (client mqtt.Client, err error) {
+// IniMQTT 初始化 MQTT，version 为固件版本，写入在线状态消息
+// 连接成功后发布 online，commander 不为 nil 时订阅命令主题，failover 选择每次连接的服务器，store 保存未完成的报文
+func InitMQTT(log *logger.Logger, mqttConfig *config.MQTTConfig, version string, commander *Commander, failover *Failover, store mqtt.Store) (client mqtt.Client, err error) {
 	log.WithFields(logger.Fields{
 		"mqtt": "init",
 	}).Info("Init MQTT")
 
-	log.WithFields(logger.Fields{
-		"mqtt": "init",
-	}).Info("mqttConfig:", mqttConfig)
-
 	mqttClientOptions := mqtt.NewClientOptions()
-	if mqttConfig.X509 {
-		mqttClientOptions.AddBroker(fmt.Sprintf("tls://%s:%d", mqttConfig.Server, mqttConfig.Port))
-		tlsconfig := NewTLSConfig(log, mqttConfig)
-		mqttClientOptions.SetTLSConfig(tlsconfig)
+	if err := failover.AddBrokers(mqttClientOptions); err != nil {
+		return nil, err
 	}
-
-	if !mqttConfig.X509 {
-		mqttClientOptions.AddBroker(fmt.Sprintf("tcp://%s:%d", mqttConfig.Server, mqttConfig.Port))
+	dialer, err := NewDialer(&mqttConfig.Proxy, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt proxy: %w", err)
+	}
+	mqttClientOptions.SetDialer(dialer)
+	failover.dialer = dialer
+	headers, websocket, err := websocketOptions(&mqttConfig.Websocket)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt websocket options: %w", err)
+	}
+	mqttClientOptions.SetHTTPHeaders(headers)
+	mqttClientOptions.SetWebsocketOptions(websocket)
+	if mqttConfig.X509 || failover.NeedTLS() {
+		tlsconfig, err := NewTLSConfig(log, mqttConfig)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt tls config: %w", err)
+		}
+		mqttClientOptions.SetTLSConfig(tlsconfig)
 	}
 
 	mqttClientOptions.SetClientID(mqttConfig.ClientID)
@@ -88,20 +105,47 @@ func InitMQTT(log *logger.Logger, mqttConfig *config.MQTTConfig) (client mqtt.Cl
 	mqttClientOptions.SetPassword(mqttConfig.Password)
 	mqttClientOptions.SetCleanSession(false)
 	mqttClientOptions.SetOrderMatters(true)
-	mqttClientOptions.SetProtocolVersion(4)
+	mqttClientOptions.SetProtocolVersion(uint(mqttConfig.ProtocolVersion))
+	if mqttConfig.ProtocolVersion == packets.ProtocolVersion5 {
+		// 不清除会话，需要设置会话过期时间，否则断开后服务器丢弃会话
+		mqttClientOptions.SetSessionExpiryInterval(uint32(mqttConfig.SessionExpiry))
+	}
 	mqttClientOptions.SetAutoReconnect(true)
 	mqttClientOptions.SetConnectRetry(true)
-	mqttClientOptions.SetStore(mqtt.NewFileStore(mqttConfig.FileStore))
+	mqttClientOptions.SetStore(store)
 	// mqttClientOptions.SetStore(NewStore())
 	mqttClientOptions.SetKeepAlive(time.Duration(mqttConfig.KeepAlive) * time.Second)
-	mqttClientOptions.SetDefaultPublishHandler(messagePubHandler)
-	mqttClientOptions.SetOnConnectHandler(connectHandler)
-	mqttClientOptions.SetConnectionLostHandler(connectLostHandler)
+	mqttClientOptions.SetDefaultPublishHandler(messagePubHandler(log))
+	if level, ok := logLevels[mqttConfig.LogLevel]; ok {
+		// MQTT 客户端内部日志写入同一个日志，debug 包括收发的每个报文和 fileStore 的读写
+		mqttClientOptions.SetLogger(log, level)
+	}
+	ackTimeout := time.Duration(mqttConfig.AckTimeout) * time.Second
+	mqttClientOptions.SetOnConnectHandler(func(client mqtt.Client, args ...interface{}) {
+		connectHandler(log)(client, args...)
+		failover.OnConnect()
+		if mqttConfig.Presence.Enabled {
+			publishPresence(log, client, mqttConfig, version, PresenceOnline, ackTimeout)
+		}
+		if commander != nil {
+			commander.Subscribe(client)
+		}
+	})
+	if mqttConfig.Presence.Enabled {
+		// 异常断开时由服务器发布保留的 offline
+		mqttClientOptions.SetBinaryWill(mqttConfig.Presence.Topic,
+			presencePayload(PresenceOffline, mqttConfig.ClientID, version), mqttConfig.Presence.Qos, true)
+	}
+	mqttClientOptions.SetConnectionLostHandler(connectLostHandler(log))
 	log.WithFields(logger.Fields{
 		"mqtt": "init",
 	}).Info("配置完成")
 
 	NewMQTTClient := mqtt.NewClient(mqttClientOptions)
+	if commander != nil {
+		// 保留会话时服务器可能在订阅之前就开始投递命令
+		NewMQTTClient.AddRoute(commander.Topic(), commander.OnMessage)
+	}
 	if token := NewMQTTClient.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
@@ -111,10 +155,20 @@ func InitMQTT(log *logger.Logger, mqttConfig *config.MQTTConfig) (client mqtt.Cl
 // Run MQTT Publish
 func Run(
 	log *logger.Logger,
-	db *gorm.DB,
+	ob *outbox.Outbox,
 	mqttConfig *config.MQTTConfig,
+	version string,
+	handlers *command.Handlers,
 ) {
-	client, err := InitMQTT(log, mqttConfig)
+	var commander *Commander
+	if mqttConfig.Command.Enabled {
+		commander = NewCommander(log, handlers, mqttConfig)
+		go commander.Run()
+	}
+
+	failover := NewFailover(log, mqttConfig)
+	store := NewPacketStore(log, ob.DB(), mqttConfig)
+	client, err := InitMQTT(log, mqttConfig, version, commander, failover, store)
 	if err != nil {
 		log.WithFields(logger.Fields{
 			"system": "init",
@@ -122,6 +176,19 @@ func Run(
 	}
 	defer client.Disconnect(250)
 
+	go failover.RunPrimaryRetry(client, time.Duration(mqttConfig.AckTimeout)*time.Second)
+	if mqttConfig.X509 && len(mqttConfig.X509Pem) > 0 {
+		go NewCertMonitor(log, ob, mqttConfig).Run()
+	}
+
+	running.Lock()
+	running.log = log
+	running.client = client
+	running.mqttConfig = mqttConfig
+	running.version = version
+	running.failover = failover
+	running.Unlock()
+
 	log.WithFields(logger.Fields{
 		"mqtt": "run",
 	}).Info("MQTT RUN")
@@ -138,22 +205,11 @@ func Run(
 		}).Error("MQTT config is null")
 	}
 
-	var mqttMsg model.MQTTMsg
-
-	for {
-		// 不断读取数据库，然后发送
-		// 如果数据库没有数据，等待一个周期
-		db.First(&mqttMsg)
-		if mqttMsg.Topic == "Status" {
-			db.Delete(&mqttMsg, 1)
-			go publish(log, client, mqttMsg.Msg, mqttConfig.TopicBootUp)
-		}
-		if mqttMsg.Topic == "GPS" {
-			db.Delete(&mqttMsg, 1)
-			go publish(log, client, mqttMsg.Msg, mqttConfig.TopicGPS)
-		}
-		if mqttMsg.Topic == "" {
-			time.Sleep(150 * time.Second)
-		}
-	}
+	ackTimeout := time.Duration(mqttConfig.AckTimeout) * time.Second
+	dispatcher := outbox.NewDispatcher(log, ob, mqttConfig, outbox.PublisherFunc(
+		func(route outbox.Route, payload string) error {
+			return publish(log, client, ackTimeout, route, payload)
+		},
+	))
+	dispatcher.Run()
 }
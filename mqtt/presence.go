@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt"
+)
+
+// 在线状态
+// PresenceOnline 连接成功后发布
+// PresenceOffline 作为遗嘱由服务器在异常断开时发布，正常退出时由网关发布
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// Presence 在线状态消息，以保留消息发布，后端订阅即可得到网关的最新状态
+type Presence struct {
+	Status   string    `json:"status"`
+	ClientID string    `json:"clientID"`
+	Version  string    `json:"version"` // 固件版本 app_version
+	Time     time.Time `json:"time"`
+}
+
+// presencePayload 在线状态消息体
+func presencePayload(status string, clientID string, version string) []byte {
+	payload, _ := json.Marshal(Presence{
+		Status:   status,
+		ClientID: clientID,
+		Version:  version,
+		Time:     time.Now(),
+	})
+	return payload
+}
+
+// publishPresence 发布保留的在线状态消息并等待服务器确认
+func publishPresence(log *logger.Logger, client mqtt.Client, mqttConfig *config.MQTTConfig, version string, status string, timeout time.Duration) {
+	payload := presencePayload(status, mqttConfig.ClientID, version)
+	token := client.Publish(mqttConfig.Presence.Topic, mqttConfig.Presence.Qos, true, payload)
+	if !token.WaitTimeout(timeout) || token.Error() != nil {
+		log.WithFields(logger.Fields{
+			"mqtt":   "presence",
+			"status": status,
+		}).Error("Publish presence: ", token.Error())
+		return
+	}
+	log.WithFields(logger.Fields{
+		"mqtt":   "presence",
+		"status": status,
+	}).Info("Publish presence")
+}
+
+// running 运行中的 MQTT 客户端，退出时发布 offline
+var running struct {
+	sync.Mutex
+	log        *logger.Logger
+	client     mqtt.Client
+	mqttConfig *config.MQTTConfig
+	version    string
+	failover   *Failover
+}
+
+// Broker 已连接的服务器名称，未连接时为空
+func Broker() string {
+	running.Lock()
+	defer running.Unlock()
+	if running.failover == nil {
+		return ""
+	}
+	return running.failover.Connected()
+}
+
+// Connected MQTT 客户端是否已连接服务器，供联网检测使用
+func Connected() bool {
+	running.Lock()
+	defer running.Unlock()
+	return running.client != nil && running.client.IsConnectionOpen()
+}
+
+// Shutdown 正常退出，发布 offline 后断开连接
+// 正常断开时服务器不会发布遗嘱，需要网关自己发布
+func Shutdown(timeout time.Duration) {
+	running.Lock()
+	defer running.Unlock()
+	if running.client == nil {
+		return
+	}
+	if running.mqttConfig.Presence.Enabled && running.client.IsConnectionOpen() {
+		publishPresence(running.log, running.client, running.mqttConfig, running.version, PresenceOffline, timeout)
+	}
+	running.client.Disconnect(250)
+	running.client = nil
+}
@@ -0,0 +1,128 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/net/proxy"
+)
+
+func init() {
+	// pkg/net/proxy 只支持 SOCKS5，注册 HTTP CONNECT 代理
+	proxy.RegisterDialerType("http", newHTTPProxy)
+}
+
+// NewDialer 根据配置创建连接服务器使用的 Dialer
+// url 为空时使用环境变量 ALL_PROXY、NO_PROXY，none 直接连接；bypass 中的主机不经过代理
+func NewDialer(proxyConfig *config.MQTTProxyConfig, timeout time.Duration) (proxy.Dialer, error) {
+	forward := &net.Dialer{Timeout: timeout}
+
+	var dialer proxy.Dialer
+	switch proxyConfig.URL {
+	case "":
+		dialer = proxy.FromEnvironmentUsing(forward)
+	case "none":
+		return forward, nil
+	default:
+		proxyURL, err := url.Parse(proxyConfig.URL)
+		if err != nil {
+			return nil, err
+		}
+		dialer, err = proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(proxyConfig.Bypass) > 0 {
+		perHost := proxy.NewPerHost(dialer, forward)
+		for _, host := range proxyConfig.Bypass {
+			perHost.AddFromString(host)
+		}
+		dialer = perHost
+	}
+	return dialer, nil
+}
+
+// dialTimeout 使用 dialer 连接，支持 ContextDialer 时超时也作用于代理握手
+func dialTimeout(dialer proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return contextDialer.DialContext(ctx, "tcp", addr)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// httpProxy 通过 HTTP CONNECT 建立隧道
+type httpProxy struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+}
+
+func newHTTPProxy(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &httpProxy{proxyURL: proxyURL, forward: forward}, nil
+}
+
+// Dial 连接代理并发送 CONNECT，代理返回 200 后连接即为到 addr 的隧道
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext 同 Dial，ctx 的超时同时作用于连接代理和 CONNECT 握手
+func (p *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := p.proxyURL.Host
+	if len(p.proxyURL.Port()) == 0 {
+		proxyAddr = net.JoinHostPort(p.proxyURL.Hostname(), "80")
+	}
+	var conn net.Conn
+	var err error
+	if contextDialer, ok := p.forward.(proxy.ContextDialer); ok {
+		conn, err = contextDialer.DialContext(ctx, network, proxyAddr)
+	} else {
+		conn, err = p.forward.Dial(network, proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := p.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// 代理返回 200 之后由客户端先发送数据，不会有多读的内容
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", p.proxyURL.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
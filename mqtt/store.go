@@ -3,11 +3,24 @@ package mqtt
 import (
 	"strings"
 
+	"github.com/zsy-cn/4g-gateway/config"
 	log "github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/mqtt"
 	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
+	"gorm.io/gorm"
 )
 
+// NewPacketStore MQTT 客户端保存未完成报文的存储
+// store 为 sqlite 时使用 db 中的 mqtt_packets 表，否则使用 fileStore 目录
+func NewPacketStore(logger *log.Logger, db *gorm.DB, mqttConfig *config.MQTTConfig) mqtt.Store {
+	if mqttConfig.Store == "sqlite" {
+		return NewDBStore(logger, db, mqttConfig.StoreMaxPackets, mqttConfig.StoreMaxBytes)
+	}
+	store := mqtt.NewFileStore(mqttConfig.FileStore)
+	store.SetLimits(mqttConfig.StoreMaxPackets, mqttConfig.StoreMaxBytes)
+	return store
+}
+
 // Store MQTT 存储
 type Store struct {
 	store mqtt.Store
@@ -125,3 +138,10 @@ func (s *Store) Close() {
 func (s *Store) Reset() {
 	s.store.Reset()
 }
+
+// SetProtocolVersion 设置协议版本，读取 MQTT 5 的报文需要
+func (s *Store) SetProtocolVersion(version byte) {
+	if store, ok := s.store.(mqtt.VersionedStore); ok {
+		store.SetProtocolVersion(version)
+	}
+}
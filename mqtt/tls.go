@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// tlsVersions tlsMinVersion 的可选值
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig 根据配置创建 TLS 配置，始终校验服务器证书
+// 证书、私钥或 CA 无法加载，以及配置不合法时返回 error
+func NewTLSConfig(log *logger.Logger, mqttConfig *config.MQTTConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: mqttConfig.X509ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(tlsConfig.ServerName) == 0 {
+		// 经代理连接时 tls.Client 不会从地址中取得域名
+		tlsConfig.ServerName = mqttConfig.Server
+	}
+
+	if len(mqttConfig.X509Pem) > 0 || len(mqttConfig.X509Key) > 0 {
+		// 证书更换后在下一次重连时生效，不需要重启网关
+		reloader, err := newCertReloader(log, mqttConfig.X509Pem, mqttConfig.X509Key)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate %s / %s: %w", mqttConfig.X509Pem, mqttConfig.X509Key, err)
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	if len(mqttConfig.X509CA) > 0 {
+		pem, err := ioutil.ReadFile(mqttConfig.X509CA)
+		if err != nil {
+			return nil, fmt.Errorf("load ca bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca bundle %s", mqttConfig.X509CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(mqttConfig.TLSMinVersion) > 0 {
+		version, ok := tlsVersions[mqttConfig.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %q", mqttConfig.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(mqttConfig.TLSCiphers) > 0 {
+		ciphers, err := parseCiphers(mqttConfig.TLSCiphers)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = ciphers
+	}
+
+	if len(mqttConfig.X509Pins) > 0 {
+		pins, err := parsePins(mqttConfig.X509Pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPins(pins)
+	}
+
+	log.WithFields(logger.Fields{
+		"mqtt":       "X509",
+		"ca":         mqttConfig.X509CA,
+		"serverName": mqttConfig.X509ServerName,
+		"pins":       len(mqttConfig.X509Pins),
+		"minVersion": mqttConfig.TLSMinVersion,
+	}).Info("MQTT TLS config")
+	return tlsConfig, nil
+}
+
+// parseCiphers 将加密套件名称转换为 ID，只允许 Go 认为安全的套件
+func parseCiphers(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure tls cipher %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parsePins 解析公钥指纹，格式为 base64 编码的 SHA-256，可以带 sha256/ 前缀
+func parsePins(values []string) ([][]byte, error) {
+	pins := make([][]byte, 0, len(values))
+	for _, value := range values {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "sha256/"))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin %q", value)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifyPins 在证书链校验通过之后，要求链中至少一个证书的公钥与指纹匹配
+func verifyPins(pins [][]byte) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if string(sum[:]) == string(pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("server certificate does not match any spki pin")
+	}
+}
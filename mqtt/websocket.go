@@ -0,0 +1,33 @@
+package mqtt
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt"
+)
+
+// websocketOptions ws 和 wss 连接使用的 HTTP 头和代理
+// proxy 为空时使用环境变量，none 不使用代理
+func websocketOptions(websocketConfig *config.MQTTWebsocketConfig) (http.Header, *mqtt.WebsocketOptions, error) {
+	headers := make(http.Header)
+	for name, value := range websocketConfig.Headers {
+		headers.Set(name, value)
+	}
+
+	options := &mqtt.WebsocketOptions{}
+	switch websocketConfig.Proxy {
+	case "":
+		options.Proxy = http.ProxyFromEnvironment
+	case "none":
+		options.Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	default:
+		proxyURL, err := url.Parse(websocketConfig.Proxy)
+		if err != nil {
+			return nil, nil, err
+		}
+		options.Proxy = http.ProxyURL(proxyURL)
+	}
+	return headers, options, nil
+}
@@ -0,0 +1,153 @@
+package outbox
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+)
+
+// 批量上传的编码方式
+// EncodingJSON 消息体为 JSON 数组
+// EncodingGzip 消息体为 gzip 压缩的 JSON 数组
+// EncodingDeflate 消息体为 deflate (RFC 1951) 压缩的 JSON 数组
+const (
+	EncodingJSON    = "json"
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// BatchHeader 批量消息头，占据消息的第一行，后端据此解码消息体
+//
+//	{"batch":1,"encoding":"gzip","count":12}\n<消息体>
+type BatchHeader struct {
+	Batch    int    `json:"batch"`
+	Encoding string `json:"encoding"`
+	Count    int    `json:"count"`
+}
+
+// batcher 按消息类型合并待发送消息
+type batcher struct {
+	kinds    []string
+	maxCount int
+	maxBytes int
+	maxAge   time.Duration
+	encoding string
+}
+
+// newBatcher 根据配置创建 batcher，未启用时返回 nil
+// 消息类型按优先级从高到低排列
+func newBatcher(batchConfig *config.MQTTBatchConfig, registry *Registry) *batcher {
+	if !batchConfig.Enabled || len(batchConfig.Kinds) == 0 {
+		return nil
+	}
+	b := &batcher{
+		kinds:    append([]string(nil), batchConfig.Kinds...),
+		maxCount: batchConfig.MaxCount,
+		maxBytes: batchConfig.MaxBytes,
+		maxAge:   time.Duration(batchConfig.MaxAge) * time.Second,
+		encoding: batchConfig.Encoding,
+	}
+	sort.SliceStable(b.kinds, func(i, j int) bool {
+		return registry.Priority(b.kinds[i]) > registry.Priority(b.kinds[j])
+	})
+	if b.maxCount <= 0 {
+		b.maxCount = 1
+	}
+	return b
+}
+
+// Kinds 参与合并的消息类型
+func (b *batcher) Kinds() []string {
+	return b.kinds
+}
+
+// take 从按写入顺序排列的消息中取出一批，受条数和字节数限制，至少取一条
+// 返回值 full 表示达到了条数或字节数上限
+func (b *batcher) take(msgs []model.MQTTMsg) (batch []model.MQTTMsg, full bool) {
+	size := 0
+	for i, msg := range msgs {
+		if i >= b.maxCount {
+			return batch, true
+		}
+		if b.maxBytes > 0 && i > 0 && size+len(msg.Msg) > b.maxBytes {
+			return batch, true
+		}
+		size += len(msg.Msg)
+		batch = append(batch, msg)
+	}
+	full = len(batch) >= b.maxCount || (b.maxBytes > 0 && size >= b.maxBytes)
+	return batch, full
+}
+
+// due 最早一条消息等待时间超过上限，需要发送
+func (b *batcher) due(oldest model.MQTTMsg) bool {
+	return time.Since(oldest.CreatedAt) >= b.maxAge
+}
+
+// dueAt 最早一条消息需要发送的时间
+func (b *batcher) dueAt(oldest model.MQTTMsg) time.Time {
+	return oldest.CreatedAt.Add(b.maxAge)
+}
+
+// EncodeBatch 将多条消息编码为一条批量消息
+func EncodeBatch(encoding string, msgs []string) ([]byte, error) {
+	items := make([]json.RawMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if json.Valid([]byte(msg)) {
+			items = append(items, json.RawMessage(msg))
+			continue
+		}
+		raw, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, raw)
+	}
+	body, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := json.Marshal(BatchHeader{Batch: 1, Encoding: encoding, Count: len(msgs)})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	buf.WriteByte('\n')
+
+	switch encoding {
+	case EncodingJSON:
+		buf.Write(body)
+	case EncodingGzip:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case EncodingDeflate:
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown batch encoding %q", encoding)
+	}
+	return buf.Bytes(), nil
+}
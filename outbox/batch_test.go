@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+)
+
+// decodeBatch 按后端的方式解码批量消息
+func decodeBatch(t *testing.T, payload []byte) (BatchHeader, []json.RawMessage) {
+	t.Helper()
+	i := bytes.IndexByte(payload, '\n')
+	if i < 0 {
+		t.Fatal("missing header line")
+	}
+	var header BatchHeader
+	if err := json.Unmarshal(payload[:i], &header); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+
+	var body io.Reader = bytes.NewReader(payload[i+1:])
+	switch header.Encoding {
+	case EncodingJSON:
+	case EncodingGzip:
+		r, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = r
+	case EncodingDeflate:
+		body = flate.NewReader(body)
+	default:
+		t.Fatalf("unknown encoding %q", header.Encoding)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		t.Fatalf("body: %v", err)
+	}
+	return header, items
+}
+
+func TestEncodeBatchRoundTrip(t *testing.T) {
+	msgs := []string{`{"lat":31.2,"lng":121.5}`, `{"lat":31.3,"lng":121.6}`, "not json"}
+	want := []string{`{"lat":31.2,"lng":121.5}`, `{"lat":31.3,"lng":121.6}`, `"not json"`}
+	for _, encoding := range []string{EncodingJSON, EncodingGzip, EncodingDeflate} {
+		t.Run(encoding, func(t *testing.T) {
+			payload, err := EncodeBatch(encoding, msgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, items := decodeBatch(t, payload)
+			if header != (BatchHeader{Batch: 1, Encoding: encoding, Count: len(msgs)}) {
+				t.Fatalf("header %+v", header)
+			}
+			if len(items) != len(want) {
+				t.Fatalf("%d items, want %d", len(items), len(want))
+			}
+			for i, item := range items {
+				if string(item) != want[i] {
+					t.Fatalf("item %d %s, want %s", i, item, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeBatchUnknownEncoding(t *testing.T) {
+	if _, err := EncodeBatch("zstd", []string{"{}"}); err == nil {
+		t.Fatal("unknown encoding accepted")
+	}
+}
+
+func testMsgs(sizes ...int) []model.MQTTMsg {
+	msgs := make([]model.MQTTMsg, len(sizes))
+	for i, size := range sizes {
+		msgs[i].ID = uint(i + 1)
+		msgs[i].Msg = strings.Repeat("x", size)
+	}
+	return msgs
+}
+
+func TestBatcherTake(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxCount  int
+		maxBytes  int
+		sizes     []int
+		wantCount int
+		wantFull  bool
+	}{
+		{name: "below limits", maxCount: 5, maxBytes: 100, sizes: []int{10, 10}, wantCount: 2},
+		{name: "count limit", maxCount: 3, sizes: []int{10, 10, 10, 10}, wantCount: 3, wantFull: true},
+		{name: "exactly count", maxCount: 2, sizes: []int{10, 10}, wantCount: 2, wantFull: true},
+		{name: "bytes limit", maxCount: 10, maxBytes: 25, sizes: []int{10, 10, 10}, wantCount: 2, wantFull: true},
+		{name: "exactly bytes", maxCount: 10, maxBytes: 20, sizes: []int{10, 10}, wantCount: 2, wantFull: true},
+		{name: "oversized first", maxCount: 10, maxBytes: 5, sizes: []int{10, 10}, wantCount: 1, wantFull: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &batcher{maxCount: tt.maxCount, maxBytes: tt.maxBytes}
+			batch, full := b.take(testMsgs(tt.sizes...))
+			if len(batch) != tt.wantCount || full != tt.wantFull {
+				t.Fatalf("took %d full %v, want %d full %v", len(batch), full, tt.wantCount, tt.wantFull)
+			}
+			for i, msg := range batch {
+				if msg.ID != uint(i+1) {
+					t.Fatalf("batch out of order: %d at %d", msg.ID, i)
+				}
+			}
+		})
+	}
+}
+
+func TestBatcherDue(t *testing.T) {
+	b := &batcher{maxAge: time.Minute}
+	var fresh, stale model.MQTTMsg
+	fresh.CreatedAt = time.Now().Add(-30 * time.Second)
+	stale.CreatedAt = time.Now().Add(-61 * time.Second)
+	if b.due(fresh) {
+		t.Fatal("fresh message due before linger")
+	}
+	if !b.due(stale) {
+		t.Fatal("stale message not due after linger")
+	}
+	if got := b.dueAt(fresh); !got.Equal(fresh.CreatedAt.Add(time.Minute)) {
+		t.Fatalf("dueAt %s", got)
+	}
+}
+
+func TestNewBatcherOrdersKinds(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(model.KindHeartbeat, Route{Priority: DefaultHeartbeatPriority})
+	registry.Register(model.KindGPS, Route{Priority: DefaultGPSPriority})
+	registry.Register(model.KindCellular, Route{Priority: DefaultStatusPriority})
+
+	if newBatcher(&config.MQTTBatchConfig{Kinds: []string{model.KindGPS}}, registry) != nil {
+		t.Fatal("batcher created while disabled")
+	}
+	b := newBatcher(&config.MQTTBatchConfig{
+		Enabled: true,
+		Kinds:   []string{model.KindHeartbeat, model.KindGPS, model.KindCellular},
+	}, registry)
+	want := []string{model.KindCellular, model.KindGPS, model.KindHeartbeat}
+	if strings.Join(b.Kinds(), ",") != strings.Join(want, ",") {
+		t.Fatalf("kinds %v, want %v", b.Kinds(), want)
+	}
+	if b.maxCount != 1 {
+		t.Fatalf("maxCount %d, want at least 1", b.maxCount)
+	}
+}
@@ -0,0 +1,491 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"gorm.io/gorm"
+)
+
+// IdlePeriod 队列为空时的默认轮询周期
+const IdlePeriod = 150 * time.Second
+
+// OfflinePeriod 未连接服务器时的等待时间
+const OfflinePeriod = 5 * time.Second
+
+// ErrOffline 未连接服务器，消息没有发出，不计入重试次数
+var ErrOffline = errors.New("outbox: publisher offline")
+
+// Pending 已交给 MQTT 客户端但尚未确认的发布，与 MQTT 客户端的 Token 相同
+type Pending interface {
+	Done() <-chan struct{}
+	Error() error
+}
+
+// PendingError 等待服务器确认超时，报文仍保存在 MQTT 客户端中，由客户端重连后重发
+// 调度器不重新发布消息，等待原来的报文有结果后再更新
+type PendingError struct {
+	Topic   string
+	Timeout time.Duration
+	Pending Pending
+}
+
+func (e *PendingError) Error() string {
+	return fmt.Sprintf("publish to %s not acknowledged within %s", e.Topic, e.Timeout)
+}
+
+// Publisher 消息发布接口，由 mqtt 模块实现
+// Publish 在服务器确认之后才返回 nil，route.Expiry 为消息剩余的有效期
+// 等待确认超时返回 *PendingError，消息保持 in-flight 状态
+type Publisher interface {
+	Publish(route Route, payload string) error
+}
+
+// PublisherFunc 函数形式的 Publisher
+type PublisherFunc func(route Route, payload string) error
+
+// Publish 调用 f
+func (f PublisherFunc) Publish(route Route, payload string) error {
+	return f(route, payload)
+}
+
+// Dispatcher 读取数据库中的消息，按路由表发布，服务器确认后才删除
+type Dispatcher struct {
+	log              *logger.Logger
+	db               *gorm.DB
+	outbox           *Outbox
+	registry         *Registry
+	publisher        Publisher
+	batcher          *batcher
+	pollPeriod       time.Duration
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	maxRetries       int
+}
+
+// NewDispatcher 创建发送队列调度器
+func NewDispatcher(
+	log *logger.Logger,
+	outbox *Outbox,
+	mqttConfig *config.MQTTConfig,
+	publisher Publisher,
+) *Dispatcher {
+	d := &Dispatcher{
+		log:              log,
+		db:               outbox.DB(),
+		outbox:           outbox,
+		registry:         outbox.Registry(),
+		publisher:        publisher,
+		batcher:          newBatcher(&mqttConfig.Batch, outbox.Registry()),
+		pollPeriod:       time.Duration(mqttConfig.PollPeriod) * time.Second,
+		retryInterval:    time.Duration(mqttConfig.RetryInterval) * time.Second,
+		maxRetryInterval: time.Duration(mqttConfig.MaxRetryInterval) * time.Second,
+		maxRetries:       mqttConfig.MaxRetries,
+	}
+	if d.pollPeriod <= 0 {
+		d.pollPeriod = IdlePeriod
+	}
+	if d.retryInterval <= 0 {
+		d.retryInterval = time.Second
+	}
+	if d.maxRetryInterval < d.retryInterval {
+		d.maxRetryInterval = d.retryInterval
+	}
+	return d
+}
+
+// Run 不断读取数据库，然后发送，如果数据库没有数据，等待新消息通知或一个轮询周期
+func (d *Dispatcher) Run() {
+	d.log.WithFields(logger.Fields{
+		"outbox": "run",
+	}).Info("Outbox dispatcher run, routes: ", d.registry.Kinds())
+
+	d.recover()
+
+	for {
+		var mqttMsg model.MQTTMsg
+		result := d.single().Limit(1).Find(&mqttMsg)
+		if result.Error != nil {
+			d.log.WithFields(logger.Fields{
+				"outbox": "run",
+			}).Error("Read outbox: ", result.Error)
+			d.wait(d.pollPeriod)
+			continue
+		}
+
+		// 优先级不低于队首消息的批量消息先发送
+		if d.flushBatches(result.RowsAffected > 0, mqttMsg.Priority) {
+			continue
+		}
+
+		if result.RowsAffected == 0 {
+			d.purge()
+			d.wait(d.idle())
+			continue
+		}
+		d.dispatch(&mqttMsg)
+	}
+}
+
+// pending 到达发送时间的待发送消息，优先级高的在前，同一优先级按写入顺序排列
+func (d *Dispatcher) pending() *gorm.DB {
+	return d.db.
+		Where("state = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)", model.StatePending, time.Now().UTC()).
+		Order("priority DESC").
+		Order("id")
+}
+
+// single 逐条发送的待发送消息，不包括批量上传的消息类型
+func (d *Dispatcher) single() *gorm.DB {
+	if d.batcher == nil {
+		return d.pending()
+	}
+	return d.pending().Where("topic NOT IN ?", d.batcher.Kinds())
+}
+
+// recover 进程在发送过程中退出时，消息停留在 in-flight 状态，启动时重新发送
+func (d *Dispatcher) recover() {
+	result := d.db.Model(&model.MQTTMsg{}).
+		Where("state = ? OR state IS NULL OR state = ''", model.StateInFlight).
+		Update("state", model.StatePending)
+	if result.Error != nil {
+		d.log.WithFields(logger.Fields{
+			"outbox": "recover",
+		}).Error("Recover in-flight messages: ", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		d.log.WithFields(logger.Fields{
+			"outbox": "recover",
+		}).Info("Recover in-flight messages: ", result.RowsAffected)
+	}
+	d.purge()
+}
+
+// purge 删除服务器已确认的消息
+func (d *Dispatcher) purge() {
+	err := d.db.Unscoped().Where("state = ?", model.StateAcked).Delete(&model.MQTTMsg{}).Error
+	if err != nil {
+		d.log.WithFields(logger.Fields{
+			"outbox": "purge",
+		}).Error("Purge acked messages: ", err)
+	}
+}
+
+// wait 等待新消息通知，最长等待 timeout
+func (d *Dispatcher) wait(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-d.outbox.Wake():
+	case <-timer.C:
+	}
+}
+
+// idle 计算下一次读取数据库前的等待时间，不超过轮询周期
+// 考虑失败重发的时间，以及批量消息最长等待时间
+// 批量上传的消息新写入时 next_attempt_at 为零值，由 dueAt 决定等待时间，不参与逐条消息的计算
+func (d *Dispatcher) idle() time.Duration {
+	wait := d.pollPeriod
+
+	var next model.MQTTMsg
+	query := d.db.Where("state = ?", model.StatePending)
+	if d.batcher != nil {
+		query = query.Where("topic NOT IN ?", d.batcher.Kinds())
+	}
+	result := query.Order("next_attempt_at").Limit(1).Find(&next)
+	if result.Error == nil && result.RowsAffected > 0 {
+		if until := time.Until(next.NextAttemptAt); until < wait {
+			wait = until
+		}
+	}
+
+	if d.batcher != nil {
+		for _, kind := range d.batcher.Kinds() {
+			var oldest model.MQTTMsg
+			result := d.db.Where("state = ? AND topic = ?", model.StatePending, kind).Order("id").Limit(1).Find(&oldest)
+			if result.Error != nil || result.RowsAffected == 0 {
+				continue
+			}
+			// 发送失败后还需要等到重发时间
+			due := d.batcher.dueAt(oldest)
+			if oldest.NextAttemptAt.After(due) {
+				due = oldest.NextAttemptAt
+			}
+			if until := time.Until(due); until < wait {
+				wait = until
+			}
+		}
+	}
+
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// backoff 第 retries 次重试前的等待时间，指数增长
+func (d *Dispatcher) backoff(retries int) time.Duration {
+	wait := d.retryInterval
+	for i := 1; i < retries && wait < d.maxRetryInterval; i++ {
+		wait *= 2
+	}
+	if wait > d.maxRetryInterval {
+		wait = d.maxRetryInterval
+	}
+	return wait
+}
+
+// dispatch 发布一条消息，无路由的消息移入死信表
+func (d *Dispatcher) dispatch(mqttMsg *model.MQTTMsg) {
+	route, ok := d.registry.Lookup(mqttMsg.Topic)
+	if !ok {
+		d.deadLetter(mqttMsg, "no route for kind")
+		return
+	}
+
+	msgs := []model.MQTTMsg{*mqttMsg}
+	route, ok = d.remaining(route, msgs)
+	if !ok {
+		return
+	}
+	if err := d.setState(msgs, model.StateInFlight); err != nil {
+		time.Sleep(time.Second)
+		return
+	}
+
+	err := d.publisher.Publish(route, mqttMsg.Msg)
+	d.settle(msgs, err)
+}
+
+// flushBatches 发送达到条数、字节数或等待时间上限的批量消息，有消息发出时返回 true
+// hasHead 为 true 时只发送优先级不低于 priority 的批量消息
+func (d *Dispatcher) flushBatches(hasHead bool, priority int) bool {
+	if d.batcher == nil {
+		return false
+	}
+	sent := false
+	for _, kind := range d.batcher.Kinds() {
+		var msgs []model.MQTTMsg
+		err := d.pending().Where("topic = ?", kind).Limit(d.batcher.maxCount + 1).Find(&msgs).Error
+		if err != nil {
+			d.log.WithFields(logger.Fields{
+				"outbox": "batch",
+				"kind":   kind,
+			}).Error("Read outbox: ", err)
+			continue
+		}
+		if len(msgs) == 0 || (hasHead && msgs[0].Priority < priority) {
+			continue
+		}
+		batch, full := d.batcher.take(msgs)
+		if !full && !d.batcher.due(msgs[0]) {
+			continue
+		}
+		d.dispatchBatch(kind, batch)
+		sent = true
+	}
+	return sent
+}
+
+// dispatchBatch 将同一类型的多条消息合并为一条发布
+func (d *Dispatcher) dispatchBatch(kind string, msgs []model.MQTTMsg) {
+	route, ok := d.registry.Lookup(kind)
+	if !ok {
+		for i := range msgs {
+			d.deadLetter(&msgs[i], "no route for kind")
+		}
+		return
+	}
+
+	route, ok = d.remaining(route, msgs)
+	if !ok {
+		return
+	}
+
+	payloads := make([]string, len(msgs))
+	for i, msg := range msgs {
+		payloads[i] = msg.Msg
+	}
+	payload, err := EncodeBatch(d.batcher.encoding, payloads)
+	if err != nil {
+		d.log.WithFields(logger.Fields{
+			"outbox": "batch",
+			"kind":   kind,
+		}).Error("Encode batch: ", err)
+		for i := range msgs {
+			d.deadLetter(&msgs[i], "encode batch: "+err.Error())
+		}
+		return
+	}
+
+	if err := d.setState(msgs, model.StateInFlight); err != nil {
+		time.Sleep(time.Second)
+		return
+	}
+
+	d.log.WithFields(logger.Fields{
+		"outbox":   "batch",
+		"kind":     kind,
+		"count":    len(msgs),
+		"bytes":    len(payload),
+		"encoding": d.batcher.encoding,
+	}).Info("Publish batch")
+
+	err = d.publisher.Publish(route, string(payload))
+	d.settle(msgs, err)
+}
+
+// remaining 计算消息剩余的有效期，批量消息以最新一条为准
+// 消息已全部过期时直接删除，返回 false
+func (d *Dispatcher) remaining(route Route, msgs []model.MQTTMsg) (Route, bool) {
+	if route.Expiry <= 0 {
+		return route, true
+	}
+	newest := msgs[0].CreatedAt
+	for _, msg := range msgs[1:] {
+		if msg.CreatedAt.After(newest) {
+			newest = msg.CreatedAt
+		}
+	}
+	route.Expiry -= time.Since(newest)
+	if route.Expiry >= time.Second {
+		return route, true
+	}
+
+	d.log.WithFields(logger.Fields{
+		"outbox": "expire",
+		"id":     msgs[0].ID,
+		"count":  len(msgs),
+		"kind":   msgs[0].Topic,
+	}).Warn("Drop expired messages")
+	if err := d.db.Unscoped().Delete(&model.MQTTMsg{}, ids(msgs)).Error; err != nil {
+		d.log.WithFields(logger.Fields{
+			"outbox": "expire",
+			"id":     msgs[0].ID,
+		}).Error("Drop expired messages: ", err)
+		time.Sleep(time.Second)
+	}
+	return route, false
+}
+
+// settle 根据发布结果更新消息：成功则删除，未连接则等待，失败则按指数退避重发
+// 失败次数超过 maxRetries 的消息移入死信表
+// 等待确认超时的消息保持 in-flight，原来的报文有结果后再更新，避免同一条消息发布两次
+func (d *Dispatcher) settle(msgs []model.MQTTMsg, err error) {
+	var pending *PendingError
+	if errors.As(err, &pending) {
+		d.log.WithFields(logger.Fields{
+			"outbox": "dispatch",
+			"id":     msgs[0].ID,
+			"count":  len(msgs),
+			"kind":   msgs[0].Topic,
+		}).Warn("Publish not acknowledged yet, wait for the original packet: ", err)
+		go func() {
+			<-pending.Pending.Done()
+			d.settle(msgs, pending.Pending.Error())
+			d.outbox.Notify()
+		}()
+		return
+	}
+
+	if err == nil {
+		if d.setState(msgs, model.StateAcked) == nil {
+			d.db.Unscoped().Delete(&model.MQTTMsg{}, ids(msgs))
+		}
+		return
+	}
+
+	if errors.Is(err, ErrOffline) {
+		d.setState(msgs, model.StatePending)
+		d.wait(OfflinePeriod)
+		return
+	}
+
+	retries := 0
+	for _, msg := range msgs {
+		if msg.Retries > retries {
+			retries = msg.Retries
+		}
+	}
+	retries++
+	if d.maxRetries > 0 && retries > d.maxRetries {
+		for i := range msgs {
+			d.deadLetter(&msgs[i], "max retries exceeded: "+err.Error())
+		}
+		return
+	}
+	wait := d.backoff(retries)
+	d.log.WithFields(logger.Fields{
+		"outbox":  "dispatch",
+		"id":      msgs[0].ID,
+		"count":   len(msgs),
+		"kind":    msgs[0].Topic,
+		"retries": retries,
+	}).Warn("Publish failed, retry in ", wait, ": ", err)
+
+	err = d.db.Model(&model.MQTTMsg{}).Where("id IN ?", ids(msgs)).Updates(map[string]interface{}{
+		"state":           model.StatePending,
+		"retries":         gorm.Expr("retries + 1"),
+		"next_attempt_at": time.Now().UTC().Add(wait),
+	}).Error
+	if err != nil {
+		d.log.WithFields(logger.Fields{
+			"outbox": "dispatch",
+			"id":     msgs[0].ID,
+		}).Error("Schedule retry: ", err)
+	}
+}
+
+// setState 更新消息状态
+func (d *Dispatcher) setState(msgs []model.MQTTMsg, state string) error {
+	err := d.db.Model(&model.MQTTMsg{}).Where("id IN ?", ids(msgs)).Update("state", state).Error
+	if err != nil {
+		d.log.WithFields(logger.Fields{
+			"outbox": "state",
+			"id":     msgs[0].ID,
+			"state":  state,
+		}).Error("Update message state: ", err)
+	}
+	return err
+}
+
+// ids 消息的主键
+func ids(msgs []model.MQTTMsg) []uint {
+	ids := make([]uint, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+// deadLetter 将消息移入死信表
+func (d *Dispatcher) deadLetter(mqttMsg *model.MQTTMsg, reason string) {
+	d.log.WithFields(logger.Fields{
+		"outbox": "dead-letter",
+		"id":     mqttMsg.ID,
+		"kind":   mqttMsg.Topic,
+	}).Warn("Move message to dead letter: ", reason)
+
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&model.MQTTDeadLetter{
+			Kind:   mqttMsg.Topic,
+			Msg:    mqttMsg.Msg,
+			Reason: reason,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(mqttMsg).Error
+	})
+	if err != nil {
+		d.log.WithFields(logger.Fields{
+			"outbox": "dead-letter",
+			"id":     mqttMsg.ID,
+		}).Error("Move message to dead letter: ", err)
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,317 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+var testDBSeq int64
+
+// newTestOutbox 每个测试使用单独的内存数据库
+func newTestOutbox(t *testing.T) *Outbox {
+	t.Helper()
+	dsn := fmt.Sprintf("file:outbox%d?mode=memory&cache=shared", atomic.AddInt64(&testDBSeq, 1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: gormlogger.Default.LogMode(gormlogger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if _, err := model.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewRegistry()
+	registry.Register(model.KindStatus, Route{Topic: "gw/status", Qos: 2, Priority: DefaultStatusPriority})
+	registry.Register(model.KindGPS, Route{Topic: "gw/gps", Qos: 1, Priority: DefaultGPSPriority})
+	registry.Register(model.KindHeartbeat, Route{Topic: "gw/heartbeat", Qos: 1, Priority: DefaultHeartbeatPriority})
+	return New(db, registry)
+}
+
+func newTestLogger() *logger.Logger {
+	log := logger.New()
+	log.SetOutput(ioutil.Discard)
+	return log
+}
+
+// recordingPublisher 记录发布的消息，按顺序返回 errs 中的结果，用完后返回 nil
+type recordingPublisher struct {
+	mu        sync.Mutex
+	errs      []error
+	published []string
+}
+
+func (p *recordingPublisher) Publish(route Route, payload string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, payload)
+	if len(p.errs) == 0 {
+		return nil
+	}
+	err := p.errs[0]
+	p.errs = p.errs[1:]
+	return err
+}
+
+func newTestDispatcher(ob *Outbox, publisher Publisher, maxRetries int) *Dispatcher {
+	return NewDispatcher(newTestLogger(), ob, &config.MQTTConfig{
+		PollPeriod:       1,
+		RetryInterval:    2,
+		MaxRetryInterval: 8,
+		MaxRetries:       maxRetries,
+	}, publisher)
+}
+
+// dispatchNext 发送一条到达发送时间的消息，没有时返回 false
+func dispatchNext(t *testing.T, d *Dispatcher) bool {
+	t.Helper()
+	var msg model.MQTTMsg
+	result := d.single().Limit(1).Find(&msg)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return false
+	}
+	d.dispatch(&msg)
+	return true
+}
+
+func loadMsg(t *testing.T, ob *Outbox, id uint) (model.MQTTMsg, bool) {
+	t.Helper()
+	var msg model.MQTTMsg
+	result := ob.DB().Unscoped().Limit(1).Find(&msg, id)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	return msg, result.RowsAffected > 0
+}
+
+func putMsg(t *testing.T, ob *Outbox, kind string, msg string) uint {
+	t.Helper()
+	if err := ob.Put(kind, msg); err != nil {
+		t.Fatal(err)
+	}
+	var last model.MQTTMsg
+	if err := ob.DB().Order("id DESC").Limit(1).Find(&last).Error; err != nil {
+		t.Fatal(err)
+	}
+	return last.ID
+}
+
+func TestDispatchAckDeletes(t *testing.T) {
+	ob := newTestOutbox(t)
+	publisher := &recordingPublisher{}
+	d := newTestDispatcher(ob, publisher, 0)
+	id := putMsg(t, ob, model.KindStatus, `{"status":"BootUp"}`)
+
+	if !dispatchNext(t, d) {
+		t.Fatal("no message dispatched")
+	}
+	if len(publisher.published) != 1 || publisher.published[0] != `{"status":"BootUp"}` {
+		t.Fatalf("published %q", publisher.published)
+	}
+	if _, ok := loadMsg(t, ob, id); ok {
+		t.Fatal("acked message not deleted")
+	}
+}
+
+func TestDispatchErrorSchedulesRetry(t *testing.T) {
+	ob := newTestOutbox(t)
+	d := newTestDispatcher(ob, &recordingPublisher{errs: []error{errors.New("timeout"), errors.New("timeout")}}, 0)
+	id := putMsg(t, ob, model.KindStatus, "BootUp")
+
+	before := time.Now().UTC()
+	dispatchNext(t, d)
+	msg, ok := loadMsg(t, ob, id)
+	if !ok {
+		t.Fatal("failed message deleted")
+	}
+	if msg.State != model.StatePending || msg.Retries != 1 {
+		t.Fatalf("state %s retries %d, want pending 1", msg.State, msg.Retries)
+	}
+	if wait := msg.NextAttemptAt.Sub(before); wait < 2*time.Second || wait > 3*time.Second {
+		t.Fatalf("first retry in %s, want retryInterval 2s", wait)
+	}
+	// 未到重发时间，不会再次发送
+	if dispatchNext(t, d) {
+		t.Fatal("message dispatched before next_attempt_at")
+	}
+
+	// 第二次失败后等待时间加倍
+	ob.DB().Model(&model.MQTTMsg{}).Where("id = ?", id).Update("next_attempt_at", time.Now().UTC())
+	before = time.Now().UTC()
+	dispatchNext(t, d)
+	msg, _ = loadMsg(t, ob, id)
+	if msg.Retries != 2 {
+		t.Fatalf("retries %d, want 2", msg.Retries)
+	}
+	if wait := msg.NextAttemptAt.Sub(before); wait < 4*time.Second || wait > 5*time.Second {
+		t.Fatalf("second retry in %s, want 4s", wait)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := newTestDispatcher(newTestOutbox(t), &recordingPublisher{}, 0)
+	want := []time.Duration{2 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for retries, wait := range want {
+		if got := d.backoff(retries); got != wait {
+			t.Fatalf("backoff(%d) = %s, want %s", retries, got, wait)
+		}
+	}
+}
+
+func TestDispatchOfflineIsNotRetry(t *testing.T) {
+	ob := newTestOutbox(t)
+	d := newTestDispatcher(ob, &recordingPublisher{errs: []error{ErrOffline}}, 1)
+	id := putMsg(t, ob, model.KindStatus, "BootUp")
+
+	// 通知让 settle 中的离线等待立即返回
+	ob.Notify()
+	dispatchNext(t, d)
+	msg, ok := loadMsg(t, ob, id)
+	if !ok {
+		t.Fatal("offline message deleted")
+	}
+	if msg.State != model.StatePending || msg.Retries != 0 || !msg.NextAttemptAt.IsZero() {
+		t.Fatalf("state %s retries %d next %s, want pending 0 zero", msg.State, msg.Retries, msg.NextAttemptAt)
+	}
+}
+
+func TestDispatchDeadLetterAfterMaxRetries(t *testing.T) {
+	ob := newTestOutbox(t)
+	failed := errors.New("not authorized")
+	d := newTestDispatcher(ob, &recordingPublisher{errs: []error{failed, failed, failed}}, 2)
+	id := putMsg(t, ob, model.KindGPS, "fix")
+
+	for i := 0; i < 3; i++ {
+		ob.DB().Model(&model.MQTTMsg{}).Where("id = ?", id).Update("next_attempt_at", time.Now().UTC())
+		if !dispatchNext(t, d) {
+			t.Fatalf("attempt %d not dispatched", i+1)
+		}
+	}
+	if _, ok := loadMsg(t, ob, id); ok {
+		t.Fatal("message not removed after max retries")
+	}
+	var letters []model.MQTTDeadLetter
+	if err := ob.DB().Find(&letters).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Kind != model.KindGPS || letters[0].Msg != "fix" {
+		t.Fatalf("dead letters %+v", letters)
+	}
+}
+
+func TestDispatchNoRouteDeadLetter(t *testing.T) {
+	ob := newTestOutbox(t)
+	publisher := &recordingPublisher{}
+	d := newTestDispatcher(ob, publisher, 0)
+	putMsg(t, ob, "Unknown", "x")
+
+	dispatchNext(t, d)
+	if len(publisher.published) != 0 {
+		t.Fatal("message without route published")
+	}
+	var count int64
+	ob.DB().Model(&model.MQTTDeadLetter{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("dead letters %d, want 1", count)
+	}
+}
+
+func TestRecoverResetsInFlight(t *testing.T) {
+	ob := newTestOutbox(t)
+	d := newTestDispatcher(ob, &recordingPublisher{}, 0)
+	inFlight := putMsg(t, ob, model.KindStatus, "a")
+	acked := putMsg(t, ob, model.KindStatus, "b")
+	pending := putMsg(t, ob, model.KindStatus, "c")
+	ob.DB().Model(&model.MQTTMsg{}).Where("id = ?", inFlight).Update("state", model.StateInFlight)
+	ob.DB().Model(&model.MQTTMsg{}).Where("id = ?", acked).Update("state", model.StateAcked)
+
+	d.recover()
+	for _, id := range []uint{inFlight, pending} {
+		msg, ok := loadMsg(t, ob, id)
+		if !ok || msg.State != model.StatePending {
+			t.Fatalf("message %d state %s, want pending", id, msg.State)
+		}
+	}
+	if _, ok := loadMsg(t, ob, acked); ok {
+		t.Fatal("acked message not purged")
+	}
+}
+
+// fakePending 等待确认超时的发布
+type fakePending struct {
+	done chan struct{}
+	err  error
+}
+
+func (p *fakePending) Done() <-chan struct{} { return p.done }
+func (p *fakePending) Error() error          { return p.err }
+
+func TestDispatchPendingWaitsForOriginal(t *testing.T) {
+	ob := newTestOutbox(t)
+	pending := &fakePending{done: make(chan struct{})}
+	publisher := &recordingPublisher{errs: []error{&PendingError{Topic: "gw/status", Timeout: time.Second, Pending: pending}}}
+	d := newTestDispatcher(ob, publisher, 0)
+	id := putMsg(t, ob, model.KindStatus, "BootUp")
+
+	dispatchNext(t, d)
+	msg, ok := loadMsg(t, ob, id)
+	if !ok || msg.State != model.StateInFlight || msg.Retries != 0 {
+		t.Fatalf("state %s retries %d, want in-flight 0", msg.State, msg.Retries)
+	}
+	// 等待原报文确认期间不重新发布
+	if dispatchNext(t, d) {
+		t.Fatal("unacknowledged message published again")
+	}
+
+	close(pending.done)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := loadMsg(t, ob, id); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message not deleted after the original packet was acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(publisher.published) != 1 {
+		t.Fatalf("published %d times, want 1", len(publisher.published))
+	}
+}
+
+func TestDispatchPriorityOrder(t *testing.T) {
+	ob := newTestOutbox(t)
+	publisher := &recordingPublisher{}
+	d := newTestDispatcher(ob, publisher, 0)
+	putMsg(t, ob, model.KindHeartbeat, "heartbeat-1")
+	putMsg(t, ob, model.KindGPS, "gps-1")
+	putMsg(t, ob, model.KindStatus, "status-1")
+	putMsg(t, ob, model.KindGPS, "gps-2")
+	putMsg(t, ob, model.KindHeartbeat, "heartbeat-2")
+	putMsg(t, ob, model.KindStatus, "status-2")
+
+	for dispatchNext(t, d) {
+	}
+	want := []string{"status-1", "status-2", "gps-1", "gps-2", "heartbeat-1", "heartbeat-2"}
+	if fmt.Sprint(publisher.published) != fmt.Sprint(want) {
+		t.Fatalf("published %q, want %q", publisher.published, want)
+	}
+}
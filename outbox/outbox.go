@@ -0,0 +1,78 @@
+package outbox
+
+import (
+	"github.com/zsy-cn/4g-gateway/model"
+	"gorm.io/gorm"
+)
+
+// Outbox 发送队列的写入接口
+// 消息先写入数据库，再通知调度器立即发送，调度器的定时轮询只作为兜底
+type Outbox struct {
+	db       *gorm.DB
+	registry *Registry
+	wake     chan struct{}
+}
+
+// New 创建发送队列，registry 决定消息的主题和优先级
+func New(db *gorm.DB, registry *Registry) *Outbox {
+	return &Outbox{
+		db:       db,
+		registry: registry,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// DB 发送队列使用的数据库
+func (o *Outbox) DB() *gorm.DB {
+	return o.db
+}
+
+// Registry 发送队列使用的路由表
+func (o *Outbox) Registry() *Registry {
+	return o.registry
+}
+
+// Put 写入一条消息，kind 为消息类型，由路由表映射到 MQTT 主题和优先级
+func (o *Outbox) Put(kind string, msg string) error {
+	err := o.db.Create(&model.MQTTMsg{
+		Topic:    kind,
+		Msg:      msg,
+		Priority: o.registry.Priority(kind),
+	}).Error
+	if err != nil {
+		return err
+	}
+	o.Notify()
+	return nil
+}
+
+// Depth 每个消息类型等待发送的消息条数，不包括发送中和已确认的消息
+func (o *Outbox) Depth() (map[string]int64, error) {
+	var rows []struct {
+		Topic string
+		Count int64
+	}
+	err := o.db.Model(&model.MQTTMsg{}).Select("topic, COUNT(*) AS count").
+		Where("state = ?", model.StatePending).Group("topic").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	depth := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		depth[row.Topic] = row.Count
+	}
+	return depth, nil
+}
+
+// Notify 通知调度器有新消息，不阻塞
+func (o *Outbox) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wake 调度器等待新消息的通道
+func (o *Outbox) Wake() <-chan struct{} {
+	return o.wake
+}
@@ -0,0 +1,361 @@
+package outbox
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"gorm.io/gorm"
+)
+
+// 淘汰策略
+// PolicyDropOldest 超出限制时丢弃最早的消息
+// PolicyDropNewest 超出限制时丢弃最新的消息
+// PolicyKeep 从不丢弃
+const (
+	PolicyDropOldest = "drop-oldest"
+	PolicyDropNewest = "drop-newest"
+	PolicyKeep       = "keep"
+)
+
+// evictChunk 超出数据库空间上限时每次淘汰的条数
+const evictChunk = 500
+
+// Retention 发送队列保留策略，按条数、时间、字节数和数据库空间淘汰待发送消息
+// 只淘汰 pending 状态的消息，in-flight 的消息不受影响
+type Retention struct {
+	log    *logger.Logger
+	db     *gorm.DB
+	outbox *Outbox
+	config *config.RetentionConfig
+
+	mu      sync.Mutex
+	evicted map[string]int64 // 每个消息类型累计淘汰的条数
+}
+
+// NewRetention 创建保留策略
+func NewRetention(log *logger.Logger, outbox *Outbox, retentionConfig *config.RetentionConfig) *Retention {
+	return &Retention{
+		log:     log,
+		db:      outbox.DB(),
+		outbox:  outbox,
+		config:  retentionConfig,
+		evicted: make(map[string]int64),
+	}
+}
+
+// Run 定期执行保留策略和 VACUUM
+func (r *Retention) Run() {
+	checkPeriod := time.Duration(r.config.CheckPeriod) * time.Second
+	if checkPeriod <= 0 {
+		checkPeriod = 5 * time.Minute
+	}
+	vacuumPeriod := time.Duration(r.config.VacuumPeriod) * time.Second
+	lastVacuum := time.Now()
+
+	for {
+		r.Enforce()
+		if vacuumPeriod > 0 && time.Since(lastVacuum) >= vacuumPeriod {
+			r.Vacuum()
+			lastVacuum = time.Now()
+		}
+		time.Sleep(checkPeriod)
+	}
+}
+
+// Evicted 每个消息类型累计淘汰的条数
+func (r *Retention) Evicted() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	evicted := make(map[string]int64, len(r.evicted))
+	for kind, n := range r.evicted {
+		evicted[kind] = n
+	}
+	return evicted
+}
+
+// policy 消息类型的保留策略，状态消息未配置时从不丢弃
+func (r *Retention) policy(kind string) config.KindRetention {
+	if retention, ok := r.config.Kinds[kind]; ok {
+		return retention
+	}
+	if kind == model.KindStatus {
+		return config.KindRetention{Policy: PolicyKeep}
+	}
+	return config.KindRetention{Policy: r.config.Policy}
+}
+
+// kinds 队列中现有的消息类型，按优先级从低到高排列
+func (r *Retention) kinds() []string {
+	var kinds []string
+	if err := r.db.Model(&model.MQTTMsg{}).Distinct().Pluck("topic", &kinds).Error; err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "retention",
+		}).Error("List kinds: ", err)
+		return nil
+	}
+	registry := r.outbox.Registry()
+	sort.SliceStable(kinds, func(i, j int) bool {
+		return registry.Priority(kinds[i]) < registry.Priority(kinds[j])
+	})
+	return kinds
+}
+
+// Enforce 执行一次保留策略
+func (r *Retention) Enforce() {
+	for _, kind := range r.kinds() {
+		retention := r.policy(kind)
+		if retention.Policy == PolicyKeep {
+			continue
+		}
+		if retention.MaxAge > 0 {
+			r.evictOlderThan(kind, time.Now().Add(-time.Duration(retention.MaxAge)*time.Second))
+		}
+		if retention.MaxRows > 0 {
+			r.evictRows(kind, retention)
+		}
+		if retention.MaxBytes > 0 {
+			r.evictBytes(kind, retention)
+		}
+	}
+	r.evictDeadLetters()
+	r.evictFileSize()
+}
+
+// Vacuum 回收已删除消息占用的空间
+func (r *Retention) Vacuum() {
+	before, err := r.usedBytes()
+	if err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "vacuum",
+		}).Error("Read database size: ", err)
+	}
+	if err := r.db.Exec("VACUUM").Error; err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "vacuum",
+		}).Error("Vacuum: ", err)
+		return
+	}
+	after, err := r.usedBytes()
+	if err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "vacuum",
+		}).Error("Read database size: ", err)
+	}
+	r.log.WithFields(logger.Fields{
+		"outbox": "vacuum",
+		"before": before,
+		"after":  after,
+	}).Info("Vacuum database")
+}
+
+// evictable 可淘汰的消息，按淘汰顺序排列
+func (r *Retention) evictable(kind string, policy string) *gorm.DB {
+	tx := r.db.Model(&model.MQTTMsg{}).Where("topic = ? AND state = ?", kind, model.StatePending)
+	if policy == PolicyDropNewest {
+		return tx.Order("id DESC")
+	}
+	return tx.Order("id")
+}
+
+// evictOlderThan 淘汰写入时间早于 before 的消息
+func (r *Retention) evictOlderThan(kind string, before time.Time) {
+	result := r.db.Unscoped().
+		Where("topic = ? AND state = ? AND created_at < ?", kind, model.StatePending, before).
+		Delete(&model.MQTTMsg{})
+	if result.Error != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+			"kind":   kind,
+		}).Error("Evict by age: ", result.Error)
+		return
+	}
+	r.record(kind, "max-age", result.RowsAffected)
+}
+
+// evictRows 淘汰超出条数上限的消息
+func (r *Retention) evictRows(kind string, retention config.KindRetention) {
+	var count int64
+	if err := r.db.Model(&model.MQTTMsg{}).Where("topic = ?", kind).Count(&count).Error; err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+			"kind":   kind,
+		}).Error("Count messages: ", err)
+		return
+	}
+	if count <= int64(retention.MaxRows) {
+		return
+	}
+	var ids []uint
+	excess := int(count) - retention.MaxRows
+	if err := r.evictable(kind, retention.Policy).Limit(excess).Pluck("id", &ids).Error; err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+			"kind":   kind,
+		}).Error("Select messages: ", err)
+		return
+	}
+	r.delete(kind, "max-rows", ids)
+}
+
+// evictBytes 淘汰超出字节数上限的消息
+func (r *Retention) evictBytes(kind string, retention config.KindRetention) {
+	var total int64
+	err := r.db.Model(&model.MQTTMsg{}).Where("topic = ?", kind).
+		Select("COALESCE(SUM(LENGTH(msg)), 0)").Scan(&total).Error
+	if err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+			"kind":   kind,
+		}).Error("Sum message bytes: ", err)
+		return
+	}
+	if total <= retention.MaxBytes {
+		return
+	}
+
+	rows, err := r.evictable(kind, retention.Policy).Select("id, LENGTH(msg)").Rows()
+	if err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+			"kind":   kind,
+		}).Error("Select messages: ", err)
+		return
+	}
+	var ids []uint
+	for excess := total - retention.MaxBytes; excess > 0 && rows.Next(); {
+		var id uint
+		var size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			break
+		}
+		ids = append(ids, id)
+		excess -= size
+	}
+	rows.Close()
+	r.delete(kind, "max-bytes", ids)
+}
+
+// evictFileSize 数据库已用空间超出上限时，按优先级从低到高淘汰可淘汰的消息
+// 无法读取已用空间时不淘汰，记录错误
+func (r *Retention) evictFileSize() {
+	if r.config.MaxFileSize <= 0 {
+		return
+	}
+	for _, kind := range r.kinds() {
+		retention := r.policy(kind)
+		if retention.Policy == PolicyKeep {
+			continue
+		}
+		for {
+			used, err := r.usedBytes()
+			if err != nil {
+				r.log.WithFields(logger.Fields{
+					"outbox": "evict",
+				}).Error("Read database size: ", err)
+				return
+			}
+			if used <= r.config.MaxFileSize {
+				break
+			}
+			var ids []uint
+			if err := r.evictable(kind, retention.Policy).Limit(evictChunk).Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+				break
+			}
+			r.delete(kind, "max-file-size", ids)
+		}
+	}
+	used, err := r.usedBytes()
+	if err != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+		}).Error("Read database size: ", err)
+		return
+	}
+	if used > r.config.MaxFileSize {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+			"used":   used,
+			"limit":  r.config.MaxFileSize,
+		}).Warn("Database still exceeds size limit, nothing left to evict")
+	}
+}
+
+// evictDeadLetters 死信表只保留最新的若干条
+func (r *Retention) evictDeadLetters() {
+	if r.config.DeadLetterMaxRows <= 0 {
+		return
+	}
+	var count int64
+	if err := r.db.Model(&model.MQTTDeadLetter{}).Count(&count).Error; err != nil || count <= int64(r.config.DeadLetterMaxRows) {
+		return
+	}
+	var ids []uint
+	excess := int(count) - r.config.DeadLetterMaxRows
+	if err := r.db.Model(&model.MQTTDeadLetter{}).Order("id").Limit(excess).Pluck("id", &ids).Error; err != nil {
+		return
+	}
+	result := r.db.Unscoped().Delete(&model.MQTTDeadLetter{}, ids)
+	if result.Error != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+		}).Error("Evict dead letters: ", result.Error)
+		return
+	}
+	r.record("dead-letter", "max-rows", result.RowsAffected)
+}
+
+// delete 删除指定的消息
+func (r *Retention) delete(kind string, reason string, ids []uint) {
+	if len(ids) == 0 {
+		return
+	}
+	result := r.db.Unscoped().Where("state = ?", model.StatePending).Delete(&model.MQTTMsg{}, ids)
+	if result.Error != nil {
+		r.log.WithFields(logger.Fields{
+			"outbox": "evict",
+			"kind":   kind,
+			"reason": reason,
+		}).Error("Evict messages: ", result.Error)
+		return
+	}
+	r.record(kind, reason, result.RowsAffected)
+}
+
+// record 记录淘汰的条数
+func (r *Retention) record(kind string, reason string, n int64) {
+	if n == 0 {
+		return
+	}
+	r.mu.Lock()
+	r.evicted[kind] += n
+	total := r.evicted[kind]
+	r.mu.Unlock()
+
+	r.log.WithFields(logger.Fields{
+		"outbox": "evict",
+		"kind":   kind,
+		"reason": reason,
+		"count":  n,
+		"total":  total,
+	}).Warn("Evict messages")
+}
+
+// usedBytes 数据库已用空间，不包括空闲页
+func (r *Retention) usedBytes() (int64, error) {
+	var pageCount, freeCount, pageSize int64
+	if err := r.db.Raw("PRAGMA page_count").Scan(&pageCount).Error; err != nil {
+		return 0, fmt.Errorf("page_count: %w", err)
+	}
+	if err := r.db.Raw("PRAGMA freelist_count").Scan(&freeCount).Error; err != nil {
+		return 0, fmt.Errorf("freelist_count: %w", err)
+	}
+	if err := r.db.Raw("PRAGMA page_size").Scan(&pageSize).Error; err != nil {
+		return 0, fmt.Errorf("page_size: %w", err)
+	}
+	return (pageCount - freeCount) * pageSize, nil
+}
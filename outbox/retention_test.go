@@ -0,0 +1,144 @@
+package outbox
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+)
+
+// remainingMsgs 队列中剩余的消息内容，按写入顺序排列
+func remainingMsgs(t *testing.T, ob *Outbox, kind string) string {
+	t.Helper()
+	var msgs []string
+	if err := ob.DB().Model(&model.MQTTMsg{}).Where("topic = ?", kind).Order("id").Pluck("msg", &msgs).Error; err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(msgs, ",")
+}
+
+func TestRetentionMaxRows(t *testing.T) {
+	tests := []struct {
+		policy      string
+		want        string
+		wantEvicted int64
+	}{
+		{policy: PolicyDropOldest, want: "3,4", wantEvicted: 2},
+		{policy: PolicyDropNewest, want: "1,2", wantEvicted: 2},
+		{policy: PolicyKeep, want: "1,2,3,4", wantEvicted: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ob := newTestOutbox(t)
+			for _, msg := range []string{"1", "2", "3", "4"} {
+				putMsg(t, ob, model.KindGPS, msg)
+			}
+			r := NewRetention(newTestLogger(), ob, &config.RetentionConfig{
+				Kinds: map[string]config.KindRetention{
+					model.KindGPS: {MaxRows: 2, Policy: tt.policy},
+				},
+			})
+			r.Enforce()
+			if got := remainingMsgs(t, ob, model.KindGPS); got != tt.want {
+				t.Fatalf("remaining %s, want %s", got, tt.want)
+			}
+			if got := r.Evicted()[model.KindGPS]; got != tt.wantEvicted {
+				t.Fatalf("evicted %d, want %d", got, tt.wantEvicted)
+			}
+		})
+	}
+}
+
+func TestRetentionDefaultPolicy(t *testing.T) {
+	ob := newTestOutbox(t)
+	for _, msg := range []string{"1", "2", "3"} {
+		putMsg(t, ob, model.KindStatus, msg)
+		putMsg(t, ob, model.KindHeartbeat, msg)
+	}
+	r := NewRetention(newTestLogger(), ob, &config.RetentionConfig{
+		Policy: PolicyDropOldest,
+		Kinds: map[string]config.KindRetention{
+			model.KindHeartbeat: {MaxRows: 1, Policy: PolicyDropOldest},
+		},
+	})
+	// 状态消息未单独配置时从不丢弃
+	if got := r.policy(model.KindStatus).Policy; got != PolicyKeep {
+		t.Fatalf("status policy %s, want keep", got)
+	}
+	if got := r.policy(model.KindGPS).Policy; got != PolicyDropOldest {
+		t.Fatalf("gps policy %s, want default drop-oldest", got)
+	}
+
+	r.Enforce()
+	if got := remainingMsgs(t, ob, model.KindStatus); got != "1,2,3" {
+		t.Fatalf("status remaining %s", got)
+	}
+	if got := remainingMsgs(t, ob, model.KindHeartbeat); got != "3" {
+		t.Fatalf("heartbeat remaining %s", got)
+	}
+	evicted := r.Evicted()
+	if evicted[model.KindHeartbeat] != 2 || evicted[model.KindStatus] != 0 {
+		t.Fatalf("evicted %v", evicted)
+	}
+}
+
+func TestRetentionSkipsInFlight(t *testing.T) {
+	ob := newTestOutbox(t)
+	first := putMsg(t, ob, model.KindGPS, "1")
+	putMsg(t, ob, model.KindGPS, "2")
+	putMsg(t, ob, model.KindGPS, "3")
+	ob.DB().Model(&model.MQTTMsg{}).Where("id = ?", first).Update("state", model.StateInFlight)
+
+	r := NewRetention(newTestLogger(), ob, &config.RetentionConfig{
+		Kinds: map[string]config.KindRetention{
+			model.KindGPS: {MaxRows: 1, Policy: PolicyDropOldest},
+		},
+	})
+	// in-flight 的消息计入条数但不淘汰
+	r.Enforce()
+	if got := remainingMsgs(t, ob, model.KindGPS); got != "1" {
+		t.Fatalf("remaining %s, want only in-flight 1", got)
+	}
+}
+
+func TestRetentionMaxAgeAndBytes(t *testing.T) {
+	ob := newTestOutbox(t)
+	old := putMsg(t, ob, model.KindGPS, "old")
+	ob.DB().Model(&model.MQTTMsg{}).Where("id = ?", old).Update("created_at", time.Now().Add(-2*time.Hour))
+	for _, msg := range []string{"aaaa", "bbbb", "cccc"} {
+		putMsg(t, ob, model.KindGPS, msg)
+	}
+
+	r := NewRetention(newTestLogger(), ob, &config.RetentionConfig{
+		Kinds: map[string]config.KindRetention{
+			model.KindGPS: {MaxAge: 3600, MaxBytes: 8, Policy: PolicyDropOldest},
+		},
+	})
+	r.Enforce()
+	if got := remainingMsgs(t, ob, model.KindGPS); got != "bbbb,cccc" {
+		t.Fatalf("remaining %s", got)
+	}
+	if got := r.Evicted()[model.KindGPS]; got != 2 {
+		t.Fatalf("evicted %d, want 2", got)
+	}
+}
+
+func TestRetentionUsedBytes(t *testing.T) {
+	ob := newTestOutbox(t)
+	r := NewRetention(newTestLogger(), ob, &config.RetentionConfig{})
+	used, err := r.usedBytes()
+	if err != nil || used <= 0 {
+		t.Fatalf("usedBytes %d, %v", used, err)
+	}
+
+	sqlDB, err := ob.DB().DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	if _, err := r.usedBytes(); err == nil {
+		t.Fatal("usedBytes on a closed database returned no error")
+	}
+}
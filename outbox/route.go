@@ -0,0 +1,117 @@
+package outbox
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+)
+
+// 未配置 [mqtt.routes] 时的默认优先级，状态消息先于 GPS 发送，心跳最后发送
+const (
+	DefaultStatusPriority    = 10
+	DefaultGPSPriority       = 0
+	DefaultHeartbeatPriority = -10
+)
+
+// Route 消息类型对应的发布参数
+type Route struct {
+	Topic    string
+	Qos      byte
+	Retain   bool
+	Priority int           // 优先级，数值大的先发送，同一优先级按写入顺序发送
+	Expiry   time.Duration // 消息有效期，从写入队列开始计算，0 不过期
+}
+
+// Registry 消息类型到 MQTT 发布参数的路由表
+type Registry struct {
+	mu     sync.RWMutex
+	routes map[string]Route
+}
+
+// NewRegistry 创建空路由表
+func NewRegistry() *Registry {
+	return &Registry{
+		routes: make(map[string]Route),
+	}
+}
+
+// NewRegistryFromConfig 根据配置创建路由表
+// 兼容旧配置，topicBootUp、topicGPS 和 topicHeartbeat 作为 Status、GPS 和 Heartbeat 的默认路由，[mqtt.routes] 中的配置优先
+// topicVoltage 同时作为电压读数和电压告警的默认路由，告警与状态消息同样优先
+// topicEvent 作为网关事件的默认路由
+// topicCellular 作为蜂窝网络状态的默认路由，与 GPS 同样优先
+// 心跳只在两个周期内有效，离线期间积压的心跳不再发送
+func NewRegistryFromConfig(mqttConfig *config.MQTTConfig) *Registry {
+	r := NewRegistry()
+	if len(mqttConfig.TopicBootUp) > 0 {
+		r.Register(model.KindStatus, Route{Topic: mqttConfig.TopicBootUp, Qos: 2, Priority: DefaultStatusPriority})
+	}
+	if len(mqttConfig.TopicGPS) > 0 {
+		r.Register(model.KindGPS, Route{Topic: mqttConfig.TopicGPS, Qos: 2, Priority: DefaultGPSPriority})
+	}
+	if len(mqttConfig.TopicHeartbeat) > 0 {
+		r.Register(model.KindHeartbeat, Route{
+			Topic:    mqttConfig.TopicHeartbeat,
+			Qos:      1,
+			Priority: DefaultHeartbeatPriority,
+			Expiry:   2 * time.Duration(mqttConfig.HeartPeriod) * time.Second,
+		})
+	}
+	if len(mqttConfig.TopicVoltage) > 0 {
+		r.Register(model.KindVoltage, Route{Topic: mqttConfig.TopicVoltage, Qos: 1, Priority: DefaultGPSPriority})
+		r.Register(model.KindVoltageAlarm, Route{Topic: mqttConfig.TopicVoltage, Qos: 2, Priority: DefaultStatusPriority})
+	}
+	if len(mqttConfig.TopicEvent) > 0 {
+		r.Register(model.KindEvent, Route{Topic: mqttConfig.TopicEvent, Qos: 2, Priority: DefaultStatusPriority})
+	}
+	if len(mqttConfig.TopicCellular) > 0 {
+		r.Register(model.KindCellular, Route{Topic: mqttConfig.TopicCellular, Qos: 1, Priority: DefaultGPSPriority})
+	}
+	for kind, route := range mqttConfig.Routes {
+		r.Register(kind, Route{
+			Topic:    route.Topic,
+			Qos:      route.Qos,
+			Retain:   route.Retain,
+			Priority: route.Priority,
+			Expiry:   time.Duration(route.Expiry) * time.Second,
+		})
+	}
+	return r
+}
+
+// Register 注册消息类型的路由，已存在则覆盖
+func (r *Registry) Register(kind string, route Route) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[kind] = route
+	return r
+}
+
+// Lookup 查找消息类型的路由
+func (r *Registry) Lookup(kind string) (Route, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	route, ok := r.routes[kind]
+	return route, ok
+}
+
+// Priority 消息类型的优先级，未注册的类型为 0
+func (r *Registry) Priority(kind string) int {
+	route, _ := r.Lookup(kind)
+	return route.Priority
+}
+
+// Kinds 返回所有已注册的消息类型
+func (r *Registry) Kinds() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	kinds := make([]string, 0, len(r.routes))
+	for kind := range r.routes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
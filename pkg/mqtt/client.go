@@ -1,4 +1,4 @@
-// Package mqtt provides an MQTT v3.1.1 client library.
+// Package mqtt provides an MQTT v3.1.1 and v5 client library.
 package mqtt
 
 import (
@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
 )
 
@@ -58,6 +60,10 @@ type Client interface {
 	// to the specified topic.
 	// Returns a token to track delivery of the message to the broker
 	Publish(topic string, qos byte, retained bool, payload interface{}) Token
+	// PublishWithProperties is like Publish but also sends the given MQTT 5
+	// properties (for example the message expiry interval or user properties).
+	// The properties are ignored when connected with an older protocol version.
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *packets.Properties) Token
 	// Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 	// a message is published on the topic provided, or nil for the default handler
 	Subscribe(topic string, qos byte, callback MessageHandler) Token
@@ -99,6 +105,12 @@ type client struct {
 	conn   net.Conn   // the network connection, must only be set with connMu locked (only used when starting/stopping workers)
 	connMu sync.Mutex // mutex for the connection (again only used in two functions)
 
+	serverProps   *packets.Properties // CONNACK properties of the current connection (MQTT 5 only)
+	serverPropsMu sync.RWMutex
+
+	broker atomic.Value // string - the broker of the current (or last) connection, without credentials
+	logs   *loggers     // level loggers of this client, see ClientOptions.SetLogger
+
 	stop         chan struct{}  // Closed to request that workers stop
 	workers      sync.WaitGroup // used to wait for workers to complete (ping, keepalive, errwatch, resume)
 	commsStopped chan struct{}  // closed when the comms routines have stopped (kept running until after workers have closed to avoid deadlocks)
@@ -116,7 +128,7 @@ func NewClient(o *ClientOptions) Client {
 		c.options.Store = NewMemoryStore()
 	}
 	switch c.options.ProtocolVersion {
-	case 3, 4:
+	case 3, 4, packets.ProtocolVersion5:
 		c.options.protocolVersionExplicit = true
 	case 0x83, 0x84:
 		c.options.protocolVersionExplicit = true
@@ -124,16 +136,47 @@ func NewClient(o *ClientOptions) Client {
 		c.options.ProtocolVersion = 4
 		c.options.protocolVersionExplicit = false
 	}
+	c.logs = packageLoggers
+	if c.options.Logger != nil {
+		c.logs = newLoggers(c.options.Logger, c.options.LogLevel, c.logFields)
+	}
 	c.persist = c.options.Store
+	if s, ok := c.persist.(VersionedStore); ok {
+		s.SetProtocolVersion(c.protocolVersion())
+	}
+	if s, ok := c.persist.(loggedStore); ok {
+		s.setLoggers(c.logs)
+	}
 	c.status = disconnected
-	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor)}
+	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor), logs: c.logs}
 	c.msgRouter = newRouter()
 	c.msgRouter.setDefaultHandler(c.options.DefaultPublishHandler)
 	c.obound = make(chan *PacketAndToken)
 	c.oboundP = make(chan *PacketAndToken)
+	c.broker.Store("")
 	return c
 }
 
+// loggers returns the level loggers of the client
+func (c *client) loggers() *loggers {
+	return c.logs
+}
+
+// logFields are the fields added to every entry when a structured logger is set
+func (c *client) logFields() logger.Fields {
+	return logger.Fields{
+		"clientID": c.options.ClientID,
+		"broker":   c.broker.Load(),
+	}
+}
+
+// redactBroker returns the broker URL without credentials, for logging
+func redactBroker(broker *url.URL) string {
+	u := *broker
+	u.User = nil
+	return u.String()
+}
+
 // AddRoute allows you to add a handler for messages on a specific topic
 // without making a subscription. For example having a different handler
 // for parts of a wildcard subscription
@@ -202,13 +245,13 @@ var ErrNotConnected = errors.New("not Connected")
 // because queued messages may be delivered immediately post connection
 func (c *client) Connect() Token {
 	t := newToken(packets.Connect).(*ConnectToken)
-	DEBUG.Println(CLI, "Connect()")
+	c.logs.DEBUG.Println(CLI, "Connect()")
 
 	if c.options.ConnectRetry && atomic.LoadUint32(&c.status) != disconnected {
 		// if in any state other than disconnected and ConnectRetry is
 		// enabled then the connection will come up automatically
 		// client can assume connection is up
-		WARN.Println(CLI, "Connect() called but not disconnected")
+		c.logs.WARN.Println(CLI, "Connect() called but not disconnected")
 		t.returnCode = packets.Accepted
 		t.flowComplete()
 		return t
@@ -233,14 +276,14 @@ func (c *client) Connect() Token {
 		conn, rc, t.sessionPresent, err = c.attemptConnection()
 		if err != nil {
 			if c.options.ConnectRetry {
-				DEBUG.Println(CLI, "Connect failed, sleeping for", int(c.options.ConnectRetryInterval.Seconds()), "seconds and will then retry")
+				c.logs.DEBUG.Println(CLI, "Connect failed, sleeping for", int(c.options.ConnectRetryInterval.Seconds()), "seconds and will then retry")
 				time.Sleep(c.options.ConnectRetryInterval)
 
 				if atomic.LoadUint32(&c.status) == connecting {
 					goto RETRYCONN
 				}
 			}
-			ERROR.Println(CLI, "Failed to connect to a broker")
+			c.logs.ERROR.Println(CLI, "Failed to connect to a broker")
 			c.setConnected(disconnected)
 			c.persist.Close()
 			t.returnCode = rc
@@ -256,34 +299,40 @@ func (c *client) Connect() Token {
 				c.persist.Reset()
 			}
 		} else {
-			WARN.Println(CLI, "Connect() called but connection established in another goroutine")
+			c.logs.WARN.Println(CLI, "Connect() called but connection established in another goroutine")
 		}
 
 		close(inboundFromStore)
+		t.m.Lock()
+		t.properties = c.serverProperties()
+		t.m.Unlock()
 		t.flowComplete()
-		DEBUG.Println(CLI, "exit startClient")
+		c.logs.DEBUG.Println(CLI, "exit startClient")
 	}()
 	return t
 }
 
 // internal function used to reconnect the client when it loses its connection
 func (c *client) reconnect() {
-	DEBUG.Println(CLI, "enter reconnect")
+	c.logs.DEBUG.Println(CLI, "enter reconnect")
 	var (
-		sleep = 1 * time.Second
-		conn  net.Conn
+		sleep   = 1 * time.Second
+		conn    net.Conn
+		attempt = 0
 	)
 
 	for {
 		if nil != c.options.OnReconnecting {
 			c.options.OnReconnecting(c, &c.options)
 		}
+		attempt++
+		c.logs.INFO.Println(CLI, "reconnecting", logger.Fields{"attempt": attempt})
 		var err error
 		conn, _, _, err = c.attemptConnection()
 		if err == nil {
 			break
 		}
-		DEBUG.Println(CLI, "Reconnect failed, sleeping for", int(sleep.Seconds()), "seconds:", err)
+		c.logs.WARN.Println(CLI, "reconnect failed", logger.Fields{"attempt": attempt, "retryIn": sleep.String(), "error": err.Error()})
 		time.Sleep(sleep)
 		if sleep < c.options.MaxReconnectInterval {
 			sleep *= 2
@@ -303,7 +352,7 @@ func (c *client) reconnect() {
 		if conn != nil {
 			conn.Close()
 		}
-		DEBUG.Println(CLI, "Client moved to disconnected state while reconnecting, abandoning reconnect")
+		c.logs.DEBUG.Println(CLI, "Client moved to disconnected state while reconnecting, abandoning reconnect")
 		return
 	}
 
@@ -329,28 +378,42 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 		conn           net.Conn
 		err            error
 		rc             byte
+		props          *packets.Properties
 	)
 
 	c.optionsMu.Lock() // Protect c.options.Servers so that servers can be added in test cases
 	brokers := c.options.Servers
 	c.optionsMu.Unlock()
+	if c.options.BrokerSelector != nil {
+		brokers = c.options.BrokerSelector(brokers)
+	}
+	rc = packets.ErrNetworkError
+	err = errors.New("no broker selected")
 	for _, broker := range brokers {
 		cm := newConnectMsgFromOptions(&c.options, broker)
-		DEBUG.Println(CLI, "about to write new connect msg")
+		tlsCfg := c.options.TLSConfig
+		if c.options.OnConnectAttempt != nil {
+			c.logs.DEBUG.Println(CLI, "using custom onConnectAttempt handler...")
+			tlsCfg = c.options.OnConnectAttempt(broker, c.options.TLSConfig)
+		}
+		fields := logger.Fields{"broker": redactBroker(broker)}
+		c.logs.INFO.Println(CLI, "connecting to broker", fields)
+		c.logs.DEBUG.Println(CLI, "about to write new connect msg")
 	CONN:
 		// Start by opening the network connection (tcp, tls, ws) etc
-		conn, err = openConnection(broker, c.options.TLSConfig, c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions)
+		conn, err = openConnection(broker, tlsCfg, c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions, c.options.Dialer)
 		if err != nil {
-			ERROR.Println(CLI, err.Error())
-			WARN.Println(CLI, "failed to connect to broker, trying next")
+			c.logs.WARN.Println(CLI, "failed to connect to broker, trying next", fields, logger.Fields{"error": err.Error()})
 			rc = packets.ErrNetworkError
 			continue
 		}
-		DEBUG.Println(CLI, "socket connected to broker")
+		c.logs.DEBUG.Println(CLI, "socket connected to broker")
 
 		// Now we send the perform the MQTT connection handshake
-		rc, sessionPresent, err = connectMQTT(conn, cm, protocolVersion)
+		rc, sessionPresent, props, err = connectMQTT(conn, cm, protocolVersion, c.logs)
 		if rc == packets.Accepted {
+			c.broker.Store(redactBroker(broker))
+			c.logs.INFO.Println(CLI, "connected to broker", fields, logger.Fields{"sessionPresent": sessionPresent, "protocolVersion": protocolVersion})
 			break // successfully connected
 		}
 
@@ -359,21 +422,28 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 			conn.Close()
 		}
 		if !c.options.protocolVersionExplicit && protocolVersion == 4 { // try falling back to 3.1?
-			DEBUG.Println(CLI, "Trying reconnect using MQTT 3.1 protocol")
+			c.logs.DEBUG.Println(CLI, "Trying reconnect using MQTT 3.1 protocol")
 			protocolVersion = 3
 			goto CONN
 		}
-		if c.options.protocolVersionExplicit { // to maintain logging from previous version
-			ERROR.Println(CLI, "Connecting to", broker, "CONNACK was not CONN_ACCEPTED, but rather", packets.ConnackReturnCodes[rc])
+		if protocolVersion == packets.ProtocolVersion5 {
+			c.logs.ERROR.Println(CLI, "CONNACK was not Success, but rather", packets.NewReasonError(rc, props), fields)
+		} else if c.options.protocolVersionExplicit { // to maintain logging from previous version
+			c.logs.ERROR.Println(CLI, "CONNACK was not CONN_ACCEPTED, but rather", packets.ConnackReturnCodes[rc], fields)
 		}
 	}
 	// If the connection was successful we set member variable and lock in the protocol version for future connection attempts (and users)
 	if rc == packets.Accepted {
 		c.options.ProtocolVersion = protocolVersion
 		c.options.protocolVersionExplicit = true
+		c.serverPropsMu.Lock()
+		c.serverProps = props
+		c.serverPropsMu.Unlock()
 	} else {
 		// Maintain same error format as used previously
-		if rc != packets.ErrNetworkError { // mqtt error
+		if rc != packets.ErrNetworkError && protocolVersion == packets.ProtocolVersion5 {
+			err = packets.NewReasonError(rc, props)
+		} else if rc != packets.ErrNetworkError { // mqtt error
 			err = packets.ConnErrors[rc]
 		} else { // network error (if this occurred in ConnectMQTT then err will be nil)
 			err = fmt.Errorf("%s : %s", packets.ConnErrors[rc], err)
@@ -388,19 +458,19 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 func (c *client) Disconnect(quiesce uint) {
 	status := atomic.LoadUint32(&c.status)
 	if status == connected {
-		DEBUG.Println(CLI, "disconnecting")
+		c.logs.DEBUG.Println(CLI, "disconnecting")
 		c.setConnected(disconnected)
 
-		dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+		dm := packets.NewControlPacketWithVersion(packets.Disconnect, c.protocolVersion()).(*packets.DisconnectPacket)
 		dt := newToken(packets.Disconnect)
 		c.oboundP <- &PacketAndToken{p: dm, t: dt}
 
 		// wait for work to finish, or quiesce time consumed
-		DEBUG.Println(CLI, "calling WaitTimeout")
+		c.logs.DEBUG.Println(CLI, "calling WaitTimeout")
 		dt.WaitTimeout(time.Duration(quiesce) * time.Millisecond)
-		DEBUG.Println(CLI, "WaitTimeout done")
+		c.logs.DEBUG.Println(CLI, "WaitTimeout done")
 	} else {
-		WARN.Println(CLI, "Disconnect() called but not connected (disconnected/reconnecting)")
+		c.logs.WARN.Println(CLI, "Disconnect() called but not connected (disconnected/reconnecting)")
 		c.setConnected(disconnected)
 	}
 
@@ -410,11 +480,11 @@ func (c *client) Disconnect(quiesce uint) {
 // forceDisconnect will end the connection with the mqtt broker immediately (used for tests only)
 func (c *client) forceDisconnect() {
 	if !c.IsConnected() {
-		WARN.Println(CLI, "already disconnected")
+		c.logs.WARN.Println(CLI, "already disconnected")
 		return
 	}
 	c.setConnected(disconnected)
-	DEBUG.Println(CLI, "forcefully disconnecting")
+	c.logs.DEBUG.Println(CLI, "forcefully disconnecting")
 	c.disconnect()
 }
 
@@ -423,9 +493,9 @@ func (c *client) disconnect() {
 	done := c.stopCommsWorkers()
 	if done != nil {
 		<-done // Wait until the disconnect is complete (to limit chance that another connection will be started)
-		DEBUG.Println(CLI, "forcefully disconnecting")
+		c.logs.DEBUG.Println(CLI, "forcefully disconnecting")
 		c.messageIds.cleanUp()
-		DEBUG.Println(CLI, "disconnected")
+		c.logs.DEBUG.Println(CLI, "disconnected")
 		c.persist.Close()
 	}
 }
@@ -436,13 +506,16 @@ func (c *client) internalConnLost(err error) {
 	// It is possible that internalConnLost will be called multiple times simultaneously
 	// (including after sending a DisconnectPacket) as such we only do cleanup etc if the
 	// routines were actually running and are not being disconnected at users request
-	DEBUG.Println(CLI, "internalConnLost called")
+	c.logs.DEBUG.Println(CLI, "internalConnLost called")
+	if c.connectionStatus() == connected {
+		c.logs.INFO.Println(CLI, "connection lost", logger.Fields{"error": fmt.Sprint(err)})
+	}
 	stopDone := c.stopCommsWorkers()
 	if stopDone != nil { // stopDone will be nil if workers already in the process of stopping or stopped
 		go func() {
-			DEBUG.Println(CLI, "internalConnLost waiting on workers")
+			c.logs.DEBUG.Println(CLI, "internalConnLost waiting on workers")
 			<-stopDone
-			DEBUG.Println(CLI, "internalConnLost workers stopped")
+			c.logs.DEBUG.Println(CLI, "internalConnLost workers stopped")
 			if c.options.CleanSession && !c.options.AutoReconnect {
 				c.messageIds.cleanUp()
 			}
@@ -455,7 +528,7 @@ func (c *client) internalConnLost(err error) {
 			if c.options.OnConnectionLost != nil {
 				go c.options.OnConnectionLost(c, err)
 			}
-			DEBUG.Println(CLI, "internalConnLost complete")
+			c.logs.DEBUG.Println(CLI, "internalConnLost complete")
 		}()
 	}
 }
@@ -464,18 +537,18 @@ func (c *client) internalConnLost(err error) {
 // outgoing messages.
 // Returns true if the comms workers were started (i.e. they were not already running)
 func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packets.ControlPacket) bool {
-	DEBUG.Println(CLI, "startCommsWorkers called")
+	c.logs.DEBUG.Println(CLI, "startCommsWorkers called")
 	c.connMu.Lock()
 	defer c.connMu.Unlock()
 	if c.conn != nil {
-		WARN.Println(CLI, "startCommsWorkers called when commsworkers already running")
+		c.logs.WARN.Println(CLI, "startCommsWorkers called when commsworkers already running")
 		conn.Close() // No use for the new network connection
 		return false
 	}
 	c.conn = conn // Store the connection
 
 	c.stop = make(chan struct{})
-	if c.options.KeepAlive != 0 {
+	if c.keepAlive() != 0 {
 		atomic.StoreInt32(&c.pingOutstanding, 0)
 		c.lastReceived.Store(time.Now())
 		c.lastSent.Store(time.Now())
@@ -490,7 +563,7 @@ func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packet
 	ackOut := c.msgRouter.matchAndDispatch(incomingPubChan, c.options.Order, c)
 
 	c.setConnected(connected)
-	DEBUG.Println(CLI, "client is connected/reconnected")
+	c.logs.DEBUG.Println(CLI, "client is connected/reconnected")
 	if c.options.OnConnect != nil {
 		go c.options.OnConnect(c)
 	}
@@ -527,7 +600,7 @@ func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packet
 				}
 				close(commsoboundP) // Nothing sending to these channels anymore so close them and allow comms routines to exit
 				close(commsobound)
-				DEBUG.Println(CLI, "startCommsWorkers output redirector finished")
+				c.logs.DEBUG.Println(CLI, "startCommsWorkers output redirector finished")
 				return
 			}
 		}
@@ -554,15 +627,15 @@ func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packet
 					commsErrors = nil
 					continue
 				}
-				ERROR.Println(CLI, "Connect comms goroutine - error triggered", err)
+				c.logs.ERROR.Println(CLI, "Connect comms goroutine - error triggered", err)
 				c.internalConnLost(err) // no harm in calling this if the connection is already down (or shutdown is in progress)
 				continue
 			}
 		}
-		DEBUG.Println(CLI, "incoming comms goroutine done")
+		c.logs.DEBUG.Println(CLI, "incoming comms goroutine done")
 		close(c.commsStopped)
 	}()
-	DEBUG.Println(CLI, "startCommsWorkers done")
+	c.logs.DEBUG.Println(CLI, "startCommsWorkers done")
 	return true
 }
 
@@ -570,11 +643,11 @@ func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packet
 // Returns nil it workers did not need to be stopped; otherwise returns a channel which will be closed when the stop is complete
 // Note: This may block so run as a go routine if calling from any of the comms routines
 func (c *client) stopCommsWorkers() chan struct{} {
-	DEBUG.Println(CLI, "stopCommsWorkers called")
+	c.logs.DEBUG.Println(CLI, "stopCommsWorkers called")
 	// It is possible that this function will be called multiple times simultaneously due to the way things get shutdown
 	c.connMu.Lock()
 	if c.conn == nil {
-		DEBUG.Println(CLI, "stopCommsWorkers done (not running)")
+		c.logs.DEBUG.Println(CLI, "stopCommsWorkers done (not running)")
 		c.connMu.Unlock()
 		return nil
 	}
@@ -594,14 +667,14 @@ func (c *client) stopCommsWorkers() chan struct{} {
 	doneChan := make(chan struct{})
 
 	go func() {
-		DEBUG.Println(CLI, "stopCommsWorkers waiting for workers")
+		c.logs.DEBUG.Println(CLI, "stopCommsWorkers waiting for workers")
 		c.workers.Wait()
 
 		// Stopping the workers will allow the comms routines to exit; we wait for these to complete
-		DEBUG.Println(CLI, "stopCommsWorkers waiting for comms")
+		c.logs.DEBUG.Println(CLI, "stopCommsWorkers waiting for comms")
 		<-c.commsStopped // wait for comms routine to stop
 
-		DEBUG.Println(CLI, "stopCommsWorkers done")
+		c.logs.DEBUG.Println(CLI, "stopCommsWorkers done")
 		close(doneChan)
 	}()
 	return doneChan
@@ -611,8 +684,16 @@ func (c *client) stopCommsWorkers() chan struct{} {
 // to the specified topic.
 // Returns a token to track delivery of the message to the broker
 func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	return c.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishWithProperties will publish a message with the specified QoS, content
+// and MQTT 5 properties to the specified topic.
+// Returns a token to track delivery of the message to the broker, with MQTT 5 the
+// token fails if the broker acknowledges the message with a failure reason code
+func (c *client) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *packets.Properties) Token {
 	token := newToken(packets.Publish).(*PublishToken)
-	DEBUG.Println(CLI, "enter Publish")
+	c.logs.DEBUG.Println(CLI, "enter Publish")
 	switch {
 	case !c.IsConnected():
 		token.setError(ErrNotConnected)
@@ -621,10 +702,13 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		token.flowComplete()
 		return token
 	}
-	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub := packets.NewControlPacketWithVersion(packets.Publish, c.protocolVersion()).(*packets.PublishPacket)
 	pub.Qos = qos
 	pub.TopicName = topic
 	pub.Retain = retained
+	if pub.Version == packets.ProtocolVersion5 {
+		pub.Properties = props
+	}
 	switch p := payload.(type) {
 	case string:
 		pub.Payload = []byte(p)
@@ -646,14 +730,15 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		pub.MessageID = mID
 		token.messageID = mID
 	}
-	persistOutbound(c.persist, pub)
+	persistOutbound(c.persist, pub, c.logs)
+	fields := logger.Fields{"topic": topic, "qos": qos, "messageID": pub.MessageID}
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing publish message (connecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing publish message (connecting)", fields)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing publish message (reconnecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing publish message (reconnecting)", fields)
 	default:
-		DEBUG.Println(CLI, "sending publish message, topic:", topic)
+		c.logs.DEBUG.Println(CLI, "sending publish message", fields)
 		publishWaitTimeout := c.options.WriteTimeout
 		if publishWaitTimeout == 0 {
 			publishWaitTimeout = time.Second * 30
@@ -676,7 +761,7 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 // other message handlers.
 func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Token {
 	token := newToken(packets.Subscribe).(*SubscribeToken)
-	DEBUG.Println(CLI, "enter Subscribe")
+	c.logs.DEBUG.Println(CLI, "enter Subscribe")
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
 		return token
@@ -693,7 +778,7 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 			return token
 		}
 	}
-	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub := packets.NewControlPacketWithVersion(packets.Subscribe, c.protocolVersion()).(*packets.SubscribePacket)
 	if err := validateTopicAndQos(topic, qos); err != nil {
 		token.setError(err)
 		return token
@@ -724,16 +809,16 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		sub.MessageID = mID
 		token.messageID = mID
 	}
-	DEBUG.Println(CLI, sub.String())
+	c.logs.DEBUG.Println(CLI, sub.String())
 
-	persistOutbound(c.persist, sub)
+	persistOutbound(c.persist, sub, c.logs)
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing subscribe message (connecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (connecting), topic:", topic)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing subscribe message (reconnecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (reconnecting), topic:", topic)
 	default:
-		DEBUG.Println(CLI, "sending subscribe message, topic:", topic)
+		c.logs.DEBUG.Println(CLI, "sending subscribe message, topic:", topic)
 		subscribeWaitTimeout := c.options.WriteTimeout
 		if subscribeWaitTimeout == 0 {
 			subscribeWaitTimeout = time.Second * 30
@@ -744,7 +829,7 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 			token.setError(errors.New("subscribe was broken by timeout"))
 		}
 	}
-	DEBUG.Println(CLI, "exit Subscribe")
+	c.logs.DEBUG.Println(CLI, "exit Subscribe")
 	return token
 }
 
@@ -753,7 +838,7 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHandler) Token {
 	var err error
 	token := newToken(packets.Subscribe).(*SubscribeToken)
-	DEBUG.Println(CLI, "enter SubscribeMultiple")
+	c.logs.DEBUG.Println(CLI, "enter SubscribeMultiple")
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
 		return token
@@ -770,7 +855,7 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 			return token
 		}
 	}
-	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub := packets.NewControlPacketWithVersion(packets.Subscribe, c.protocolVersion()).(*packets.SubscribePacket)
 	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters); err != nil {
 		token.setError(err)
 		return token
@@ -793,14 +878,14 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		sub.MessageID = mID
 		token.messageID = mID
 	}
-	persistOutbound(c.persist, sub)
+	persistOutbound(c.persist, sub, c.logs)
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing subscribe message (connecting), topics:", sub.Topics)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (connecting), topics:", sub.Topics)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing subscribe message (reconnecting), topics:", sub.Topics)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (reconnecting), topics:", sub.Topics)
 	default:
-		DEBUG.Println(CLI, "sending subscribe message, topics:", sub.Topics)
+		c.logs.DEBUG.Println(CLI, "sending subscribe message, topics:", sub.Topics)
 		subscribeWaitTimeout := c.options.WriteTimeout
 		if subscribeWaitTimeout == 0 {
 			subscribeWaitTimeout = time.Second * 30
@@ -811,7 +896,7 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 			token.setError(errors.New("subscribe was broken by timeout"))
 		}
 	}
-	DEBUG.Println(CLI, "exit SubscribeMultiple")
+	c.logs.DEBUG.Println(CLI, "exit SubscribeMultiple")
 	return token
 }
 
@@ -842,13 +927,13 @@ func (c *client) reserveStoredPublishIDs() {
 // Note: This function will exit if c.stop is closed (this allows the shutdown to proceed avoiding a potential deadlock)
 //
 func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
-	DEBUG.Println(STR, "enter Resume")
+	c.logs.DEBUG.Println(STR, "enter Resume")
 
 	storedKeys := c.persist.All()
 	for _, key := range storedKeys {
 		packet := c.persist.Get(key)
 		if packet == nil {
-			DEBUG.Println(STR, fmt.Sprintf("resume found NIL packet (%s)", key))
+			c.logs.DEBUG.Println(STR, fmt.Sprintf("resume found NIL packet (%s)", key))
 			continue
 		}
 		details := packet.Details()
@@ -856,7 +941,7 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 			switch packet.(type) {
 			case *packets.SubscribePacket:
 				if subscription {
-					DEBUG.Println(STR, fmt.Sprintf("loaded pending subscribe (%d)", details.MessageID))
+					c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending subscribe (%d)", details.MessageID))
 					subPacket := packet.(*packets.SubscribePacket)
 					token := newToken(packets.Subscribe).(*SubscribeToken)
 					token.messageID = details.MessageID
@@ -865,7 +950,7 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 					select {
 					case c.oboundP <- &PacketAndToken{p: packet, t: token}:
 					case <-c.stop:
-						DEBUG.Println(STR, "resume exiting due to stop")
+						c.logs.DEBUG.Println(STR, "resume exiting due to stop")
 						return
 					}
 				} else {
@@ -873,58 +958,58 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 				}
 			case *packets.UnsubscribePacket:
 				if subscription {
-					DEBUG.Println(STR, fmt.Sprintf("loaded pending unsubscribe (%d)", details.MessageID))
+					c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending unsubscribe (%d)", details.MessageID))
 					token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
 					select {
 					case c.oboundP <- &PacketAndToken{p: packet, t: token}:
 					case <-c.stop:
-						DEBUG.Println(STR, "resume exiting due to stop")
+						c.logs.DEBUG.Println(STR, "resume exiting due to stop")
 						return
 					}
 				} else {
 					c.persist.Del(key) // Unsubscribe packets should not be retained following a reconnect
 				}
 			case *packets.PubrelPacket:
-				DEBUG.Println(STR, fmt.Sprintf("loaded pending pubrel (%d)", details.MessageID))
+				c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending pubrel (%d)", details.MessageID))
 				select {
 				case c.oboundP <- &PacketAndToken{p: packet, t: nil}:
 				case <-c.stop:
-					DEBUG.Println(STR, "resume exiting due to stop")
+					c.logs.DEBUG.Println(STR, "resume exiting due to stop")
 					return
 				}
 			case *packets.PublishPacket:
 				token := newToken(packets.Publish).(*PublishToken)
 				token.messageID = details.MessageID
 				c.claimID(token, details.MessageID)
-				DEBUG.Println(STR, fmt.Sprintf("loaded pending publish (%d)", details.MessageID))
-				DEBUG.Println(STR, details)
+				c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending publish (%d)", details.MessageID))
+				c.logs.DEBUG.Println(STR, details)
 				select {
 				case c.obound <- &PacketAndToken{p: packet, t: token}:
 				case <-c.stop:
-					DEBUG.Println(STR, "resume exiting due to stop")
+					c.logs.DEBUG.Println(STR, "resume exiting due to stop")
 					return
 				}
 			default:
-				ERROR.Println(STR, "invalid message type in store (discarded)")
+				c.logs.ERROR.Println(STR, "invalid message type in store (discarded)")
 				c.persist.Del(key)
 			}
 		} else {
 			switch packet.(type) {
 			case *packets.PubrelPacket:
-				DEBUG.Println(STR, fmt.Sprintf("loaded pending incomming (%d)", details.MessageID))
+				c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending incomming (%d)", details.MessageID))
 				select {
 				case ibound <- packet:
 				case <-c.stop:
-					DEBUG.Println(STR, "resume exiting due to stop (ibound <- packet)")
+					c.logs.DEBUG.Println(STR, "resume exiting due to stop (ibound <- packet)")
 					return
 				}
 			default:
-				ERROR.Println(STR, "invalid message type in store (discarded)")
+				c.logs.ERROR.Println(STR, "invalid message type in store (discarded)")
 				c.persist.Del(key)
 			}
 		}
 	}
-	DEBUG.Println(STR, "exit resume")
+	c.logs.DEBUG.Println(STR, "exit resume")
 }
 
 // Unsubscribe will end the subscription from each of the topics provided.
@@ -932,7 +1017,7 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 // received.
 func (c *client) Unsubscribe(topics ...string) Token {
 	token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
-	DEBUG.Println(CLI, "enter Unsubscribe")
+	c.logs.DEBUG.Println(CLI, "enter Unsubscribe")
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
 		return token
@@ -949,7 +1034,7 @@ func (c *client) Unsubscribe(topics ...string) Token {
 			return token
 		}
 	}
-	unsub := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	unsub := packets.NewControlPacketWithVersion(packets.Unsubscribe, c.protocolVersion()).(*packets.UnsubscribePacket)
 	unsub.Topics = make([]string, len(topics))
 	copy(unsub.Topics, topics)
 
@@ -963,15 +1048,15 @@ func (c *client) Unsubscribe(topics ...string) Token {
 		token.messageID = mID
 	}
 
-	persistOutbound(c.persist, unsub)
+	persistOutbound(c.persist, unsub, c.logs)
 
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing unsubscribe message (connecting), topics:", topics)
+		c.logs.DEBUG.Println(CLI, "storing unsubscribe message (connecting), topics:", topics)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing unsubscribe message (reconnecting), topics:", topics)
+		c.logs.DEBUG.Println(CLI, "storing unsubscribe message (reconnecting), topics:", topics)
 	default:
-		DEBUG.Println(CLI, "sending unsubscribe message, topics:", topics)
+		c.logs.DEBUG.Println(CLI, "sending unsubscribe message, topics:", topics)
 		subscribeWaitTimeout := c.options.WriteTimeout
 		if subscribeWaitTimeout == 0 {
 			subscribeWaitTimeout = time.Second * 30
@@ -986,7 +1071,7 @@ func (c *client) Unsubscribe(topics ...string) Token {
 		}
 	}
 
-	DEBUG.Println(CLI, "exit Unsubscribe")
+	c.logs.DEBUG.Println(CLI, "exit Unsubscribe")
 	return token
 }
 
@@ -999,8 +1084,12 @@ func (c *client) OptionsReader() ClientOptionsReader {
 
 // DefaultConnectionLostHandler is a definition of a function that simply
 // reports to the DEBUG log the reason for the client losing a connection.
-func DefaultConnectionLostHandler(client Client, reason error, args ...interface{}) {
-	DEBUG.Println("Connection lost:", reason.Error())
+func DefaultConnectionLostHandler(c Client, reason error, args ...interface{}) {
+	logs := packageLoggers
+	if cl, ok := c.(*client); ok {
+		logs = cl.logs
+	}
+	logs.DEBUG.Println("Connection lost:", reason.Error())
 }
 
 // UpdateLastReceived - Will be called whenever a packet is received off the network
@@ -1025,12 +1114,32 @@ func (c *client) getWriteTimeOut() time.Duration {
 
 // persistOutbound adds the packet to the outbound store
 func (c *client) persistOutbound(m packets.ControlPacket) {
-	persistOutbound(c.persist, m)
+	persistOutbound(c.persist, m, c.logs)
 }
 
 // persistInbound adds the packet to the inbound store
 func (c *client) persistInbound(m packets.ControlPacket) {
-	persistInbound(c.persist, m)
+	persistInbound(c.persist, m, c.logs)
+}
+
+// protocolVersion returns the protocol version packets are encoded with
+func (c *client) protocolVersion() byte {
+	return byte(c.options.ProtocolVersion)
+}
+
+// serverProperties returns the CONNACK properties of the current connection (MQTT 5 only)
+func (c *client) serverProperties() *packets.Properties {
+	c.serverPropsMu.RLock()
+	defer c.serverPropsMu.RUnlock()
+	return c.serverProps
+}
+
+// keepAlive returns the keep alive interval in seconds, an MQTT 5 server may override the requested value
+func (c *client) keepAlive() int64 {
+	if props := c.serverProperties(); props != nil && props.ServerKeepAlive != nil {
+		return int64(*props.ServerKeepAlive)
+	}
+	return c.options.KeepAlive
 }
 
 // pingRespReceived will be called by the network routines when a ping response is received
@@ -1,12 +1,17 @@
 package mqtt
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 	"sort"
+	"strings"
 	"sync"
 
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
 )
 
@@ -16,15 +21,28 @@ const (
 	corruptExt = ".CORRUPT"
 )
 
+// validKey matches the keys written by the client, "i.[messageid]" or "o.[messageid]"
+var validKey = regexp.MustCompile(`^[io]\.[0-9]+$`)
+
 // FileStore implements the store interface using the filesystem to provide
 // true persistence, even across client failure. This is designed to use a
 // single directory per running client. If you are running multiple clients
 // on the same filesystem, you will need to be careful to specify unique
 // store directories for each.
+//
+// Every packet is written to a temporary file which is synced before being
+// renamed into place, and the directory is synced after the rename, so a
+// power cut leaves either the old or the new packet. I/O errors are logged
+// rather than causing a panic, and files that cannot be decoded are renamed
+// with the .CORRUPT extension (quarantined) and no longer returned.
 type FileStore struct {
 	sync.RWMutex
-	directory string
-	opened    bool
+	directory  string
+	opened     bool
+	version    byte
+	maxPackets int   // 0 means no limit
+	maxBytes   int64 // 0 means no limit
+	logs       *loggers
 }
 
 // NewFileStore will create a new FileStore which stores its messages in the
@@ -33,11 +51,33 @@ func NewFileStore(directory string) *FileStore {
 	store := &FileStore{
 		directory: directory,
 		opened:    false,
+		logs:      packageLoggers,
 	}
 	return store
 }
 
+// setLoggers makes the store log through the loggers of the client using it
+func (store *FileStore) setLoggers(logs *loggers) {
+	store.Lock()
+	defer store.Unlock()
+	store.logs = logs
+}
+
+// SetLimits bounds the number of packets and their total size in bytes, 0
+// meaning no limit. When a Put would exceed a limit the oldest packets are
+// discarded; the client then does not resend them after a reconnect, so
+// limits should only be used when the application retries unacknowledged
+// messages itself.
+func (store *FileStore) SetLimits(maxPackets int, maxBytes int64) {
+	store.Lock()
+	defer store.Unlock()
+	store.maxPackets = maxPackets
+	store.maxBytes = maxBytes
+}
+
 // Open will allow the FileStore to be used.
+// Temporary files left by an interrupted write are removed and packets that
+// cannot be decoded are quarantined.
 func (store *FileStore) Open() {
 	store.Lock()
 	defer store.Unlock()
@@ -50,11 +90,23 @@ func (store *FileStore) Open() {
 	// if store dir exists, great, otherwise, create it
 	if !exists(store.directory) {
 		perms := os.FileMode(0770)
-		merr := os.MkdirAll(store.directory, perms)
-		chkerr(merr)
+		if err := os.MkdirAll(store.directory, perms); err != nil {
+			store.logs.ERROR.Println(STR, "store could not be created:", err, logger.Fields{"path": store.directory})
+			return
+		}
 	}
 	store.opened = true
-	DEBUG.Println(STR, "store is opened at", store.directory)
+	store.recover()
+	store.logs.DEBUG.Println(STR, "store is opened at", store.directory)
+}
+
+// SetProtocolVersion sets the protocol version used to decode the stored
+// packets. Packets are stored in their wire encoding, so a store written
+// by an MQTT 5 client cannot be read back as MQTT 3.1.1 and vice versa.
+func (store *FileStore) SetProtocolVersion(version byte) {
+	store.Lock()
+	defer store.Unlock()
+	store.version = version
 }
 
 // Close will disallow the FileStore from being used.
@@ -62,7 +114,7 @@ func (store *FileStore) Close() {
 	store.Lock()
 	defer store.Unlock()
 	store.opened = false
-	DEBUG.Println(STR, "store is closed")
+	store.logs.DEBUG.Println(STR, "store is closed")
 }
 
 // Put will put a message into the store, associated with the provided
@@ -71,40 +123,35 @@ func (store *FileStore) Put(key string, m packets.ControlPacket) {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		ERROR.Println(STR, "Trying to use file store, but not open")
+		store.logs.ERROR.Println(STR, "Trying to use file store, but not open")
+		return
+	}
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		store.logs.ERROR.Println(STR, "packet not encoded:", err, logger.Fields{"key": key})
 		return
 	}
-	full := fullpath(store.directory, key)
-	write(store.directory, key, m)
-	if !exists(full) {
-		ERROR.Println(STR, "file not created:", full)
+	store.evict(key, int64(buf.Len()))
+	if err := write(store.directory, key, buf.Bytes(), store.logs); err != nil {
+		store.logs.ERROR.Println(STR, "file not created:", err, logger.Fields{"key": key})
+		return
 	}
+	store.logs.DEBUG.Println(STR, "store put", logger.Fields{"key": key})
 }
 
 // Get will retrieve a message from the store, the one associated with
 // the provided key value.
 func (store *FileStore) Get(key string) packets.ControlPacket {
-	store.RLock()
-	defer store.RUnlock()
+	store.Lock()
+	defer store.Unlock()
 	if !store.opened {
-		ERROR.Println(STR, "trying to use file store, but not open")
+		store.logs.ERROR.Println(STR, "trying to use file store, but not open")
 		return nil
 	}
-	filepath := fullpath(store.directory, key)
-	if !exists(filepath) {
-		return nil
-	}
-	mfile, oerr := os.Open(filepath)
-	chkerr(oerr)
-	msg, rerr := packets.ReadPacket(mfile)
-	chkerr(mfile.Close())
-
-	// Message was unreadable, return nil
-	if rerr != nil {
-		newpath := corruptpath(store.directory, key)
-		WARN.Println(STR, "corrupted file detected:", rerr.Error(), "archived at:", newpath)
-		if err := os.Rename(filepath, newpath); err != nil {
-			ERROR.Println(STR, err)
+	msg, err := store.read(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			store.quarantine(key, err)
 		}
 		return nil
 	}
@@ -116,7 +163,8 @@ func (store *FileStore) Get(key string) packets.ControlPacket {
 func (store *FileStore) All() []string {
 	store.RLock()
 	defer store.RUnlock()
-	return store.all()
+	keys, _ := store.files()
+	return keys
 }
 
 // Del will remove the persisted message associated with the provided
@@ -131,59 +179,164 @@ func (store *FileStore) Del(key string) {
 func (store *FileStore) Reset() {
 	store.Lock()
 	defer store.Unlock()
-	WARN.Println(STR, "FileStore Reset")
-	for _, key := range store.all() {
+	store.logs.WARN.Println(STR, "FileStore Reset")
+	keys, _ := store.files()
+	for _, key := range keys {
 		store.del(key)
 	}
 }
 
 // lockless
-func (store *FileStore) all() []string {
-	var err error
-	var keys []string
-	var files fileInfos
+// read decodes the packet stored under key
+func (store *FileStore) read(key string) (packets.ControlPacket, error) {
+	data, err := ioutil.ReadFile(fullpath(store.directory, key))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty file")
+	}
+	reader := bytes.NewReader(data)
+	msg, err := packets.ReadPacketWithVersion(reader, store.version)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() != 0 {
+		return nil, errors.New("trailing data after packet")
+	}
+	return msg, nil
+}
+
+// lockless
+// quarantine renames an unreadable packet so that it is no longer returned
+// but is kept for inspection
+func (store *FileStore) quarantine(key string, reason error) {
+	newpath := corruptpath(store.directory, key)
+	store.logs.WARN.Println(STR, "corrupted file detected:", reason, "archived at:", newpath, logger.Fields{"key": key})
+	if err := os.Rename(fullpath(store.directory, key), newpath); err != nil {
+		store.logs.ERROR.Println(STR, "corrupted file not archived:", err, logger.Fields{"key": key})
+		return
+	}
+	syncDir(store.directory, store.logs)
+}
+
+// lockless
+// recover removes temporary files and quarantines packets that cannot be
+// decoded or whose name is not a valid key
+func (store *FileStore) recover() {
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		store.logs.ERROR.Println(STR, "store could not be read:", err, logger.Fields{"path": store.directory})
+		return
+	}
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case strings.HasSuffix(name, tmpExt):
+			store.logs.WARN.Println(STR, "removing interrupted write", logger.Fields{"file": name})
+			if err := os.Remove(path.Join(store.directory, name)); err != nil {
+				store.logs.ERROR.Println(STR, "file not deleted:", err, logger.Fields{"file": name})
+			}
+		case strings.HasSuffix(name, msgExt):
+			key := strings.TrimSuffix(name, msgExt)
+			if !validKey.MatchString(key) {
+				store.quarantine(key, errors.New("invalid key"))
+				continue
+			}
+			if _, err := store.read(key); err != nil {
+				store.quarantine(key, err)
+			}
+		}
+	}
+}
 
+// lockless
+// files returns the keys of the stored packets, oldest first, and their
+// total size in bytes
+func (store *FileStore) files() ([]string, int64) {
 	if !store.opened {
-		ERROR.Println(STR, "trying to use file store, but not open")
-		return nil
+		store.logs.ERROR.Println(STR, "trying to use file store, but not open")
+		return nil, 0
 	}
 
-	files, err = ioutil.ReadDir(store.directory)
-	chkerr(err)
-	sort.Sort(files)
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		store.logs.ERROR.Println(STR, "store could not be read:", err, logger.Fields{"path": store.directory})
+		return nil, 0
+	}
+	sort.Sort(fileInfos(files))
+	var keys []string
+	var size int64
 	for _, f := range files {
-		DEBUG.Println(STR, "file in All():", f.Name())
+		store.logs.DEBUG.Println(STR, "file in All():", f.Name())
 		name := f.Name()
-		if name[len(name)-4:] != msgExt {
-			DEBUG.Println(STR, "skipping file, doesn't have right extension: ", name)
+		if !strings.HasSuffix(name, msgExt) {
+			store.logs.DEBUG.Println(STR, "skipping file, doesn't have right extension: ", name)
+			continue
+		}
+		key := strings.TrimSuffix(name, msgExt) // remove file extension
+		if !validKey.MatchString(key) {
 			continue
 		}
-		key := name[0 : len(name)-4] // remove file extension
 		keys = append(keys, key)
+		size += f.Size()
+	}
+	return keys, size
+}
+
+// lockless
+// evict deletes the oldest packets until a packet of size bytes can be stored
+// under key without exceeding the limits
+func (store *FileStore) evict(key string, size int64) {
+	if store.maxPackets <= 0 && store.maxBytes <= 0 {
+		return
+	}
+	keys, total := store.files()
+	count := len(keys)
+	for _, k := range keys {
+		if k == key {
+			// replaced by the new packet
+			count--
+			if info, err := os.Stat(fullpath(store.directory, k)); err == nil {
+				total -= info.Size()
+			}
+		}
+	}
+	for _, k := range keys {
+		overPackets := store.maxPackets > 0 && count+1 > store.maxPackets
+		overBytes := store.maxBytes > 0 && total+size > store.maxBytes
+		if !overPackets && !overBytes {
+			return
+		}
+		if k == key {
+			continue
+		}
+		if info, err := os.Stat(fullpath(store.directory, k)); err == nil {
+			total -= info.Size()
+		}
+		store.logs.WARN.Println(STR, "store full, discarding oldest packet", logger.Fields{"key": k})
+		store.del(k)
+		count--
 	}
-	return keys
 }
 
 // lockless
 func (store *FileStore) del(key string) {
 	if !store.opened {
-		ERROR.Println(STR, "trying to use file store, but not open")
+		store.logs.ERROR.Println(STR, "trying to use file store, but not open")
 		return
 	}
-	DEBUG.Println(STR, "store del filepath:", store.directory)
-	DEBUG.Println(STR, "store delete key:", key)
 	filepath := fullpath(store.directory, key)
-	DEBUG.Println(STR, "path of deletion:", filepath)
-	if !exists(filepath) {
-		WARN.Println(STR, "store could not delete key:", key)
+	store.logs.DEBUG.Println(STR, "store delete", logger.Fields{"key": key, "path": filepath})
+	if err := os.Remove(filepath); err != nil {
+		if os.IsNotExist(err) {
+			store.logs.WARN.Println(STR, "store could not delete key", logger.Fields{"key": key})
+		} else {
+			store.logs.ERROR.Println(STR, "file not deleted:", err, logger.Fields{"key": key})
+		}
 		return
 	}
-	rerr := os.Remove(filepath)
-	chkerr(rerr)
-	DEBUG.Println(STR, "del msg:", key)
-	if exists(filepath) {
-		ERROR.Println(STR, "file not deleted:", filepath)
-	}
+	store.logs.DEBUG.Println(STR, "del msg", logger.Fields{"key": key})
 }
 
 func fullpath(store string, key string) string {
@@ -206,26 +359,49 @@ func corruptpath(store string, key string) string {
 // rename it to "X.[messageid].msg", overwriting any existing
 // message with the same id
 // X will be 'i' for inbound messages, and O for outbound messages
-func write(store, key string, m packets.ControlPacket) {
+// The file is synced before the rename and the directory after it, so
+// that the packet survives a power cut once write returns
+func write(store, key string, data []byte, logs *loggers) error {
 	temppath := tmppath(store, key)
 	f, err := os.Create(temppath)
-	chkerr(err)
-	werr := m.Write(f)
-	chkerr(werr)
-	cerr := f.Close()
-	chkerr(cerr)
-	rerr := os.Rename(temppath, fullpath(store, key))
-	chkerr(rerr)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(temppath)
+		return err
+	}
+	if err := os.Rename(temppath, fullpath(store, key)); err != nil {
+		os.Remove(temppath)
+		return err
+	}
+	syncDir(store, logs)
+	return nil
 }
 
-func exists(file string) bool {
-	if _, err := os.Stat(file); err != nil {
-		if os.IsNotExist(err) {
-			return false
-		}
-		chkerr(err)
+// syncDir makes a rename in the directory durable
+func syncDir(directory string, logs *loggers) {
+	d, err := os.Open(directory)
+	if err != nil {
+		logs.ERROR.Println(STR, "directory not synced:", err)
+		return
+	}
+	if err := d.Sync(); err != nil {
+		logs.DEBUG.Println(STR, "directory not synced:", err)
 	}
-	return true
+	d.Close()
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
 }
 
 type fileInfos []os.FileInfo
@@ -3,6 +3,7 @@ package mqtt
 import (
 	"sync"
 
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
 )
 
@@ -13,6 +14,7 @@ type MemoryStore struct {
 	sync.RWMutex
 	messages map[string]packets.ControlPacket
 	opened   bool
+	logs     *loggers
 }
 
 // NewMemoryStore returns a pointer to a new instance of
@@ -22,16 +24,24 @@ func NewMemoryStore() *MemoryStore {
 	store := &MemoryStore{
 		messages: make(map[string]packets.ControlPacket),
 		opened:   false,
+		logs:     packageLoggers,
 	}
 	return store
 }
 
+// setLoggers makes the store log through the loggers of the client using it
+func (store *MemoryStore) setLoggers(logs *loggers) {
+	store.Lock()
+	defer store.Unlock()
+	store.logs = logs
+}
+
 // Open initializes a MemoryStore instance.
 func (store *MemoryStore) Open() {
 	store.Lock()
 	defer store.Unlock()
 	store.opened = true
-	DEBUG.Println(STR, "memorystore initialized")
+	store.logs.DEBUG.Println(STR, "memorystore initialized")
 }
 
 // Put takes a key and a pointer to a Message and stores the
@@ -40,7 +50,7 @@ func (store *MemoryStore) Put(key string, message packets.ControlPacket) {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		ERROR.Println(STR, "Trying to use memory store, but not open")
+		store.logs.ERROR.Println(STR, "Trying to use memory store, but not open")
 		return
 	}
 	store.messages[key] = message
@@ -52,15 +62,15 @@ func (store *MemoryStore) Get(key string) packets.ControlPacket {
 	store.RLock()
 	defer store.RUnlock()
 	if !store.opened {
-		ERROR.Println(STR, "Trying to use memory store, but not open")
+		store.logs.ERROR.Println(STR, "Trying to use memory store, but not open")
 		return nil
 	}
 	mid := mIDFromKey(key)
 	m := store.messages[key]
 	if m == nil {
-		CRITICAL.Println(STR, "memorystore get: message", mid, "not found")
+		store.logs.CRITICAL.Println(STR, "memorystore get: message not found", logger.Fields{"key": mid})
 	} else {
-		DEBUG.Println(STR, "memorystore get: message", mid, "found")
+		store.logs.DEBUG.Println(STR, "memorystore get: message found", logger.Fields{"key": mid})
 	}
 	return m
 }
@@ -71,7 +81,7 @@ func (store *MemoryStore) All() []string {
 	store.RLock()
 	defer store.RUnlock()
 	if !store.opened {
-		ERROR.Println(STR, "Trying to use memory store, but not open")
+		store.logs.ERROR.Println(STR, "Trying to use memory store, but not open")
 		return nil
 	}
 	var keys []string
@@ -87,16 +97,16 @@ func (store *MemoryStore) Del(key string) {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		ERROR.Println(STR, "Trying to use memory store, but not open")
+		store.logs.ERROR.Println(STR, "Trying to use memory store, but not open")
 		return
 	}
 	mid := mIDFromKey(key)
 	m := store.messages[key]
 	if m == nil {
-		WARN.Println(STR, "memorystore del: message", mid, "not found")
+		store.logs.WARN.Println(STR, "memorystore del: message not found", logger.Fields{"key": mid})
 	} else {
 		delete(store.messages, key)
-		DEBUG.Println(STR, "memorystore del: message", mid, "was deleted")
+		store.logs.DEBUG.Println(STR, "memorystore del: message was deleted", logger.Fields{"key": mid})
 	}
 }
 
@@ -105,11 +115,11 @@ func (store *MemoryStore) Close() {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		ERROR.Println(STR, "Trying to close memory store, but not open")
+		store.logs.ERROR.Println(STR, "Trying to close memory store, but not open")
 		return
 	}
 	store.opened = false
-	DEBUG.Println(STR, "memorystore closed")
+	store.logs.DEBUG.Println(STR, "memorystore closed")
 }
 
 // Reset eliminates all persisted message data in the store.
@@ -117,8 +127,8 @@ func (store *MemoryStore) Reset() {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		ERROR.Println(STR, "Trying to reset memory store, but not open")
+		store.logs.ERROR.Println(STR, "Trying to reset memory store, but not open")
 	}
 	store.messages = make(map[string]packets.ControlPacket)
-	WARN.Println(STR, "memorystore wiped")
+	store.logs.WARN.Println(STR, "memorystore wiped")
 }
@@ -17,6 +17,9 @@ type Message interface {
 	Topic() string
 	MessageID() uint16
 	Payload() []byte
+	// Properties returns the MQTT 5 properties of the message, nil for
+	// older protocol versions
+	Properties() *packets.Properties
 	Ack()
 }
 
@@ -27,6 +30,7 @@ type message struct {
 	topic     string
 	messageID uint16
 	payload   []byte
+	props     *packets.Properties
 	once      sync.Once
 	ack       func()
 }
@@ -55,6 +59,10 @@ func (m *message) Payload() []byte {
 	return m.payload
 }
 
+func (m *message) Properties() *packets.Properties {
+	return m.props
+}
+
 func (m *message) Ack() {
 	m.once.Do(m.ack)
 }
@@ -67,6 +75,7 @@ func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
 		topic:     p.TopicName,
 		messageID: p.MessageID,
 		payload:   p.Payload,
+		props:     p.Properties,
 		ack:       ack,
 	}
 }
@@ -109,5 +118,12 @@ func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.
 
 	m.Keepalive = uint16(options.KeepAlive)
 
+	if options.ProtocolVersion == packets.ProtocolVersion5 {
+		m.Properties = options.ConnectProperties
+		if options.WillEnabled {
+			m.WillProperties = options.WillProperties
+		}
+	}
+
 	return m
 }
@@ -14,6 +14,7 @@ type MId uint16
 type messageIds struct {
 	sync.RWMutex
 	index map[uint16]tokenCompletor
+	logs  *loggers
 
 	lastIssuedID uint16 // The most recently issued ID. Used so we cycle through ids rather than immediately reusing them (can make debugging easier)
 }
@@ -40,7 +41,7 @@ func (mids *messageIds) cleanUp() {
 	}
 	mids.index = make(map[uint16]tokenCompletor)
 	mids.Unlock()
-	DEBUG.Println(MID, "cleaned up")
+	mids.logs.DEBUG.Println(MID, "cleaned up")
 }
 
 func (mids *messageIds) freeID(id uint16) {
@@ -94,11 +95,12 @@ func (mids *messageIds) getToken(id uint16) tokenCompletor {
 	if token, ok := mids.index[id]; ok {
 		return token
 	}
-	return &DummyToken{id: id}
+	return &DummyToken{id: id, logs: mids.logs}
 }
 
 type DummyToken struct {
-	id uint16
+	id   uint16
+	logs *loggers
 }
 
 // Wait implements the Token Wait method.
@@ -119,7 +121,11 @@ func (d *DummyToken) Done() <-chan struct{} {
 }
 
 func (d *DummyToken) flowComplete() {
-	ERROR.Printf("A lookup for token %d returned nil\n", d.id)
+	logs := d.logs
+	if logs == nil {
+		logs = packageLoggers
+	}
+	logs.ERROR.Printf("A lookup for token %d returned nil\n", d.id)
 }
 
 func (d *DummyToken) Error() error {
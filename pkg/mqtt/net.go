@@ -2,6 +2,7 @@ package mqtt
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"reflect"
@@ -9,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
 	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
 )
 
@@ -21,65 +23,69 @@ const closedNetConnErrorText = "use of closed network connection" // error strin
 //
 // Note that, for backward compatibility, ConnectMQTT() suppresses the actual connection error (compare to connectMQTT()).
 func ConnectMQTT(conn net.Conn, cm *packets.ConnectPacket, protocolVersion uint) (byte, bool) {
-	rc, sessionPresent, _ := connectMQTT(conn, cm, protocolVersion)
+	rc, sessionPresent, _, _ := connectMQTT(conn, cm, protocolVersion, packageLoggers)
 	return rc, sessionPresent
 }
 
-func connectMQTT(conn io.ReadWriter, cm *packets.ConnectPacket, protocolVersion uint) (byte, bool, error) {
+// connectMQTT performs the MQTT handshake, the returned properties are those of the CONNACK (MQTT 5 only)
+func connectMQTT(conn io.ReadWriter, cm *packets.ConnectPacket, protocolVersion uint, logs *loggers) (byte, bool, *packets.Properties, error) {
 	switch protocolVersion {
+	case packets.ProtocolVersion5:
+		logs.DEBUG.Println(CLI, "Using MQTT 5 protocol")
+		cm.ProtocolName = "MQTT"
+		cm.ProtocolVersion = packets.ProtocolVersion5
 	case 3:
-		DEBUG.Println(CLI, "Using MQTT 3.1 protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1 protocol")
 		cm.ProtocolName = "MQIsdp"
 		cm.ProtocolVersion = 3
 	case 0x83:
-		DEBUG.Println(CLI, "Using MQTT 3.1b protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1b protocol")
 		cm.ProtocolName = "MQIsdp"
 		cm.ProtocolVersion = 0x83
 	case 0x84:
-		DEBUG.Println(CLI, "Using MQTT 3.1.1b protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1.1b protocol")
 		cm.ProtocolName = "MQTT"
 		cm.ProtocolVersion = 0x84
 	default:
-		DEBUG.Println(CLI, "Using MQTT 3.1.1 protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1.1 protocol")
 		cm.ProtocolName = "MQTT"
 		cm.ProtocolVersion = 4
 	}
 
 	if err := cm.Write(conn); err != nil {
-		ERROR.Println(CLI, err)
-		return packets.ErrNetworkError, false, err
+		logs.ERROR.Println(CLI, err)
+		return packets.ErrNetworkError, false, nil, err
 	}
 
-	rc, sessionPresent, err := verifyCONNACK(conn)
-	return rc, sessionPresent, err
+	return verifyCONNACK(conn, cm.ProtocolVersion, logs)
 }
 
 // This function is only used for receiving a connack
 // when the connection is first started.
 // This prevents receiving incoming data while resume
 // is in progress if clean session is false.
-func verifyCONNACK(conn io.Reader) (byte, bool, error) {
-	DEBUG.Println(NET, "connect started")
+func verifyCONNACK(conn io.Reader, version byte, logs *loggers) (byte, bool, *packets.Properties, error) {
+	logs.DEBUG.Println(NET, "connect started")
 
-	ca, err := packets.ReadPacket(conn)
+	ca, err := packets.ReadPacketWithVersion(conn, version)
 	if err != nil {
-		ERROR.Println(NET, "connect got error", err)
-		return packets.ErrNetworkError, false, err
+		logs.ERROR.Println(NET, "connect got error", err)
+		return packets.ErrNetworkError, false, nil, err
 	}
 
 	if ca == nil {
-		ERROR.Println(NET, "received nil packet")
-		return packets.ErrNetworkError, false, errors.New("nil CONNACK packet")
+		logs.ERROR.Println(NET, "received nil packet")
+		return packets.ErrNetworkError, false, nil, errors.New("nil CONNACK packet")
 	}
 
 	msg, ok := ca.(*packets.ConnackPacket)
 	if !ok {
-		ERROR.Println(NET, "received msg that was not CONNACK")
-		return packets.ErrNetworkError, false, errors.New("non-CONNACK first packet received")
+		logs.ERROR.Println(NET, "received msg that was not CONNACK")
+		return packets.ErrNetworkError, false, nil, errors.New("non-CONNACK first packet received")
 	}
 
-	DEBUG.Println(NET, "received connack")
-	return msg.ReturnCode, msg.SessionPresent, nil
+	logs.DEBUG.Println(NET, "received connack")
+	return msg.ReturnCode, msg.SessionPresent, msg.Properties, nil
 }
 
 // inbound encapsulates the output from startIncoming.
@@ -93,16 +99,16 @@ type inbound struct {
 // startIncoming initiates a goroutine that reads incoming messages off the wire and sends them to the channel (returned).
 // If there are any issues with the network connection then the returned channel will be closed and the goroutine will exit
 // (so closing the connection will terminate the goroutine)
-func startIncoming(conn io.Reader) <-chan inbound {
+func startIncoming(conn io.Reader, version byte, logs *loggers) <-chan inbound {
 	var err error
 	var cp packets.ControlPacket
 	ibound := make(chan inbound)
 
-	DEBUG.Println(NET, "incoming started")
+	logs.DEBUG.Println(NET, "incoming started")
 
 	go func() {
 		for {
-			if cp, err = packets.ReadPacket(conn); err != nil {
+			if cp, err = packets.ReadPacketWithVersion(conn, version); err != nil {
 				// We do not want to log the error if it is due to the network connection having been closed
 				// elsewhere (i.e. after sending DisconnectPacket). Detecting this situation is the subject of
 				// https://github.com/golang/go/issues/4373
@@ -110,10 +116,10 @@ func startIncoming(conn io.Reader) <-chan inbound {
 					ibound <- inbound{err: err}
 				}
 				close(ibound)
-				DEBUG.Println(NET, "incoming complete")
+				logs.DEBUG.Println(NET, "incoming complete")
 				return
 			}
-			DEBUG.Println(NET, "startIncoming Received Message")
+			logs.DEBUG.Println(NET, "startIncoming Received Message")
 			ibound <- inbound{cp: cp}
 		}
 	}()
@@ -138,36 +144,38 @@ func startIncomingComms(conn io.Reader,
 	c commsFns,
 	inboundFromStore <-chan packets.ControlPacket,
 ) <-chan incomingComms {
-	ibound := startIncoming(conn) // Start goroutine that reads from network connection
+	logs := c.loggers()
+	ibound := startIncoming(conn, c.protocolVersion(), logs) // Start goroutine that reads from network connection
 	output := make(chan incomingComms)
+	aliases := make(map[uint16]string) // MQTT 5 topic aliases set by the server on this connection
 
-	DEBUG.Println(NET, "startIncomingComms started")
+	logs.DEBUG.Println(NET, "startIncomingComms started")
 	go func() {
 		for {
 			if inboundFromStore == nil && ibound == nil {
 				close(output)
-				DEBUG.Println(NET, "startIncomingComms goroutine complete")
+				logs.DEBUG.Println(NET, "startIncomingComms goroutine complete")
 				return // As soon as ibound is closed we can exit (should have already processed an error)
 			}
-			DEBUG.Println(NET, "logic waiting for msg on ibound")
+			logs.DEBUG.Println(NET, "logic waiting for msg on ibound")
 
 			var msg packets.ControlPacket
 			var ok bool
 			select {
 			case msg, ok = <-inboundFromStore:
 				if !ok {
-					DEBUG.Println(NET, "startIncomingComms: inboundFromStore complete")
+					logs.DEBUG.Println(NET, "startIncomingComms: inboundFromStore complete")
 					inboundFromStore = nil // should happen quickly as this is only for persisted messages
 					continue
 				}
-				DEBUG.Println(NET, "startIncomingComms: got msg from store")
+				logs.DEBUG.Println(NET, "startIncomingComms: got msg from store")
 			case ibMsg, ok := <-ibound:
 				if !ok {
-					DEBUG.Println(NET, "startIncomingComms: ibound complete")
+					logs.DEBUG.Println(NET, "startIncomingComms: ibound complete")
 					ibound = nil
 					continue
 				}
-				DEBUG.Println(NET, "startIncomingComms: got msg on ibound")
+				logs.DEBUG.Println(NET, "startIncomingComms: got msg on ibound")
 				// If the inbound comms routine encounters any issues it will send us an error.
 				if ibMsg.err != nil {
 					output <- incomingComms{err: ibMsg.err}
@@ -175,20 +183,28 @@ func startIncomingComms(conn io.Reader,
 				}
 				msg = ibMsg.cp
 
+				// Topic aliases must be resolved before the publish is persisted
+				if pub, ok := msg.(*packets.PublishPacket); ok {
+					if err := resolveTopicAlias(aliases, pub); err != nil {
+						output <- incomingComms{err: err}
+						continue
+					}
+				}
+
 				c.persistInbound(msg)
 				c.UpdateLastReceived() // Notify keepalive logic that we recently received a packet
 			}
 
 			switch m := msg.(type) {
 			case *packets.PingrespPacket:
-				DEBUG.Println(NET, "startIncomingComms: received pingresp")
+				logs.DEBUG.Println(NET, "startIncomingComms: received pingresp")
 				c.pingRespReceived()
 			case *packets.SubackPacket:
-				DEBUG.Println(NET, "startIncomingComms: received suback, id:", m.MessageID)
+				logs.DEBUG.Println(NET, "startIncomingComms: received suback", logger.Fields{"messageID": m.MessageID})
 				token := c.getToken(m.MessageID)
 
 				if t, ok := token.(*SubscribeToken); ok {
-					DEBUG.Println(NET, "startIncomingComms: granted qoss", m.ReturnCodes)
+					logs.DEBUG.Println(NET, "startIncomingComms: granted qoss", m.ReturnCodes)
 					for i, qos := range m.ReturnCodes {
 						t.subResult[t.subs[i]] = qos
 					}
@@ -197,31 +213,47 @@ func startIncomingComms(conn io.Reader,
 				token.flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.UnsubackPacket:
-				DEBUG.Println(NET, "startIncomingComms: received unsuback, id:", m.MessageID)
+				logs.DEBUG.Println(NET, "startIncomingComms: received unsuback", logger.Fields{"messageID": m.MessageID})
 				c.getToken(m.MessageID).flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.PublishPacket:
-				DEBUG.Println(NET, "startIncomingComms: received publish, msgId:", m.MessageID)
+				logs.DEBUG.Println(NET, "startIncomingComms: received publish", logger.Fields{"messageID": m.MessageID, "topic": m.TopicName, "qos": m.Qos})
 				output <- incomingComms{incomingPub: m}
 			case *packets.PubackPacket:
-				DEBUG.Println(NET, "startIncomingComms: received puback, id:", m.MessageID)
-				c.getToken(m.MessageID).flowComplete()
+				logs.DEBUG.Println(NET, "startIncomingComms: received puback", logger.Fields{"messageID": m.MessageID})
+				completeWithReason(c.getToken(m.MessageID), m.ReasonCode, m.Properties)
 				c.freeID(m.MessageID)
 			case *packets.PubrecPacket:
-				DEBUG.Println(NET, "startIncomingComms: received pubrec, id:", m.MessageID)
-				prel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+				logs.DEBUG.Println(NET, "startIncomingComms: received pubrec", logger.Fields{"messageID": m.MessageID})
+				if m.ReasonCode >= 0x80 {
+					// The server refused the message (MQTT 5), the flow ends here
+					completeWithReason(c.getToken(m.MessageID), m.ReasonCode, m.Properties)
+					c.freeID(m.MessageID)
+					continue
+				}
+				prel := packets.NewControlPacketWithVersion(packets.Pubrel, m.Version).(*packets.PubrelPacket)
 				prel.MessageID = m.MessageID
 				output <- incomingComms{outbound: &PacketAndToken{p: prel, t: nil}}
 			case *packets.PubrelPacket:
-				DEBUG.Println(NET, "startIncomingComms: received pubrel, id:", m.MessageID)
-				pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+				logs.DEBUG.Println(NET, "startIncomingComms: received pubrel", logger.Fields{"messageID": m.MessageID})
+				pc := packets.NewControlPacketWithVersion(packets.Pubcomp, m.Version).(*packets.PubcompPacket)
 				pc.MessageID = m.MessageID
 				c.persistOutbound(pc)
 				output <- incomingComms{outbound: &PacketAndToken{p: pc, t: nil}}
 			case *packets.PubcompPacket:
-				DEBUG.Println(NET, "startIncomingComms: received pubcomp, id:", m.MessageID)
-				c.getToken(m.MessageID).flowComplete()
+				logs.DEBUG.Println(NET, "startIncomingComms: received pubcomp", logger.Fields{"messageID": m.MessageID})
+				completeWithReason(c.getToken(m.MessageID), m.ReasonCode, m.Properties)
 				c.freeID(m.MessageID)
+			case *packets.DisconnectPacket:
+				// Only MQTT 5 servers send DISCONNECT, the connection will be closed by the server
+				logs.DEBUG.Println(NET, "startIncomingComms: received disconnect, reason:", m.ReasonCode)
+				err := packets.NewReasonError(m.ReasonCode, m.Properties)
+				if err == nil {
+					err = errors.New("disconnected by server")
+				}
+				output <- incomingComms{err: fmt.Errorf("server sent DISCONNECT: %w", err)}
+			case *packets.AuthPacket:
+				logs.WARN.Println(NET, "startIncomingComms: received auth, enhanced authentication is not supported")
 			}
 		}
 	}()
@@ -239,18 +271,24 @@ func startOutgoingComms(conn net.Conn,
 	obound <-chan *PacketAndToken,
 	oboundFromIncoming <-chan *PacketAndToken,
 ) <-chan error {
+	logs := c.loggers()
 	errChan := make(chan error)
-	DEBUG.Println(NET, "outgoing started")
+	logs.DEBUG.Println(NET, "outgoing started")
+
+	var aliases *topicAliases // MQTT 5 topic aliases assigned by the client on this connection
+	if props := c.serverProperties(); props != nil && props.TopicAliasMaximum != nil {
+		aliases = newTopicAliases(*props.TopicAliasMaximum)
+	}
 
 	go func() {
 		for {
-			DEBUG.Println(NET, "outgoing waiting for an outbound message")
+			logs.DEBUG.Println(NET, "outgoing waiting for an outbound message")
 
 			// This goroutine will only exits when all of the input channels we receive on have been closed. This approach is taken to avoid any
 			// deadlocks (if the connection goes down there are limited options as to what we can do with anything waiting on us and
 			// throwing away the packets seems the best option)
 			if oboundp == nil && obound == nil && oboundFromIncoming == nil {
-				DEBUG.Println(NET, "outgoing comms stopping")
+				logs.DEBUG.Println(NET, "outgoing comms stopping")
 				close(errChan)
 				return
 			}
@@ -262,17 +300,17 @@ func startOutgoingComms(conn net.Conn,
 					continue
 				}
 				msg := pub.p.(*packets.PublishPacket)
-				DEBUG.Println(NET, "obound msg to write", msg.MessageID)
+				logs.DEBUG.Println(NET, "obound msg to write", logger.Fields{"messageID": msg.MessageID})
 
 				writeTimeout := c.getWriteTimeOut()
 				if writeTimeout > 0 {
 					if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
-						ERROR.Println(NET, "SetWriteDeadline ", err)
+						logs.ERROR.Println(NET, "SetWriteDeadline ", err)
 					}
 				}
 
-				if err := msg.Write(conn); err != nil {
-					ERROR.Println(NET, "outgoing obound reporting error ", err)
+				if err := aliases.apply(msg).Write(conn); err != nil {
+					logs.ERROR.Println(NET, "outgoing obound reporting error ", err)
 					pub.t.setError(err)
 					// report error if it's not due to the connection being closed elsewhere
 					if !strings.Contains(err.Error(), closedNetConnErrorText) {
@@ -285,22 +323,22 @@ func startOutgoingComms(conn net.Conn,
 					// If we successfully wrote, we don't want the timeout to happen during an idle period
 					// so we reset it to infinite.
 					if err := conn.SetWriteDeadline(time.Time{}); err != nil {
-						ERROR.Println(NET, "SetWriteDeadline to 0 ", err)
+						logs.ERROR.Println(NET, "SetWriteDeadline to 0 ", err)
 					}
 				}
 
 				if msg.Qos == 0 {
 					pub.t.flowComplete()
 				}
-				DEBUG.Println(NET, "obound wrote msg, id:", msg.MessageID)
+				logs.DEBUG.Println(NET, "obound wrote msg", logger.Fields{"messageID": msg.MessageID})
 			case msg, ok := <-oboundp:
 				if !ok {
 					oboundp = nil
 					continue
 				}
-				DEBUG.Println(NET, "obound priority msg to write, type", reflect.TypeOf(msg.p))
+				logs.DEBUG.Println(NET, "obound priority msg to write, type", reflect.TypeOf(msg.p))
 				if err := msg.p.Write(conn); err != nil {
-					ERROR.Println(NET, "outgoing oboundp reporting error ", err)
+					logs.ERROR.Println(NET, "outgoing oboundp reporting error ", err)
 					if msg.t != nil {
 						msg.t.setError(err)
 					}
@@ -310,7 +348,7 @@ func startOutgoingComms(conn net.Conn,
 
 				if _, ok := msg.p.(*packets.DisconnectPacket); ok {
 					msg.t.(*DisconnectToken).flowComplete()
-					DEBUG.Println(NET, "outbound wrote disconnect, closing connection")
+					logs.DEBUG.Println(NET, "outbound wrote disconnect, closing connection")
 					// As per the MQTT spec "After sending a DISCONNECT Packet the Client MUST close the Network Connection"
 					// Closing the connection will cause the goroutines to end in sequence (starting with incoming comms)
 					conn.Close()
@@ -320,9 +358,9 @@ func startOutgoingComms(conn net.Conn,
 					oboundFromIncoming = nil
 					continue
 				}
-				DEBUG.Println(NET, "obound from incoming msg to write, type", reflect.TypeOf(msg.p), " ID ", msg.p.Details().MessageID)
+				logs.DEBUG.Println(NET, "obound from incoming msg to write, type", reflect.TypeOf(msg.p), logger.Fields{"messageID": msg.p.Details().MessageID})
 				if err := msg.p.Write(conn); err != nil {
-					ERROR.Println(NET, "outgoing oboundFromIncoming reporting error", err)
+					logs.ERROR.Println(NET, "outgoing oboundFromIncoming reporting error", err)
 					if msg.t != nil {
 						msg.t.setError(err)
 					}
@@ -346,6 +384,9 @@ type commsFns interface {
 	persistOutbound(m packets.ControlPacket) // add the packet to the outbound store
 	persistInbound(m packets.ControlPacket)  // add the packet to the inbound store
 	pingRespReceived()                       // Called when a ping response is received
+	protocolVersion() byte                   // The protocol version of the current connection
+	serverProperties() *packets.Properties   // The CONNACK properties of the current connection (MQTT 5 only)
+	loggers() *loggers                       // The level loggers of the client
 }
 
 // startComms initiates goroutines that handles communications over the network connection
@@ -372,7 +413,8 @@ func startComms(conn net.Conn, // Network connection (must be active)
 
 	// Start the outgoing handler. It is important to note that output from startIncomingComms is fed into startOutgoingComms (for ACK's)
 	oboundErr := startOutgoingComms(conn, c, oboundp, obound, outboundFromIncoming)
-	DEBUG.Println(NET, "startComms started")
+	logs := c.loggers()
+	logs.DEBUG.Println(NET, "startComms started")
 
 	// Run up go routines to handle the output from the above comms functions - these are handled in separate
 	// go routines because they can interact (e.g. ibound triggers an ACK to obound which triggers an error)
@@ -397,7 +439,7 @@ func startComms(conn net.Conn, // Network connection (must be active)
 				outPublish <- ic.incomingPub
 				continue
 			}
-			ERROR.Println(STR, "startComms received empty incomingComms msg")
+			logs.ERROR.Println(STR, "startComms received empty incomingComms msg")
 		}
 		// Close channels that will not be written to again (allowing other routines to exit)
 		close(outboundFromIncoming)
@@ -417,7 +459,7 @@ func startComms(conn net.Conn, // Network connection (must be active)
 	go func() {
 		wg.Wait()
 		close(outError)
-		DEBUG.Println(NET, "startComms closing outError")
+		logs.DEBUG.Println(NET, "startComms closing outError")
 	}()
 
 	return outPublish, outError
@@ -427,24 +469,90 @@ func startComms(conn net.Conn, // Network connection (must be active)
 // WARNING the function returned must not be called if the comms routine is shutting down or not running
 // (it needs outgoing comms in order to send the acknowledgement). Currently this is only called from
 // matchAndDispatch which will be shutdown before the comms are
-func ackFunc(oboundP chan *PacketAndToken, persist Store, packet *packets.PublishPacket) func() {
+func ackFunc(oboundP chan *PacketAndToken, persist Store, packet *packets.PublishPacket, logs *loggers) func() {
 	return func() {
 		switch packet.Qos {
 		case 2:
-			pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			pr := packets.NewControlPacketWithVersion(packets.Pubrec, packet.Version).(*packets.PubrecPacket)
 			pr.MessageID = packet.MessageID
-			DEBUG.Println(NET, "putting pubrec msg on obound")
+			logs.DEBUG.Println(NET, "putting pubrec msg on obound")
 			oboundP <- &PacketAndToken{p: pr, t: nil}
-			DEBUG.Println(NET, "done putting pubrec msg on obound")
+			logs.DEBUG.Println(NET, "done putting pubrec msg on obound")
 		case 1:
-			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			pa := packets.NewControlPacketWithVersion(packets.Puback, packet.Version).(*packets.PubackPacket)
 			pa.MessageID = packet.MessageID
-			DEBUG.Println(NET, "putting puback msg on obound")
-			persistOutbound(persist, pa)
+			logs.DEBUG.Println(NET, "putting puback msg on obound")
+			persistOutbound(persist, pa, logs)
 			oboundP <- &PacketAndToken{p: pa, t: nil}
-			DEBUG.Println(NET, "done putting puback msg on obound")
+			logs.DEBUG.Println(NET, "done putting puback msg on obound")
 		case 0:
 			// do nothing, since there is no need to send an ack packet back
 		}
 	}
 }
+
+// completeWithReason completes the token of an acknowledged packet, failing it
+// if the MQTT 5 reason code indicates that the server refused the packet
+func completeWithReason(t tokenCompletor, reasonCode byte, props *packets.Properties) {
+	if err := packets.NewReasonError(reasonCode, props); err != nil {
+		t.setError(err)
+		return
+	}
+	t.flowComplete()
+}
+
+// resolveTopicAlias replaces the topic alias of an incoming MQTT 5 publish by its topic name.
+// A publish carrying both a topic name and an alias (re)defines the alias for this connection.
+func resolveTopicAlias(aliases map[uint16]string, pub *packets.PublishPacket) error {
+	if pub.Properties == nil || pub.Properties.TopicAlias == nil {
+		return nil
+	}
+	alias := *pub.Properties.TopicAlias
+	if pub.TopicName != "" {
+		aliases[alias] = pub.TopicName
+		return nil
+	}
+	topic, ok := aliases[alias]
+	if !ok {
+		return &packets.ReasonError{Code: packets.ReasonTopicAliasInvalid, Reason: fmt.Sprintf("unknown topic alias %d", alias)}
+	}
+	pub.TopicName = topic
+	return nil
+}
+
+// topicAliases assigns MQTT 5 topic aliases to outgoing publishes, up to the
+// maximum announced by the server. Aliases are only valid for one connection.
+type topicAliases struct {
+	max     uint16
+	aliases map[string]uint16
+}
+
+func newTopicAliases(max uint16) *topicAliases {
+	return &topicAliases{max: max, aliases: make(map[string]uint16)}
+}
+
+// apply returns the packet to write in place of pub. The first publish to a topic
+// carries the topic name and a new alias, later ones only the alias. pub itself
+// is never modified as it may be persisted and resent on another connection.
+func (ta *topicAliases) apply(pub *packets.PublishPacket) *packets.PublishPacket {
+	if ta == nil || ta.max == 0 || pub.Version != packets.ProtocolVersion5 || pub.TopicName == "" {
+		return pub
+	}
+	if pub.Properties != nil && pub.Properties.TopicAlias != nil {
+		return pub // alias chosen by the caller
+	}
+	out := *pub
+	out.Properties = pub.Properties.Copy()
+	if alias, ok := ta.aliases[pub.TopicName]; ok {
+		out.TopicName = ""
+		out.Properties.TopicAlias = packets.Uint16(alias)
+		return &out
+	}
+	if uint16(len(ta.aliases)) >= ta.max {
+		return pub
+	}
+	alias := uint16(len(ta.aliases) + 1)
+	ta.aliases[pub.TopicName] = alias
+	out.Properties.TopicAlias = packets.Uint16(alias)
+	return &out
+}
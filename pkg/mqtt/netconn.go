@@ -1,12 +1,12 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 
 	"github.com/zsy-cn/4g-gateway/pkg/net/proxy"
@@ -17,26 +17,22 @@ import (
 //
 
 // openConnection opens a network connection using the protocol indicated in the URL. Does not carry out any MQTT specific handshakes
-func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions) (net.Conn, error) {
+// The TCP connection is made with dialer; when dialer is nil the proxy in the ALL_PROXY / NO_PROXY
+// environment variables is used, if any.
+func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions, dialer proxy.Dialer) (net.Conn, error) {
+	if dialer == nil {
+		dialer = proxy.FromEnvironmentUsing(&net.Dialer{Timeout: timeout})
+	}
+
 	switch uri.Scheme {
 	case "ws":
-		conn, err := NewWebsocket(uri.String(), nil, timeout, headers, websocketOptions)
+		conn, err := newWebsocket(uri.String(), nil, timeout, headers, websocketOptions, dialer)
 		return conn, err
 	case "wss":
-		conn, err := NewWebsocket(uri.String(), tlsc, timeout, headers, websocketOptions)
+		conn, err := newWebsocket(uri.String(), tlsc, timeout, headers, websocketOptions, dialer)
 		return conn, err
 	case "mqtt", "tcp":
-		allProxy := os.Getenv("all_proxy")
-		if len(allProxy) == 0 {
-			conn, err := net.DialTimeout("tcp", uri.Host, timeout)
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
-		}
-		proxyDialer := proxy.FromEnvironment()
-
-		conn, err := proxyDialer.Dial("tcp", uri.Host)
+		conn, err := dial(dialer, "tcp", uri.Host, timeout)
 		if err != nil {
 			return nil, err
 		}
@@ -48,30 +44,44 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 		}
 		return conn, nil
 	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
-		allProxy := os.Getenv("all_proxy")
-		if len(allProxy) == 0 {
-			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", uri.Host, tlsc)
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
-		}
-		proxyDialer := proxy.FromEnvironment()
-
-		conn, err := proxyDialer.Dial("tcp", uri.Host)
+		conn, err := dial(dialer, "tcp", uri.Host, timeout)
 		if err != nil {
 			return nil, err
 		}
 
+		// tls.Client, unlike tls.Dial, does not take the server name from the address
+		if tlsc == nil {
+			tlsc = &tls.Config{}
+		}
+		if len(tlsc.ServerName) == 0 && !tlsc.InsecureSkipVerify {
+			tlsc = tlsc.Clone()
+			tlsc.ServerName = uri.Hostname()
+		}
 		tlsConn := tls.Client(conn, tlsc)
 
+		if timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
 		err = tlsConn.Handshake()
 		if err != nil {
 			conn.Close()
 			return nil, err
 		}
+		conn.SetDeadline(time.Time{})
 
 		return tlsConn, nil
 	}
 	return nil, errors.New("unknown protocol")
 }
+
+// dial connects using the ContextDialer interface when the dialer implements it, so that
+// the timeout also applies to proxy handshakes.
+func dial(dialer proxy.Dialer, network, addr string, timeout time.Duration) (net.Conn, error) {
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok || timeout <= 0 {
+		return dialer.Dial(network, addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return contextDialer.DialContext(ctx, network, addr)
+}
@@ -7,6 +7,10 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+	"github.com/zsy-cn/4g-gateway/pkg/mqtt/packets"
+	"github.com/zsy-cn/4g-gateway/pkg/net/proxy"
 )
 
 // CredentialsProvider allows the username and password to be updated
@@ -33,6 +37,17 @@ type OnConnectHandler func(Client, ...interface{})
 // the initial connection is lost
 type ReconnectHandler func(Client, *ClientOptions, ...interface{})
 
+// ConnectionAttemptHandler is invoked prior to making the network connection
+// to a broker. It returns the TLS config to use for that broker, which allows
+// settings such as ServerName to differ between brokers.
+type ConnectionAttemptHandler func(broker *url.URL, tlsCfg *tls.Config) *tls.Config
+
+// BrokerSelector is invoked at the start of each connection attempt (initial
+// connection and reconnection) with the configured brokers. It returns the
+// brokers to try, in order, which allows the application to implement its own
+// failover policy. By default every broker is tried in the order added.
+type BrokerSelector func(brokers []*url.URL) []*url.URL
+
 // ClientOptions contains configurable options for an Client.
 type ClientOptions struct {
 	Servers                 []*url.URL
@@ -62,11 +77,18 @@ type ClientOptions struct {
 	OnConnect               OnConnectHandler
 	OnConnectionLost        ConnectionLostHandler
 	OnReconnecting          ReconnectHandler
+	OnConnectAttempt        ConnectionAttemptHandler
+	BrokerSelector          BrokerSelector
 	WriteTimeout            time.Duration
 	MessageChannelDepth     uint
 	ResumeSubs              bool
 	HTTPHeaders             http.Header
 	WebsocketOptions        *WebsocketOptions
+	Dialer                  proxy.Dialer
+	Logger                  *logger.Logger
+	LogLevel                logger.Level
+	ConnectProperties       *packets.Properties // MQTT 5 only
+	WillProperties          *packets.Properties // MQTT 5 only
 }
 
 // NewClientOptions will create a new ClientClientOptions type with some
@@ -130,7 +152,7 @@ func (o *ClientOptions) AddBroker(server string) *ClientOptions {
 	server = re.ReplaceAllLiteralString(server, "%25")
 	brokerURI, err := url.Parse(server)
 	if err != nil {
-		ERROR.Println(CLI, "Failed to parse %q broker address: %s", server, err)
+		packageLoggers.ERROR.Println(CLI, "Failed to parse %q broker address: %s", server, err)
 		return o
 	}
 	o.Servers = append(o.Servers, brokerURI)
@@ -233,15 +255,42 @@ func (o *ClientOptions) SetPingTimeout(k time.Duration) *ClientOptions {
 }
 
 // SetProtocolVersion sets the MQTT version to be used to connect to the
-// broker. Legitimate values are currently 3 - MQTT 3.1 or 4 - MQTT 3.1.1
+// broker. Legitimate values are currently 3 - MQTT 3.1, 4 - MQTT 3.1.1 or
+// 5 - MQTT 5. There is no fallback to an older version when 5 is requested.
 func (o *ClientOptions) SetProtocolVersion(pv uint) *ClientOptions {
-	if (pv >= 3 && pv <= 4) || (pv > 0x80) {
+	if (pv >= 3 && pv <= 5) || (pv > 0x80) {
 		o.ProtocolVersion = pv
 		o.protocolVersionExplicit = true
 	}
 	return o
 }
 
+// SetConnectProperties sets the properties sent in the CONNECT packet when
+// connecting with MQTT 5, for example the session expiry interval, the
+// receive maximum or the topic alias maximum the client accepts. They are
+// ignored for older protocol versions.
+func (o *ClientOptions) SetConnectProperties(p *packets.Properties) *ClientOptions {
+	o.ConnectProperties = p
+	return o
+}
+
+// SetSessionExpiryInterval sets the MQTT 5 session expiry interval in
+// seconds. With the default of 0 the broker discards the session when the
+// connection closes, so it must be set for CleanSession(false) to keep
+// queued messages and subscriptions across reconnects.
+func (o *ClientOptions) SetSessionExpiryInterval(seconds uint32) *ClientOptions {
+	o.ConnectProperties = o.ConnectProperties.Copy()
+	o.ConnectProperties.SessionExpiryInterval = packets.Uint32(seconds)
+	return o
+}
+
+// SetWillProperties sets the MQTT 5 properties of the will message, for
+// example the will delay interval or the message expiry interval.
+func (o *ClientOptions) SetWillProperties(p *packets.Properties) *ClientOptions {
+	o.WillProperties = p
+	return o
+}
+
 // UnsetWill will cause any set will message to be disregarded.
 func (o *ClientOptions) UnsetWill() *ClientOptions {
 	o.WillEnabled = false
@@ -298,6 +347,20 @@ func (o *ClientOptions) SetReconnectingHandler(cb ReconnectHandler) *ClientOptio
 	return o
 }
 
+// SetConnectionAttemptHandler sets the ConnectionAttemptHandler callback to be
+// executed prior to each attempt to connect to a broker.
+func (o *ClientOptions) SetConnectionAttemptHandler(onConnectAttempt ConnectionAttemptHandler) *ClientOptions {
+	o.OnConnectAttempt = onConnectAttempt
+	return o
+}
+
+// SetBrokerSelector sets the BrokerSelector that chooses which brokers are
+// tried on each connection attempt.
+func (o *ClientOptions) SetBrokerSelector(selector BrokerSelector) *ClientOptions {
+	o.BrokerSelector = selector
+	return o
+}
+
 // SetWriteTimeout puts a limit on how long a mqtt publish should block until it unblocks with a
 // timeout error. A duration of 0 never times out. Default never times out
 func (o *ClientOptions) SetWriteTimeout(t time.Duration) *ClientOptions {
@@ -359,6 +422,29 @@ func (o *ClientOptions) SetHTTPHeaders(h http.Header) *ClientOptions {
 	return o
 }
 
+// SetDialer sets the dialer used to make the TCP connection to the broker for all
+// protocols except unix, for instance a SOCKS5 dialer from proxy.FromURL or a
+// proxy.PerHost with bypass rules. If the dialer also implements
+// proxy.ContextDialer, ConnectTimeout applies to the proxy handshake as well.
+// Defaults to the proxy in the ALL_PROXY / NO_PROXY environment variables, if any.
+func (o *ClientOptions) SetDialer(dialer proxy.Dialer) *ClientOptions {
+	o.Dialer = dialer
+	return o
+}
+
+// SetLogger sends the library output to a structured logger, for levels up to
+// and including level (logger.DebugLevel includes packet flow and store
+// operations). Entries carry the client ID, the current broker and, where
+// relevant, the message ID as fields.
+// The logger belongs to the client and to a FileStore or MemoryStore it uses;
+// the package level ERROR, CRITICAL, WARN, INFO and DEBUG loggers are not
+// modified, so several clients can log with their own fields.
+func (o *ClientOptions) SetLogger(log *logger.Logger, level logger.Level) *ClientOptions {
+	o.Logger = log
+	o.LogLevel = level
+	return o
+}
+
 // SetWebsocketOptions sets the additional websocket options used in a WebSocket connection
 func (o *ClientOptions) SetWebsocketOptions(w *WebsocketOptions) *ClientOptions {
 	o.WebsocketOptions = w
@@ -0,0 +1,52 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// AuthPacket is an internal representation of the fields of the
+// Auth MQTT packet (MQTT 5 only)
+type AuthPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (a *AuthPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d properties: %s", a.FixedHeader, a.ReasonCode, a.Properties)
+}
+
+func (a *AuthPacket) Write(w io.Writer) error {
+	var body []byte
+	if a.ReasonCode != ReasonSuccess || !a.Properties.empty() {
+		body = append(body, a.ReasonCode)
+		body = append(body, a.Properties.Pack()...)
+	}
+	a.FixedHeader.RemainingLength = len(body)
+	packet := a.FixedHeader.pack()
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
+
+	return err
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (a *AuthPacket) Unpack(b io.Reader) error {
+	if a.RemainingLength == 0 {
+		return nil
+	}
+	var err error
+	if a.ReasonCode, err = decodeByte(b); err != nil || a.RemainingLength == 1 {
+		return err
+	}
+	a.Properties = &Properties{}
+	return a.Properties.Unpack(b)
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (a *AuthPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -11,11 +11,12 @@ import (
 type ConnackPacket struct {
 	FixedHeader
 	SessionPresent bool
-	ReturnCode     byte
+	ReturnCode     byte // the reason code for MQTT 5
+	Properties     *Properties
 }
 
 func (ca *ConnackPacket) String() string {
-	return fmt.Sprintf("%s sessionpresent: %t returncode: %d", ca.FixedHeader, ca.SessionPresent, ca.ReturnCode)
+	return fmt.Sprintf("%s sessionpresent: %t returncode: %d properties: %s", ca.FixedHeader, ca.SessionPresent, ca.ReturnCode, ca.Properties)
 }
 
 func (ca *ConnackPacket) Write(w io.Writer) error {
@@ -24,7 +25,10 @@ func (ca *ConnackPacket) Write(w io.Writer) error {
 
 	body.WriteByte(boolToByte(ca.SessionPresent))
 	body.WriteByte(ca.ReturnCode)
-	ca.FixedHeader.RemainingLength = 2
+	if ca.v5() {
+		body.Write(ca.Properties.Pack())
+	}
+	ca.FixedHeader.RemainingLength = body.Len()
 	packet := ca.FixedHeader.pack()
 	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
@@ -41,8 +45,11 @@ func (ca *ConnackPacket) Unpack(b io.Reader) error {
 	}
 	ca.SessionPresent = 1&flags > 0
 	ca.ReturnCode, err = decodeByte(b)
-
-	return err
+	if err != nil || !ca.v5() || ca.RemainingLength <= 2 {
+		return err
+	}
+	ca.Properties = &Properties{}
+	return ca.Properties.Unpack(b)
 }
 
 // Details returns a Details struct containing the Qos and
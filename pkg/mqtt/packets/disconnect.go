@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -8,14 +9,27 @@ import (
 // Disconnect MQTT packet
 type DisconnectPacket struct {
 	FixedHeader
+
+	// MQTT 5 only
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (d *DisconnectPacket) String() string {
-	return d.FixedHeader.String()
+	return fmt.Sprintf("%s reasoncode: %d", d.FixedHeader, d.ReasonCode)
 }
 
 func (d *DisconnectPacket) Write(w io.Writer) error {
+	var body []byte
+	if d.v5() && (d.ReasonCode != ReasonSuccess || !d.Properties.empty()) {
+		body = append(body, d.ReasonCode)
+		if !d.Properties.empty() {
+			body = append(body, d.Properties.Pack()...)
+		}
+	}
+	d.FixedHeader.RemainingLength = len(body)
 	packet := d.FixedHeader.pack()
+	packet.Write(body)
 	_, err := packet.WriteTo(w)
 
 	return err
@@ -24,7 +38,15 @@ func (d *DisconnectPacket) Write(w io.Writer) error {
 // Unpack decodes the details of a ControlPacket after the fixed
 // header has been read
 func (d *DisconnectPacket) Unpack(b io.Reader) error {
-	return nil
+	if !d.v5() || d.RemainingLength == 0 {
+		return nil
+	}
+	var err error
+	if d.ReasonCode, err = decodeByte(b); err != nil || d.RemainingLength == 1 {
+		return err
+	}
+	d.Properties = &Properties{}
+	return d.Properties.Unpack(b)
 }
 
 // Details returns a Details struct containing the Qos and
@@ -35,6 +35,7 @@ var PacketNames = map[uint8]string{
 	12: "PINGREQ",
 	13: "PINGRESP",
 	14: "DISCONNECT",
+	15: "AUTH",
 }
 
 // Below are the constants assigned to each of the MQTT packet types
@@ -53,6 +54,7 @@ const (
 	Pingreq     = 12
 	Pingresp    = 13
 	Disconnect  = 14
+	Auth        = 15
 )
 
 // Below are the const definitions for error codes returned by
@@ -99,7 +101,15 @@ var ConnErrors = map[byte]error{
 // representing the decoded MQTT packet and an error. One of these returns will
 // always be nil, a nil ControlPacket indicating an error occurred.
 func ReadPacket(r io.Reader) (ControlPacket, error) {
-	var fh FixedHeader
+	return ReadPacketWithVersion(r, 4)
+}
+
+// ReadPacketWithVersion reads an MQTT packet encoded with the given protocol
+// version. The variable headers of MQTT 5 packets carry reason codes and
+// properties that cannot be detected from the packet itself, so the version
+// negotiated in CONNECT must be supplied.
+func ReadPacketWithVersion(r io.Reader, version byte) (ControlPacket, error) {
+	fh := FixedHeader{Version: version}
 	b := make([]byte, 1)
 
 	_, err := io.ReadFull(r, b)
@@ -164,10 +174,22 @@ func NewControlPacket(packetType byte) ControlPacket {
 		return &PingreqPacket{FixedHeader: FixedHeader{MessageType: Pingreq}}
 	case Pingresp:
 		return &PingrespPacket{FixedHeader: FixedHeader{MessageType: Pingresp}}
+	case Auth:
+		return &AuthPacket{FixedHeader: FixedHeader{MessageType: Auth, Version: ProtocolVersion5}}
 	}
 	return nil
 }
 
+// NewControlPacketWithVersion creates a new, empty ControlPacket like
+// NewControlPacket that will be encoded with the given protocol version
+func NewControlPacketWithVersion(packetType byte, version byte) ControlPacket {
+	cp := NewControlPacket(packetType)
+	if v, ok := cp.(interface{ setVersion(byte) }); ok {
+		v.setVersion(version)
+	}
+	return cp
+}
+
 // NewControlPacketWithHeader is used to create a new ControlPacket of the type
 // specified within the FixedHeader that is passed to the function.
 // The newly created ControlPacket is empty and a pointer is returned.
@@ -201,6 +223,8 @@ func NewControlPacketWithHeader(fh FixedHeader) (ControlPacket, error) {
 		return &PingreqPacket{FixedHeader: fh}, nil
 	case Pingresp:
 		return &PingrespPacket{FixedHeader: fh}, nil
+	case Auth:
+		return &AuthPacket{FixedHeader: fh}, nil
 	}
 	return nil, fmt.Errorf("unsupported packet type 0x%x", fh.MessageType)
 }
@@ -221,6 +245,20 @@ type FixedHeader struct {
 	Qos             byte
 	Retain          bool
 	RemainingLength int
+
+	// Version is the protocol version the packet is encoded with. It is
+	// not part of the fixed header on the wire; 5 selects the MQTT 5
+	// encoding, any other value the MQTT 3.1/3.1.1 encoding.
+	Version byte
+}
+
+func (fh *FixedHeader) setVersion(version byte) {
+	fh.Version = version
+}
+
+// v5 reports whether the packet uses the MQTT 5 encoding
+func (fh *FixedHeader) v5() bool {
+	return fh.Version == ProtocolVersion5
 }
 
 func (fh FixedHeader) String() string {
@@ -344,3 +382,32 @@ func decodeLength(r io.Reader) (int, error) {
 	}
 	return int(rLength), nil
 }
+
+// packAck encodes the variable header of PUBACK, PUBREC, PUBREL and PUBCOMP
+// and sets the remaining length. The MQTT 5 reason code and properties are
+// omitted when they carry no information, as permitted by the specification.
+func packAck(fh *FixedHeader, messageID uint16, reasonCode byte, props *Properties) []byte {
+	body := encodeUint16(messageID)
+	if fh.v5() && (reasonCode != ReasonSuccess || !props.empty()) {
+		body = append(body, reasonCode)
+		if !props.empty() {
+			body = append(body, props.Pack()...)
+		}
+	}
+	fh.RemainingLength = len(body)
+	return body
+}
+
+// unpackAck decodes the variable header of PUBACK, PUBREC, PUBREL and PUBCOMP
+func unpackAck(fh *FixedHeader, b io.Reader) (messageID uint16, reasonCode byte, props *Properties, err error) {
+	messageID, err = decodeUint16(b)
+	if err != nil || !fh.v5() || fh.RemainingLength <= 2 {
+		return messageID, ReasonSuccess, nil, err
+	}
+	if reasonCode, err = decodeByte(b); err != nil || fh.RemainingLength <= 3 {
+		return messageID, reasonCode, nil, err
+	}
+	props = &Properties{}
+	err = props.Unpack(b)
+	return messageID, reasonCode, props, err
+}
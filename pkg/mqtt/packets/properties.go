@@ -0,0 +1,340 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion5 is the protocol level sent in the CONNECT packet for MQTT 5
+const ProtocolVersion5 = 5
+
+// Below are the identifiers of the MQTT 5 properties
+const (
+	PropPayloadFormat          = 0x01
+	PropMessageExpiry          = 0x02
+	PropContentType            = 0x03
+	PropResponseTopic          = 0x08
+	PropCorrelationData        = 0x09
+	PropSubscriptionIdentifier = 0x0B
+	PropSessionExpiryInterval  = 0x11
+	PropAssignedClientID       = 0x12
+	PropServerKeepAlive        = 0x13
+	PropAuthMethod             = 0x15
+	PropAuthData               = 0x16
+	PropRequestProblemInfo     = 0x17
+	PropWillDelayInterval      = 0x18
+	PropRequestResponseInfo    = 0x19
+	PropResponseInfo           = 0x1A
+	PropServerReference        = 0x1C
+	PropReasonString           = 0x1F
+	PropReceiveMaximum         = 0x21
+	PropTopicAliasMaximum      = 0x22
+	PropTopicAlias             = 0x23
+	PropMaximumQOS             = 0x24
+	PropRetainAvailable        = 0x25
+	PropUserProperty           = 0x26
+	PropMaximumPacketSize      = 0x27
+	PropWildcardSubAvailable   = 0x28
+	PropSubIDAvailable         = 0x29
+	PropSharedSubAvailable     = 0x2A
+)
+
+// UserProperty is a name/value pair carried in the properties of an MQTT 5 packet
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5 properties of a packet. Optional numeric
+// properties are pointers so that an absent property can be distinguished
+// from a zero value. Only the properties that are valid for a packet type
+// should be set, they are written as given and not validated.
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiryInterval  *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQOS             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+// Uint32 returns a pointer to v, for setting optional properties
+func Uint32(v uint32) *uint32 {
+	return &v
+}
+
+// Uint16 returns a pointer to v, for setting optional properties
+func Uint16(v uint16) *uint16 {
+	return &v
+}
+
+// Byte returns a pointer to v, for setting optional properties
+func Byte(v byte) *byte {
+	return &v
+}
+
+// Copy returns a shallow copy of the properties (slices are copied so that
+// appending to the copy does not change the original). A nil receiver
+// returns an empty set of properties.
+func (p *Properties) Copy() *Properties {
+	if p == nil {
+		return &Properties{}
+	}
+	cp := *p
+	cp.SubscriptionIdentifier = append([]int(nil), p.SubscriptionIdentifier...)
+	cp.User = append([]UserProperty(nil), p.User...)
+	return &cp
+}
+
+// GetUser returns the value of the first user property with the given key
+func (p *Properties) GetUser(key string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	for _, u := range p.User {
+		if u.Key == key {
+			return u.Value, true
+		}
+	}
+	return "", false
+}
+
+// String returns a short description of the properties that are set
+func (p *Properties) String() string {
+	if p == nil {
+		return "[]"
+	}
+	var b bytes.Buffer
+	p.encode(&b)
+	return fmt.Sprintf("[%d bytes, user: %v]", b.Len(), p.User)
+}
+
+// Pack encodes the properties, prefixed by their variable byte integer length
+func (p *Properties) Pack() []byte {
+	var body bytes.Buffer
+	if p != nil {
+		p.encode(&body)
+	}
+	return append(encodeLength(body.Len()), body.Bytes()...)
+}
+
+// empty reports whether no property is set
+func (p *Properties) empty() bool {
+	if p == nil {
+		return true
+	}
+	var body bytes.Buffer
+	p.encode(&body)
+	return body.Len() == 0
+}
+
+func (p *Properties) encode(b *bytes.Buffer) {
+	writeByteProp := func(id byte, v *byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.WriteByte(*v)
+		}
+	}
+	writeUint16Prop := func(id byte, v *uint16) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeUint16(*v))
+		}
+	}
+	writeUint32Prop := func(id byte, v *uint32) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeUint32(*v))
+		}
+	}
+	writeStringProp := func(id byte, v string) {
+		if v != "" {
+			b.WriteByte(id)
+			b.Write(encodeString(v))
+		}
+	}
+	writeBytesProp := func(id byte, v []byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeBytes(v))
+		}
+	}
+
+	writeByteProp(PropPayloadFormat, p.PayloadFormat)
+	writeUint32Prop(PropMessageExpiry, p.MessageExpiry)
+	writeStringProp(PropContentType, p.ContentType)
+	writeStringProp(PropResponseTopic, p.ResponseTopic)
+	writeBytesProp(PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifier {
+		b.WriteByte(PropSubscriptionIdentifier)
+		b.Write(encodeLength(id))
+	}
+	writeUint32Prop(PropSessionExpiryInterval, p.SessionExpiryInterval)
+	writeStringProp(PropAssignedClientID, p.AssignedClientID)
+	writeUint16Prop(PropServerKeepAlive, p.ServerKeepAlive)
+	writeStringProp(PropAuthMethod, p.AuthMethod)
+	writeBytesProp(PropAuthData, p.AuthData)
+	writeByteProp(PropRequestProblemInfo, p.RequestProblemInfo)
+	writeUint32Prop(PropWillDelayInterval, p.WillDelayInterval)
+	writeByteProp(PropRequestResponseInfo, p.RequestResponseInfo)
+	writeStringProp(PropResponseInfo, p.ResponseInfo)
+	writeStringProp(PropServerReference, p.ServerReference)
+	writeStringProp(PropReasonString, p.ReasonString)
+	writeUint16Prop(PropReceiveMaximum, p.ReceiveMaximum)
+	writeUint16Prop(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	writeUint16Prop(PropTopicAlias, p.TopicAlias)
+	writeByteProp(PropMaximumQOS, p.MaximumQOS)
+	writeByteProp(PropRetainAvailable, p.RetainAvailable)
+	for _, u := range p.User {
+		b.WriteByte(PropUserProperty)
+		b.Write(encodeString(u.Key))
+		b.Write(encodeString(u.Value))
+	}
+	writeUint32Prop(PropMaximumPacketSize, p.MaximumPacketSize)
+	writeByteProp(PropWildcardSubAvailable, p.WildcardSubAvailable)
+	writeByteProp(PropSubIDAvailable, p.SubIDAvailable)
+	writeByteProp(PropSharedSubAvailable, p.SharedSubAvailable)
+}
+
+// Unpack decodes the properties (including their length prefix) from r
+func (p *Properties) Unpack(r io.Reader) error {
+	length, err := decodeLength(r)
+	if err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	b := bytes.NewBuffer(buf)
+
+	for b.Len() > 0 {
+		id, err := b.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case PropPayloadFormat:
+			p.PayloadFormat, err = decodeBytePtr(b)
+		case PropMessageExpiry:
+			p.MessageExpiry, err = decodeUint32Ptr(b)
+		case PropContentType:
+			p.ContentType, err = decodeString(b)
+		case PropResponseTopic:
+			p.ResponseTopic, err = decodeString(b)
+		case PropCorrelationData:
+			p.CorrelationData, err = decodeBytes(b)
+		case PropSubscriptionIdentifier:
+			var id int
+			id, err = decodeLength(b)
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, id)
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, err = decodeUint32Ptr(b)
+		case PropAssignedClientID:
+			p.AssignedClientID, err = decodeString(b)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, err = decodeUint16Ptr(b)
+		case PropAuthMethod:
+			p.AuthMethod, err = decodeString(b)
+		case PropAuthData:
+			p.AuthData, err = decodeBytes(b)
+		case PropRequestProblemInfo:
+			p.RequestProblemInfo, err = decodeBytePtr(b)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, err = decodeUint32Ptr(b)
+		case PropRequestResponseInfo:
+			p.RequestResponseInfo, err = decodeBytePtr(b)
+		case PropResponseInfo:
+			p.ResponseInfo, err = decodeString(b)
+		case PropServerReference:
+			p.ServerReference, err = decodeString(b)
+		case PropReasonString:
+			p.ReasonString, err = decodeString(b)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, err = decodeUint16Ptr(b)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, err = decodeUint16Ptr(b)
+		case PropTopicAlias:
+			p.TopicAlias, err = decodeUint16Ptr(b)
+		case PropMaximumQOS:
+			p.MaximumQOS, err = decodeBytePtr(b)
+		case PropRetainAvailable:
+			p.RetainAvailable, err = decodeBytePtr(b)
+		case PropUserProperty:
+			var u UserProperty
+			if u.Key, err = decodeString(b); err == nil {
+				u.Value, err = decodeString(b)
+			}
+			p.User = append(p.User, u)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, err = decodeUint32Ptr(b)
+		case PropWildcardSubAvailable:
+			p.WildcardSubAvailable, err = decodeBytePtr(b)
+		case PropSubIDAvailable:
+			p.SubIDAvailable, err = decodeBytePtr(b)
+		case PropSharedSubAvailable:
+			p.SharedSubAvailable, err = decodeBytePtr(b)
+		default:
+			return fmt.Errorf("unknown property identifier 0x%x", id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeUint32(num uint32) []byte {
+	bytesResult := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytesResult, num)
+	return bytesResult
+}
+
+func decodeUint32(b io.Reader) (uint32, error) {
+	num := make([]byte, 4)
+	if _, err := io.ReadFull(b, num); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(num), nil
+}
+
+func decodeBytePtr(b io.Reader) (*byte, error) {
+	v, err := decodeByte(b)
+	return &v, err
+}
+
+func decodeUint16Ptr(b io.Reader) (*uint16, error) {
+	v, err := decodeUint16(b)
+	return &v, err
+}
+
+func decodeUint32Ptr(b io.Reader) (*uint32, error) {
+	v, err := decodeUint32(b)
+	return &v, err
+}
@@ -10,18 +10,21 @@ import (
 type PubackPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// MQTT 5 only
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pa *PubackPacket) String() string {
-	return fmt.Sprintf("%s MessageID: %d", pa.FixedHeader, pa.MessageID)
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pa.FixedHeader, pa.MessageID, pa.ReasonCode)
 }
 
 func (pa *PubackPacket) Write(w io.Writer) error {
-	var err error
-	pa.FixedHeader.RemainingLength = 2
+	body := packAck(&pa.FixedHeader, pa.MessageID, pa.ReasonCode, pa.Properties)
 	packet := pa.FixedHeader.pack()
-	packet.Write(encodeUint16(pa.MessageID))
-	_, err = packet.WriteTo(w)
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
 
 	return err
 }
@@ -30,7 +33,7 @@ func (pa *PubackPacket) Write(w io.Writer) error {
 // header has been read
 func (pa *PubackPacket) Unpack(b io.Reader) error {
 	var err error
-	pa.MessageID, err = decodeUint16(b)
+	pa.MessageID, pa.ReasonCode, pa.Properties, err = unpackAck(&pa.FixedHeader, b)
 
 	return err
 }
@@ -10,18 +10,21 @@ import (
 type PubcompPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// MQTT 5 only
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pc *PubcompPacket) String() string {
-	return fmt.Sprintf("%s MessageID: %d", pc.FixedHeader, pc.MessageID)
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pc.FixedHeader, pc.MessageID, pc.ReasonCode)
 }
 
 func (pc *PubcompPacket) Write(w io.Writer) error {
-	var err error
-	pc.FixedHeader.RemainingLength = 2
+	body := packAck(&pc.FixedHeader, pc.MessageID, pc.ReasonCode, pc.Properties)
 	packet := pc.FixedHeader.pack()
-	packet.Write(encodeUint16(pc.MessageID))
-	_, err = packet.WriteTo(w)
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
 
 	return err
 }
@@ -30,7 +33,7 @@ func (pc *PubcompPacket) Write(w io.Writer) error {
 // header has been read
 func (pc *PubcompPacket) Unpack(b io.Reader) error {
 	var err error
-	pc.MessageID, err = decodeUint16(b)
+	pc.MessageID, pc.ReasonCode, pc.Properties, err = unpackAck(&pc.FixedHeader, b)
 
 	return err
 }
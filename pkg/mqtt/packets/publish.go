@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 )
 
 // PublishPacket is an internal representation of the fields of the
@@ -13,10 +14,13 @@ type PublishPacket struct {
 	TopicName string
 	MessageID uint16
 	Payload   []byte
+
+	// MQTT 5 only
+	Properties *Properties
 }
 
 func (p *PublishPacket) String() string {
-	return fmt.Sprintf("%s topicName: %s MessageID: %d payload: %s", p.FixedHeader, p.TopicName, p.MessageID, string(p.Payload))
+	return fmt.Sprintf("%s topicName: %s MessageID: %d properties: %s payload: %s", p.FixedHeader, p.TopicName, p.MessageID, p.Properties, string(p.Payload))
 }
 
 func (p *PublishPacket) Write(w io.Writer) error {
@@ -27,6 +31,9 @@ func (p *PublishPacket) Write(w io.Writer) error {
 	if p.Qos > 0 {
 		body.Write(encodeUint16(p.MessageID))
 	}
+	if p.v5() {
+		body.Write(p.Properties.Pack())
+	}
 	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
 	packet := p.FixedHeader.pack()
 	packet.Write(body.Bytes())
@@ -46,6 +53,22 @@ func (p *PublishPacket) Unpack(b io.Reader) error {
 		return err
 	}
 
+	if p.v5() {
+		if p.Qos > 0 {
+			p.MessageID, err = decodeUint16(b)
+			if err != nil {
+				return err
+			}
+		}
+		p.Properties = &Properties{}
+		if err = p.Properties.Unpack(b); err != nil {
+			return err
+		}
+		// b holds exactly the remainder of this packet
+		p.Payload, err = ioutil.ReadAll(b)
+		return err
+	}
+
 	if p.Qos > 0 {
 		p.MessageID, err = decodeUint16(b)
 		if err != nil {
@@ -64,14 +87,18 @@ func (p *PublishPacket) Unpack(b io.Reader) error {
 	return err
 }
 
-// Copy creates a new PublishPacket with the same topic and payload
-// but an empty fixed header, useful for when you want to deliver
-// a message with different properties such as Qos but the same
-// content
+// Copy creates a new PublishPacket with the same topic, payload and
+// MQTT 5 properties but an otherwise empty fixed header, useful for
+// when you want to deliver a message with different properties such
+// as Qos but the same content
 func (p *PublishPacket) Copy() *PublishPacket {
 	newP := NewControlPacket(Publish).(*PublishPacket)
 	newP.TopicName = p.TopicName
 	newP.Payload = p.Payload
+	newP.Version = p.Version
+	if p.Properties != nil {
+		newP.Properties = p.Properties.Copy()
+	}
 
 	return newP
 }
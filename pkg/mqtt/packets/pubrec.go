@@ -10,18 +10,21 @@ import (
 type PubrecPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// MQTT 5 only
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pr *PubrecPacket) String() string {
-	return fmt.Sprintf("%s MessageID: %d", pr.FixedHeader, pr.MessageID)
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pr.FixedHeader, pr.MessageID, pr.ReasonCode)
 }
 
 func (pr *PubrecPacket) Write(w io.Writer) error {
-	var err error
-	pr.FixedHeader.RemainingLength = 2
+	body := packAck(&pr.FixedHeader, pr.MessageID, pr.ReasonCode, pr.Properties)
 	packet := pr.FixedHeader.pack()
-	packet.Write(encodeUint16(pr.MessageID))
-	_, err = packet.WriteTo(w)
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
 
 	return err
 }
@@ -30,7 +33,7 @@ func (pr *PubrecPacket) Write(w io.Writer) error {
 // header has been read
 func (pr *PubrecPacket) Unpack(b io.Reader) error {
 	var err error
-	pr.MessageID, err = decodeUint16(b)
+	pr.MessageID, pr.ReasonCode, pr.Properties, err = unpackAck(&pr.FixedHeader, b)
 
 	return err
 }
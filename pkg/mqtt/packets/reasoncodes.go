@@ -0,0 +1,130 @@
+package packets
+
+import "fmt"
+
+// Below are the MQTT 5 reason codes used in CONNACK, PUBACK, PUBREC, PUBREL,
+// PUBCOMP, SUBACK, UNSUBACK, DISCONNECT and AUTH. Codes below 0x80 indicate
+// success, codes of 0x80 and above indicate failure.
+const (
+	ReasonSuccess                     = 0x00
+	ReasonGrantedQoS1                 = 0x01
+	ReasonGrantedQoS2                 = 0x02
+	ReasonDisconnectWithWill          = 0x04
+	ReasonNoMatchingSubscribers       = 0x10
+	ReasonNoSubscriptionExisted       = 0x11
+	ReasonContinueAuthentication      = 0x18
+	ReasonReAuthenticate              = 0x19
+	ReasonUnspecifiedError            = 0x80
+	ReasonMalformedPacket             = 0x81
+	ReasonProtocolError               = 0x82
+	ReasonImplementationSpecificError = 0x83
+	ReasonUnsupportedProtocolVersion  = 0x84
+	ReasonClientIdentifierNotValid    = 0x85
+	ReasonBadUserNameOrPassword       = 0x86
+	ReasonNotAuthorized               = 0x87
+	ReasonServerUnavailable           = 0x88
+	ReasonServerBusy                  = 0x89
+	ReasonBanned                      = 0x8A
+	ReasonServerShuttingDown          = 0x8B
+	ReasonBadAuthenticationMethod     = 0x8C
+	ReasonKeepAliveTimeout            = 0x8D
+	ReasonSessionTakenOver            = 0x8E
+	ReasonTopicFilterInvalid          = 0x8F
+	ReasonTopicNameInvalid            = 0x90
+	ReasonPacketIdentifierInUse       = 0x91
+	ReasonPacketIdentifierNotFound    = 0x92
+	ReasonReceiveMaximumExceeded      = 0x93
+	ReasonTopicAliasInvalid           = 0x94
+	ReasonPacketTooLarge              = 0x95
+	ReasonMessageRateTooHigh          = 0x96
+	ReasonQuotaExceeded               = 0x97
+	ReasonAdministrativeAction        = 0x98
+	ReasonPayloadFormatInvalid        = 0x99
+	ReasonRetainNotSupported          = 0x9A
+	ReasonQoSNotSupported             = 0x9B
+	ReasonUseAnotherServer            = 0x9C
+	ReasonServerMoved                 = 0x9D
+	ReasonSharedSubNotSupported       = 0x9E
+	ReasonConnectionRateExceeded      = 0x9F
+	ReasonMaximumConnectTime          = 0xA0
+	ReasonSubIDNotSupported           = 0xA1
+	ReasonWildcardSubNotSupported     = 0xA2
+)
+
+// ReasonCodeNames maps the MQTT 5 reason codes to a string representation
+var ReasonCodeNames = map[byte]string{
+	ReasonSuccess:                     "Success",
+	ReasonGrantedQoS1:                 "Granted QoS 1",
+	ReasonGrantedQoS2:                 "Granted QoS 2",
+	ReasonDisconnectWithWill:          "Disconnect with Will Message",
+	ReasonNoMatchingSubscribers:       "No matching subscribers",
+	ReasonNoSubscriptionExisted:       "No subscription existed",
+	ReasonContinueAuthentication:      "Continue authentication",
+	ReasonReAuthenticate:              "Re-authenticate",
+	ReasonUnspecifiedError:            "Unspecified error",
+	ReasonMalformedPacket:             "Malformed Packet",
+	ReasonProtocolError:               "Protocol Error",
+	ReasonImplementationSpecificError: "Implementation specific error",
+	ReasonUnsupportedProtocolVersion:  "Unsupported Protocol Version",
+	ReasonClientIdentifierNotValid:    "Client Identifier not valid",
+	ReasonBadUserNameOrPassword:       "Bad User Name or Password",
+	ReasonNotAuthorized:               "Not authorized",
+	ReasonServerUnavailable:           "Server unavailable",
+	ReasonServerBusy:                  "Server busy",
+	ReasonBanned:                      "Banned",
+	ReasonServerShuttingDown:          "Server shutting down",
+	ReasonBadAuthenticationMethod:     "Bad authentication method",
+	ReasonKeepAliveTimeout:            "Keep Alive timeout",
+	ReasonSessionTakenOver:            "Session taken over",
+	ReasonTopicFilterInvalid:          "Topic Filter invalid",
+	ReasonTopicNameInvalid:            "Topic Name invalid",
+	ReasonPacketIdentifierInUse:       "Packet Identifier in use",
+	ReasonPacketIdentifierNotFound:    "Packet Identifier not found",
+	ReasonReceiveMaximumExceeded:      "Receive Maximum exceeded",
+	ReasonTopicAliasInvalid:           "Topic Alias invalid",
+	ReasonPacketTooLarge:              "Packet too large",
+	ReasonMessageRateTooHigh:          "Message rate too high",
+	ReasonQuotaExceeded:               "Quota exceeded",
+	ReasonAdministrativeAction:        "Administrative action",
+	ReasonPayloadFormatInvalid:        "Payload format invalid",
+	ReasonRetainNotSupported:          "Retain not supported",
+	ReasonQoSNotSupported:             "QoS not supported",
+	ReasonUseAnotherServer:            "Use another server",
+	ReasonServerMoved:                 "Server moved",
+	ReasonSharedSubNotSupported:       "Shared Subscriptions not supported",
+	ReasonConnectionRateExceeded:      "Connection rate exceeded",
+	ReasonMaximumConnectTime:          "Maximum connect time",
+	ReasonSubIDNotSupported:           "Subscription Identifiers not supported",
+	ReasonWildcardSubNotSupported:     "Wildcard Subscriptions not supported",
+}
+
+// ReasonError is returned when an MQTT 5 server answers with a failure
+// reason code (0x80 or above)
+type ReasonError struct {
+	Code   byte
+	Reason string // the reason string property sent by the server, if any
+}
+
+func (e *ReasonError) Error() string {
+	name, ok := ReasonCodeNames[e.Code]
+	if !ok {
+		name = "Unknown reason code"
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("%s (0x%02x): %s", name, e.Code, e.Reason)
+	}
+	return fmt.Sprintf("%s (0x%02x)", name, e.Code)
+}
+
+// NewReasonError returns a *ReasonError for code, or nil if code indicates
+// success. props may be nil.
+func NewReasonError(code byte, props *Properties) error {
+	if code < 0x80 {
+		return nil
+	}
+	e := &ReasonError{Code: code}
+	if props != nil {
+		e.Reason = props.ReasonString
+	}
+	return e
+}
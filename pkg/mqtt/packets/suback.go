@@ -11,7 +11,10 @@ import (
 type SubackPacket struct {
 	FixedHeader
 	MessageID   uint16
-	ReturnCodes []byte
+	ReturnCodes []byte // the reason codes for MQTT 5
+
+	// MQTT 5 only
+	Properties *Properties
 }
 
 func (sa *SubackPacket) String() string {
@@ -22,6 +25,9 @@ func (sa *SubackPacket) Write(w io.Writer) error {
 	var body bytes.Buffer
 	var err error
 	body.Write(encodeUint16(sa.MessageID))
+	if sa.v5() {
+		body.Write(sa.Properties.Pack())
+	}
 	body.Write(sa.ReturnCodes)
 	sa.FixedHeader.RemainingLength = body.Len()
 	packet := sa.FixedHeader.pack()
@@ -40,6 +46,12 @@ func (sa *SubackPacket) Unpack(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if sa.v5() {
+		sa.Properties = &Properties{}
+		if err = sa.Properties.Unpack(b); err != nil {
+			return err
+		}
+	}
 
 	_, err = qosBuffer.ReadFrom(b)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 )
 
 // SubscribePacket is an internal representation of the fields of the
@@ -12,7 +13,10 @@ type SubscribePacket struct {
 	FixedHeader
 	MessageID uint16
 	Topics    []string
-	Qoss      []byte
+	Qoss      []byte // for MQTT 5 these are the subscription options, with the QoS in the lowest two bits
+
+	// MQTT 5 only
+	Properties *Properties
 }
 
 func (s *SubscribePacket) String() string {
@@ -24,6 +28,9 @@ func (s *SubscribePacket) Write(w io.Writer) error {
 	var err error
 
 	body.Write(encodeUint16(s.MessageID))
+	if s.v5() {
+		body.Write(s.Properties.Pack())
+	}
 	for i, topic := range s.Topics {
 		body.Write(encodeString(topic))
 		body.WriteByte(s.Qoss[i])
@@ -44,7 +51,22 @@ func (s *SubscribePacket) Unpack(b io.Reader) error {
 	if err != nil {
 		return err
 	}
-	payloadLength := s.FixedHeader.RemainingLength - 2
+	if s.v5() {
+		s.Properties = &Properties{}
+		if err = s.Properties.Unpack(b); err != nil {
+			return err
+		}
+		rest, err := ioutil.ReadAll(b)
+		if err != nil {
+			return err
+		}
+		return s.unpackTopics(bytes.NewBuffer(rest), len(rest))
+	}
+	return s.unpackTopics(b, s.FixedHeader.RemainingLength-2)
+}
+
+// unpackTopics decodes the topic filters and their options from the payload
+func (s *SubscribePacket) unpackTopics(b io.Reader, payloadLength int) error {
 	for payloadLength > 0 {
 		topic, err := decodeString(b)
 		if err != nil {
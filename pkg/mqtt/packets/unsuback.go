@@ -1,8 +1,10 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 )
 
 // UnsubackPacket is an internal representation of the fields of the
@@ -10,6 +12,10 @@ import (
 type UnsubackPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// MQTT 5 only
+	Properties  *Properties
+	ReasonCodes []byte
 }
 
 func (ua *UnsubackPacket) String() string {
@@ -17,10 +23,16 @@ func (ua *UnsubackPacket) String() string {
 }
 
 func (ua *UnsubackPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
 	var err error
-	ua.FixedHeader.RemainingLength = 2
+	body.Write(encodeUint16(ua.MessageID))
+	if ua.v5() {
+		body.Write(ua.Properties.Pack())
+		body.Write(ua.ReasonCodes)
+	}
+	ua.FixedHeader.RemainingLength = body.Len()
 	packet := ua.FixedHeader.pack()
-	packet.Write(encodeUint16(ua.MessageID))
+	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -31,6 +43,14 @@ func (ua *UnsubackPacket) Write(w io.Writer) error {
 func (ua *UnsubackPacket) Unpack(b io.Reader) error {
 	var err error
 	ua.MessageID, err = decodeUint16(b)
+	if err != nil || !ua.v5() {
+		return err
+	}
+	ua.Properties = &Properties{}
+	if err = ua.Properties.Unpack(b); err != nil {
+		return err
+	}
+	ua.ReasonCodes, err = ioutil.ReadAll(b)
 
 	return err
 }
@@ -13,14 +13,15 @@ import (
 // connection passed in to avoid race condition on shutdown
 func keepalive(c *client, conn io.Writer) {
 	defer c.workers.Done()
-	DEBUG.Println(PNG, "keepalive starting")
+	c.logs.DEBUG.Println(PNG, "keepalive starting")
 	var checkInterval int64
 	var pingSent time.Time
 
-	if c.options.KeepAlive > 10 {
+	keepAlive := c.keepAlive()
+	if keepAlive > 10 {
 		checkInterval = 5
 	} else {
-		checkInterval = c.options.KeepAlive / 2
+		checkInterval = keepAlive / 2
 	}
 
 	intervalTicker := time.NewTicker(time.Duration(checkInterval * int64(time.Second)))
@@ -29,29 +30,29 @@ func keepalive(c *client, conn io.Writer) {
 	for {
 		select {
 		case <-c.stop:
-			DEBUG.Println(PNG, "keepalive stopped")
+			c.logs.DEBUG.Println(PNG, "keepalive stopped")
 			return
 		case <-intervalTicker.C:
 			lastSent := c.lastSent.Load().(time.Time)
 			lastReceived := c.lastReceived.Load().(time.Time)
 
-			DEBUG.Println(PNG, "ping check", time.Since(lastSent).Seconds())
-			if time.Since(lastSent) >= time.Duration(c.options.KeepAlive*int64(time.Second)) || time.Since(lastReceived) >= time.Duration(c.options.KeepAlive*int64(time.Second)) {
+			c.logs.DEBUG.Println(PNG, "ping check", time.Since(lastSent).Seconds())
+			if time.Since(lastSent) >= time.Duration(keepAlive*int64(time.Second)) || time.Since(lastReceived) >= time.Duration(keepAlive*int64(time.Second)) {
 				if atomic.LoadInt32(&c.pingOutstanding) == 0 {
-					DEBUG.Println(PNG, "keepalive sending ping")
+					c.logs.DEBUG.Println(PNG, "keepalive sending ping")
 					ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
 					// We don't want to wait behind large messages being sent, the Write call
 					// will block until it it able to send the packet.
 					atomic.StoreInt32(&c.pingOutstanding, 1)
 					if err := ping.Write(conn); err != nil {
-						ERROR.Println(PNG, err)
+						c.logs.ERROR.Println(PNG, err)
 					}
 					c.lastSent.Store(time.Now())
 					pingSent = time.Now()
 				}
 			}
 			if atomic.LoadInt32(&c.pingOutstanding) > 0 && time.Since(pingSent) >= c.options.PingTimeout {
-				CRITICAL.Println(PNG, "pingresp not received, disconnecting")
+				c.logs.CRITICAL.Println(PNG, "pingresp not received, disconnecting")
 				c.internalConnLost(errors.New("pingresp not received, disconnecting")) // no harm in calling this if the connection is already down (or shutdown is in progress)
 				return
 			}
@@ -121,10 +121,10 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 	ackChan := make(chan *PacketAndToken)
 	go func() {
 		for message := range messages {
-			// DEBUG.Println(ROU, "matchAndDispatch received message")
+			// client.logs.DEBUG.Println(ROU, "matchAndDispatch received message")
 			sent := false
 			r.RLock()
-			m := messageFromPublish(message, ackFunc(ackChan, client.persist, message))
+			m := messageFromPublish(message, ackFunc(ackChan, client.persist, message, client.logs))
 			var handlers []MessageHandler
 			for e := r.routes.Front(); e != nil; e = e.Next() {
 				if e.Value.(*route).match(message.TopicName) {
@@ -151,7 +151,7 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 						}()
 					}
 				} else {
-					DEBUG.Println(ROU, "matchAndDispatch received message and no handler was available. Message will NOT be acknowledged.")
+					client.logs.DEBUG.Println(ROU, "matchAndDispatch received message and no handler was available. Message will NOT be acknowledged.")
 				}
 			}
 			r.RUnlock()
@@ -159,10 +159,10 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 				handler(client, m)
 				m.Ack()
 			}
-			// DEBUG.Println(ROU, "matchAndDispatch handled message")
+			// client.logs.DEBUG.Println(ROU, "matchAndDispatch handled message")
 		}
 		close(ackChan)
-		DEBUG.Println(ROU, "matchAndDispatch exiting")
+		client.logs.DEBUG.Println(ROU, "matchAndDispatch exiting")
 	}()
 	return ackChan
 }
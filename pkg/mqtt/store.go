@@ -27,6 +27,15 @@ type Store interface {
 	Reset()
 }
 
+// VersionedStore is implemented by stores that persist packets in their
+// wire encoding and therefore need the protocol version to decode them
+// (MQTT 5 packets carry properties). The client calls SetProtocolVersion
+// when it is created, before the store is opened.
+type VersionedStore interface {
+	Store
+	SetProtocolVersion(version byte)
+}
+
 // A key MUST have the form "X.[messageid]"
 // where X is 'i' or 'o'
 func mIDFromKey(key string) uint16 {
@@ -57,7 +66,7 @@ func outboundKeyFromMID(id uint16) string {
 }
 
 // govern which outgoing messages are persisted
-func persistOutbound(s Store, m packets.ControlPacket) {
+func persistOutbound(s Store, m packets.ControlPacket, logs *loggers) {
 	switch m.Details().Qos {
 	case 0:
 		switch m.(type) {
@@ -73,7 +82,7 @@ func persistOutbound(s Store, m packets.ControlPacket) {
 			// until puback received
 			s.Put(outboundKeyFromMID(m.Details().MessageID), m)
 		default:
-			ERROR.Println(STR, "Asked to persist an invalid message type")
+			logs.ERROR.Println(STR, "Asked to persist an invalid message type")
 		}
 	case 2:
 		switch m.(type) {
@@ -82,13 +91,13 @@ func persistOutbound(s Store, m packets.ControlPacket) {
 			// until pubrel received
 			s.Put(outboundKeyFromMID(m.Details().MessageID), m)
 		default:
-			ERROR.Println(STR, "Asked to persist an invalid message type")
+			logs.ERROR.Println(STR, "Asked to persist an invalid message type")
 		}
 	}
 }
 
 // govern which incoming messages are persisted
-func persistInbound(s Store, m packets.ControlPacket) {
+func persistInbound(s Store, m packets.ControlPacket, logs *loggers) {
 	switch m.Details().Qos {
 	case 0:
 		switch m.(type) {
@@ -96,9 +105,15 @@ func persistInbound(s Store, m packets.ControlPacket) {
 			// Received a puback. delete matching publish
 			// from obound
 			s.Del(outboundKeyFromMID(m.Details().MessageID))
-		case *packets.PublishPacket, *packets.PubrecPacket, *packets.PingrespPacket, *packets.ConnackPacket:
+		case *packets.PubrecPacket:
+			// A PUBREC with a failure reason code (MQTT 5) ends the flow,
+			// no PUBREL will follow so delete the matching publish
+			if m.(*packets.PubrecPacket).ReasonCode >= 0x80 {
+				s.Del(outboundKeyFromMID(m.Details().MessageID))
+			}
+		case *packets.PublishPacket, *packets.PingrespPacket, *packets.ConnackPacket, *packets.DisconnectPacket, *packets.AuthPacket:
 		default:
-			ERROR.Println(STR, "Asked to persist an invalid messages type")
+			logs.ERROR.Println(STR, "Asked to persist an invalid messages type")
 		}
 	case 1:
 		switch m.(type) {
@@ -107,7 +122,7 @@ func persistInbound(s Store, m packets.ControlPacket) {
 			// until puback sent
 			s.Put(inboundKeyFromMID(m.Details().MessageID), m)
 		default:
-			ERROR.Println(STR, "Asked to persist an invalid messages type")
+			logs.ERROR.Println(STR, "Asked to persist an invalid messages type")
 		}
 	case 2:
 		switch m.(type) {
@@ -116,7 +131,7 @@ func persistInbound(s Store, m packets.ControlPacket) {
 			// until pubrel received
 			s.Put(inboundKeyFromMID(m.Details().MessageID), m)
 		default:
-			ERROR.Println(STR, "Asked to persist an invalid messages type")
+			logs.ERROR.Println(STR, "Asked to persist an invalid messages type")
 		}
 	}
 }
@@ -125,6 +125,7 @@ type ConnectToken struct {
 	baseToken
 	returnCode     byte
 	sessionPresent bool
+	properties     *packets.Properties
 }
 
 // ReturnCode returns the acknowledgement code in the connack sent
@@ -143,6 +144,14 @@ func (c *ConnectToken) SessionPresent() bool {
 	return c.sessionPresent
 }
 
+// Properties returns the properties of the connack sent in response
+// to a Connect() with MQTT 5, nil for older protocol versions
+func (c *ConnectToken) Properties() *packets.Properties {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.properties
+}
+
 // PublishToken is an extension of Token containing the extra fields
 // required to provide information about calls to Publish()
 type PublishToken struct {
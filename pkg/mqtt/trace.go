@@ -1,5 +1,12 @@
 package mqtt
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
 type (
 	// Logger interface allows implementations to provide to this package any
 	// object that implements the methods defined in it.
@@ -18,9 +25,114 @@ func (NOOPLogger) Printf(format string, v ...interface{}) {}
 
 // Internal levels of library output that are initialised to not print
 // anything but can be overridden by programmer
+// INFO carries connection lifecycle events (connect, connection lost, reconnect)
+// Clients created with ClientOptions.SetLogger log through their own loggers
+// and do not use these.
 var (
 	ERROR    Logger = NOOPLogger{}
 	CRITICAL Logger = NOOPLogger{}
 	WARN     Logger = NOOPLogger{}
+	INFO     Logger = NOOPLogger{}
 	DEBUG    Logger = NOOPLogger{}
 )
+
+// logBridge is a Logger that forwards to a structured logger. A component
+// passed as the first argument (CLI, NET, STR...) becomes the "component"
+// field, logger.Fields arguments are merged into the entry, and context adds
+// fields describing the client such as its ID and the current broker.
+type logBridge struct {
+	log     *logger.Logger
+	level   logger.Level
+	context func() logger.Fields
+}
+
+func (b logBridge) fields() logger.Fields {
+	fields := logger.Fields{"mqtt": "paho"}
+	if b.context != nil {
+		for k, v := range b.context() {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// Println logs v joined by spaces, as fmt.Println would print it
+func (b logBridge) Println(v ...interface{}) {
+	fields := b.fields()
+	args := make([]interface{}, 0, len(v))
+	for i, arg := range v {
+		switch arg := arg.(type) {
+		case logger.Fields:
+			for k, value := range arg {
+				fields[k] = value
+			}
+			continue
+		case component:
+			if i == 0 {
+				fields["component"] = strings.Trim(string(arg), "[] ")
+				continue
+			}
+		}
+		args = append(args, arg)
+	}
+	b.log.WithFields(fields).Log(b.level, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+// Printf logs a formatted message with the context fields
+func (b logBridge) Printf(format string, v ...interface{}) {
+	b.log.WithFields(b.fields()).Logf(b.level, strings.TrimSuffix(format, "\n"), v...)
+}
+
+// loggers are the level loggers used by one client, its store and the
+// goroutines it starts. Clients created with ClientOptions.SetLogger get their
+// own bridges; other clients use packageLoggers.
+type loggers struct {
+	ERROR    Logger
+	CRITICAL Logger
+	WARN     Logger
+	INFO     Logger
+	DEBUG    Logger
+}
+
+// globalLogger forwards to one of the package level loggers, read at each
+// call so that assigning ERROR, WARN... keeps working after a client exists.
+type globalLogger struct {
+	l *Logger
+}
+
+func (g globalLogger) Println(v ...interface{})               { (*g.l).Println(v...) }
+func (g globalLogger) Printf(format string, v ...interface{}) { (*g.l).Printf(format, v...) }
+
+// packageLoggers are used by clients without a structured logger and by code
+// that does not belong to a client
+var packageLoggers = &loggers{
+	ERROR:    globalLogger{&ERROR},
+	CRITICAL: globalLogger{&CRITICAL},
+	WARN:     globalLogger{&WARN},
+	INFO:     globalLogger{&INFO},
+	DEBUG:    globalLogger{&DEBUG},
+}
+
+// newLoggers returns bridges to log for the levels up to and including level,
+// and NOOPLogger for the others. The package level loggers are not modified.
+func newLoggers(log *logger.Logger, level logger.Level, context func() logger.Fields) *loggers {
+	bridge := func(l logger.Level) Logger {
+		if l > level {
+			return NOOPLogger{}
+		}
+		return logBridge{log: log, level: l, context: context}
+	}
+	return &loggers{
+		ERROR:    bridge(logger.ErrorLevel),
+		CRITICAL: bridge(logger.ErrorLevel),
+		WARN:     bridge(logger.WarnLevel),
+		INFO:     bridge(logger.InfoLevel),
+		DEBUG:    bridge(logger.DebugLevel),
+	}
+}
+
+// loggedStore is implemented by the stores of this package, which log
+// through the loggers of the client using them
+type loggedStore interface {
+	setLoggers(logs *loggers)
+}
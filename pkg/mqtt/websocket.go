@@ -5,20 +5,32 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
+	"github.com/zsy-cn/4g-gateway/pkg/net/proxy"
 	"github.com/zsy-cn/4g-gateway/pkg/websocket"
 )
 
+// ProxyFunction returns the proxy to use for a websocket request, or nil
+// for a direct connection. See http.ProxyFromEnvironment and http.ProxyURL.
+type ProxyFunction func(req *http.Request) (*url.URL, error)
+
 // WebsocketOptions are config options for a websocket dialer
 type WebsocketOptions struct {
 	ReadBufferSize  int
 	WriteBufferSize int
+	Proxy           ProxyFunction // Defaults to http.ProxyFromEnvironment when nil
 }
 
 // NewWebsocket returns a new websocket and returns a net.Conn compatible interface using the gorilla/websocket package
 func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions) (net.Conn, error) {
+	return newWebsocket(host, tlsc, timeout, requestHeader, options, nil)
+}
+
+// newWebsocket is NewWebsocket with the TCP connection made by netDialer (net.Dial when nil)
+func newWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions, netDialer proxy.Dialer) (net.Conn, error) {
 	if timeout == 0 {
 		timeout = 10 * time.Second
 	}
@@ -28,8 +40,13 @@ func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestH
 		options = &WebsocketOptions{}
 	}
 
+	proxyFunc := options.Proxy
+	if proxyFunc == nil {
+		proxyFunc = http.ProxyFromEnvironment
+	}
+
 	dialer := &websocket.Dialer{
-		Proxy:             http.ProxyFromEnvironment,
+		Proxy:             proxyFunc,
 		HandshakeTimeout:  timeout,
 		EnableCompression: false,
 		TLSClientConfig:   tlsc,
@@ -37,6 +54,11 @@ func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestH
 		ReadBufferSize:    options.ReadBufferSize,
 		WriteBufferSize:   options.WriteBufferSize,
 	}
+	if contextDialer, ok := netDialer.(proxy.ContextDialer); ok {
+		dialer.NetDialContext = contextDialer.DialContext
+	} else if netDialer != nil {
+		dialer.NetDial = netDialer.Dial
+	}
 
 	ws, _, err := dialer.Dial(host, requestHeader)
 
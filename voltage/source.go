@@ -0,0 +1,139 @@
+package voltage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zsy-cn/4g-gateway/at"
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// 电压来源
+// SourceSysfs Linux IIO 或 hwmon 的 sysfs 文件，如 in_voltage0_raw、in0_input
+// SourceADC ADC 驱动导出的原始读数文件
+// SourceAT EC20 的 AT+CBC 命令，返回模块的供电电压 (mV)
+const (
+	SourceSysfs = "sysfs"
+	SourceADC   = "adc"
+	SourceAT    = "at"
+)
+
+// Source 电压来源，Read 返回未换算的读数
+type Source interface {
+	Read() (float64, error)
+}
+
+// NewSource 根据配置创建电压来源
+func NewSource(log *logger.Logger, voltageConfig *config.VoltageConfig) (Source, error) {
+	switch voltageConfig.Source {
+	case SourceSysfs:
+		if len(voltageConfig.Path) == 0 {
+			return nil, errors.New("voltage path is required")
+		}
+		return &sysfsSource{path: voltageConfig.Path, iioScale: iioScalePath(voltageConfig.Path)}, nil
+	case SourceADC:
+		if len(voltageConfig.Path) == 0 {
+			return nil, errors.New("voltage path is required")
+		}
+		return &fileSource{path: voltageConfig.Path}, nil
+	case SourceAT:
+		if len(voltageConfig.Port) == 0 {
+			return nil, errors.New("voltage port is required")
+		}
+		return &atSource{log: log, port: voltageConfig.Port}, nil
+	}
+	return nil, fmt.Errorf("unknown voltage source %q", voltageConfig.Source)
+}
+
+// readNumber 读取只包含一个数值的文件
+func readNumber(path string) (float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
+
+// fileSource 读取文件中的数值
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Read() (float64, error) {
+	return readNumber(s.path)
+}
+
+// sysfsSource 读取 sysfs 文件，IIO 的 _raw 文件乘以 _scale 换算为 mV
+type sysfsSource struct {
+	path     string
+	iioScale string // 为空时读数已经是 mV (hwmon)
+}
+
+// iioScalePath IIO _raw 文件对应的 _scale 文件
+// in_voltage0_raw 优先使用 in_voltage0_scale，其次是通道共用的 in_voltage_scale
+func iioScalePath(path string) string {
+	if !strings.HasSuffix(path, "_raw") {
+		return ""
+	}
+	scale := strings.TrimSuffix(path, "_raw") + "_scale"
+	if _, err := readNumber(scale); err == nil {
+		return scale
+	}
+	dir, name := filepath.Split(strings.TrimSuffix(path, "_raw"))
+	shared := filepath.Join(dir, strings.TrimRight(name, "0123456789")+"_scale")
+	if _, err := readNumber(shared); err == nil {
+		return shared
+	}
+	return ""
+}
+
+func (s *sysfsSource) Read() (float64, error) {
+	value, err := readNumber(s.path)
+	if err != nil {
+		return 0, err
+	}
+	if s.iioScale == "" {
+		return value, nil
+	}
+	scale, err := readNumber(s.iioScale)
+	if err != nil {
+		return 0, err
+	}
+	return value * scale, nil
+}
+
+// cbcPattern AT+CBC 的返回值 +CBC: <bcs>,<bcl>,<voltage>
+var cbcPattern = regexp.MustCompile(`\+CBC:\s*\d+,\s*\d+,\s*(\d+)`)
+
+// ParseCBC 解析 AT+CBC 的返回值，返回电压 (mV)
+func ParseCBC(response string) (float64, error) {
+	match := cbcPattern.FindStringSubmatch(response)
+	if match == nil {
+		return 0, fmt.Errorf("unexpected AT+CBC response %q", strings.TrimSpace(response))
+	}
+	return strconv.ParseFloat(match[1], 64)
+}
+
+// atSource 通过 AT 串口共用的引擎发送 AT+CBC
+type atSource struct {
+	log  *logger.Logger
+	port string
+}
+
+func (s *atSource) Read() (float64, error) {
+	engine, err := at.Shared(s.log, s.port)
+	if err != nil {
+		return 0, err
+	}
+	response, err := engine.Command("AT+CBC", 0)
+	if err != nil {
+		return 0, err
+	}
+	return ParseCBC(strings.Join(response.Lines, "\n"))
+}
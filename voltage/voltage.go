@@ -0,0 +1,183 @@
+package voltage
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/zsy-cn/4g-gateway/config"
+	"github.com/zsy-cn/4g-gateway/model"
+	"github.com/zsy-cn/4g-gateway/outbox"
+	"github.com/zsy-cn/4g-gateway/pkg/logger"
+)
+
+// 供电状态
+// StateNormal 正常
+// StateUnder 欠压
+// StateOver 过压
+const (
+	StateNormal = "normal"
+	StateUnder  = "under-voltage"
+	StateOver   = "over-voltage"
+)
+
+// EventRecovered 电压恢复正常的告警事件，欠压和过压事件与状态同名
+const EventRecovered = "recovered"
+
+// Reading 周期上传的电压读数，单位 V
+type Reading struct {
+	Time    time.Time `json:"time"`
+	Voltage float64   `json:"voltage"` // 最近一次采样
+	Min     float64   `json:"min"`     // 本周期内的最低电压
+	Max     float64   `json:"max"`     // 本周期内的最高电压
+	Samples int       `json:"samples"`
+	State   string    `json:"state"`
+}
+
+// Alarm 欠压、过压及恢复告警，采样时立即写入发送队列
+type Alarm struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Voltage   float64   `json:"voltage"`
+	Threshold float64   `json:"threshold"` // 触发事件的阈值，恢复时为阈值加减回差
+}
+
+// Monitor 带回差的欠压、过压判断
+// 电压低于 underVoltage 进入欠压，高于 underVoltage + hysteresis 才恢复
+// 电压高于 overVoltage 进入过压，低于 overVoltage - hysteresis 才恢复
+type Monitor struct {
+	under      float64
+	over       float64
+	hysteresis float64
+	state      string
+}
+
+// NewMonitor 创建 Monitor，初始状态为正常
+func NewMonitor(voltageConfig *config.VoltageConfig) *Monitor {
+	return &Monitor{
+		under:      voltageConfig.UnderVoltage,
+		over:       voltageConfig.OverVoltage,
+		hysteresis: math.Abs(voltageConfig.Hysteresis),
+		state:      StateNormal,
+	}
+}
+
+// State 当前状态
+func (m *Monitor) State() string {
+	return m.state
+}
+
+// Update 根据新的电压更新状态，状态变化时返回告警
+func (m *Monitor) Update(voltage float64) *Alarm {
+	switch m.state {
+	case StateUnder:
+		if voltage >= m.under+m.hysteresis {
+			return m.transit(StateNormal, EventRecovered, voltage, m.under+m.hysteresis)
+		}
+	case StateOver:
+		if voltage <= m.over-m.hysteresis {
+			return m.transit(StateNormal, EventRecovered, voltage, m.over-m.hysteresis)
+		}
+	default:
+		if m.under > 0 && voltage < m.under {
+			return m.transit(StateUnder, StateUnder, voltage, m.under)
+		}
+		if m.over > 0 && voltage > m.over {
+			return m.transit(StateOver, StateOver, voltage, m.over)
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) transit(state string, event string, voltage float64, threshold float64) *Alarm {
+	m.state = state
+	return &Alarm{
+		Time:      time.Now(),
+		Event:     event,
+		Voltage:   voltage,
+		Threshold: threshold,
+	}
+}
+
+// Run 按 sampleInterval 采样，按 period 上传读数，欠压、过压及恢复时立即上传告警
+func Run(
+	log *logger.Logger,
+	ob *outbox.Outbox,
+	voltageConfig *config.VoltageConfig,
+) {
+	if !voltageConfig.Enabled {
+		log.WithFields(logger.Fields{
+			"voltage": "run",
+		}).Info("Voltage monitor disabled")
+		return
+	}
+	source, err := NewSource(log, voltageConfig)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"voltage": "init",
+		}).Error("Init voltage source: ", err)
+		return
+	}
+
+	sampleInterval := time.Duration(voltageConfig.SampleInterval) * time.Second
+	if sampleInterval <= 0 {
+		sampleInterval = 5 * time.Second
+	}
+	period := time.Duration(voltageConfig.Period) * time.Second
+	monitor := NewMonitor(voltageConfig)
+
+	var R *Reading
+	lastPublish := time.Now()
+	for {
+		raw, err := source.Read()
+		if err != nil {
+			log.WithFields(logger.Fields{
+				"voltage": "sample",
+				"source":  voltageConfig.Source,
+			}).Error("Read voltage: ", err)
+		} else {
+			voltage := raw*voltageConfig.Scale + voltageConfig.Offset
+			if alarm := monitor.Update(voltage); alarm != nil {
+				log.WithFields(logger.Fields{
+					"voltage": "alarm",
+					"event":   alarm.Event,
+					"value":   voltage,
+				}).Warn("Voltage alarm")
+				put(log, ob, model.KindVoltageAlarm, alarm)
+			}
+
+			if R == nil {
+				R = &Reading{Min: voltage, Max: voltage}
+			}
+			R.Time = time.Now()
+			R.Voltage = voltage
+			R.Min = math.Min(R.Min, voltage)
+			R.Max = math.Max(R.Max, voltage)
+			R.Samples++
+			R.State = monitor.State()
+		}
+
+		if period > 0 && time.Since(lastPublish) >= period && R != nil {
+			put(log, ob, model.KindVoltage, R)
+			R = nil
+			lastPublish = time.Now()
+		}
+		time.Sleep(sampleInterval)
+	}
+}
+
+// put 写入发送队列
+func put(log *logger.Logger, ob *outbox.Outbox, kind string, v interface{}) {
+	mqttData, err := json.Marshal(v)
+	if err != nil {
+		log.WithFields(logger.Fields{
+			"voltage": "run",
+		}).Error("MQTT Json Marshal Err:", err)
+		return
+	}
+	if err := ob.Put(kind, string(mqttData)); err != nil {
+		log.WithFields(logger.Fields{
+			"voltage": "run",
+		}).Error("Outbox Put Err:", err)
+	}
+}